@@ -21,7 +21,11 @@ func main() {
 	conf, err := internal.ConfigFromEnv()
 	must(err)
 
+	presets, err := imageservice.LoadPresets(conf.PresetsFile())
+	must(err)
+
 	imgService := imageservice.NewService(time.Second * 10) //TODO: config
+	warmer := imageservice.NewWarmer(imgService, 256)
 	cluster := internal.NewCluster()
 	go func() {
 		// check if fist gateway instance is up, if not, wait a bit to avoid host resolution errors
@@ -37,7 +41,12 @@ func main() {
 		log.Println("joined cluster")
 	}()
 
-	http.HandleFunc("/image", api.ImageHandler(cluster, imgService))
+	http.HandleFunc("/image", api.ImageHandler(cluster, imgService, presets))
+	http.HandleFunc("/placeholder", api.PlaceholderHandler(cluster, imgService))
+	http.HandleFunc("/info", api.InfoHandler(cluster, imgService))
+	http.HandleFunc("/srcset", api.SrcsetHandler(cluster, imgService, presets, warmer, conf.PublicUrl()))
+	http.HandleFunc("/purge", api.PurgeHandler(cluster, imgService))
+	http.HandleFunc("/duplicates", api.DuplicatesHandler(cluster, imgService))
 	http.HandleFunc("/health", api.HealthHandler(cluster))
 	http.Handle("/metrics", promhttp.Handler())
 
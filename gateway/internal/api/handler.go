@@ -12,13 +12,15 @@ import (
 	"math/big"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 const internalErrStr = "internal server error"
 
 // ImageHandler gets a cached image from the worker cluster
-func ImageHandler(cluster internal.Cluster, service *imageservice.Service) http.HandlerFunc {
+func ImageHandler(cluster internal.Cluster, service *imageservice.Service, presets *imageservice.Presets) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		prom.ImageHandlerHits.Inc()
 
@@ -37,50 +39,481 @@ func ImageHandler(cluster internal.Cluster, service *imageservice.Service) http.
 			return
 		}
 
-		clusterLen := len(cluster.WorkerNodes())
-		if clusterLen == 0 {
-			log.Println("ImageHandler (gateway) error cluster not available")
-			http.Error(w, internalErrStr, http.StatusInternalServerError)
+		opts, err := presets.ParseOptions(r.URL.Query())
+		if err != nil {
+			log.Println("ImageHandler (gateway) error parsing options:", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			prom.ImageHandlerErrors.Inc()
 			return
 		}
 
-		workerId := idFromUrl(imgUrl, clusterLen)
-		worker := cluster.WorkerNodes()[workerId]
-		workerUrl := fmt.Sprintf("http://%s:%d", worker.Addr.String(), 8080)
+		if opts.Format == imageservice.FormatAuto {
+			// the resolved format ends up in the variant key of the worker
+			opts.Format = imageservice.NegotiateFormat(r.Header.Get("Accept"))
+			w.Header().Set("Vary", "Accept")
+		}
 
-		log.Println("nodeId from string is", workerId, workerUrl)
+		workerUrl, err := workerUrlFor(cluster, imgUrl)
+		if err != nil {
+			log.Println("ImageHandler (gateway) error", err)
+			http.Error(w, internalErrStr, http.StatusInternalServerError)
+			prom.ImageHandlerErrors.Inc()
+			return
+		}
 
-		raw, err := service.GetImage(workerUrl, imgUrl)
-		if errors.Is(err, imageservice.ErrNotFound) { // post image and update raw variable if not cached
-			img, err := service.CacheImage(workerUrl, imgUrl)
+		img, err := service.GetImage(workerUrl, imgUrl, opts)
+		if errors.Is(err, imageservice.ErrNotFound) { // post image and update img variable if not cached
+			img, err = service.CacheImage(workerUrl, imgUrl, opts)
 			if err != nil {
-				log.Println("ImageHandler (gateway) error client responded with:", err)
-				http.Error(w, internalErrStr, http.StatusInternalServerError)
+				serviceError(w, "ImageHandler", err)
 				prom.ImageHandlerErrors.Inc()
 				return
 			}
+		} else if err != nil {
+			serviceError(w, "ImageHandler", err)
+			prom.ImageHandlerErrors.Inc()
+			return
+		}
+
+		if img.ContentType != "" {
+			w.Header().Set("Content-Type", img.ContentType)
+		}
+		if _, err := w.Write(img.Data); err != nil {
+			log.Println("ImageHandler (gateway) error writing response:", err)
+			http.Error(w, internalErrStr, http.StatusInternalServerError)
+			prom.ImageHandlerErrors.Inc()
+			return
+		}
+	}
+}
+
+// PlaceholderHandler gets the BlurHash and dominant color of an image from the worker cluster. Images
+// which are not cached yet are cached first.
+func PlaceholderHandler(cluster internal.Cluster, service *imageservice.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		prom.PlaceholderHandlerHits.Inc()
+
+		imgUrl, err := url.QueryUnescape(r.URL.Query().Get("url"))
+		if err != nil || !strings.HasPrefix(imgUrl, "https") {
+			log.Println("PlaceholderHandler (gateway) error invalid url:", imgUrl)
+			http.Error(w, "invalid url: "+imgUrl, http.StatusBadRequest)
+			prom.PlaceholderHandlerErrors.Inc()
+			return
+		}
+
+		workerUrl, err := workerUrlFor(cluster, imgUrl)
+		if err != nil {
+			log.Println("PlaceholderHandler (gateway) error", err)
+			http.Error(w, internalErrStr, http.StatusInternalServerError)
+			prom.PlaceholderHandlerErrors.Inc()
+			return
+		}
+
+		placeholder, err := service.GetPlaceholder(workerUrl, imgUrl)
+		if errors.Is(err, imageservice.ErrNotFound) {
+			if _, err = service.CacheImage(workerUrl, imgUrl, imageservice.Options{}); err != nil {
+				serviceError(w, "PlaceholderHandler", err)
+				prom.PlaceholderHandlerErrors.Inc()
+				return
+			}
+			placeholder, err = service.GetPlaceholder(workerUrl, imgUrl)
+		}
+		if err != nil {
+			serviceError(w, "PlaceholderHandler", err)
+			prom.PlaceholderHandlerErrors.Inc()
+			return
+		}
+
+		jsn, err := json.Marshal(placeholder)
+		if err != nil {
+			log.Println("PlaceholderHandler (gateway) error marshaling response:", err)
+			http.Error(w, internalErrStr, http.StatusInternalServerError)
+			prom.PlaceholderHandlerErrors.Inc()
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(jsn); err != nil {
+			log.Println("PlaceholderHandler (gateway) error writing response:", err)
+			return
+		}
+	}
+}
+
+// InfoHandler gets the metadata of an image from the worker cluster. Images which are not cached yet
+// are cached first.
+func InfoHandler(cluster internal.Cluster, service *imageservice.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		imgUrl, err := url.QueryUnescape(r.URL.Query().Get("url"))
+		if err != nil || !strings.HasPrefix(imgUrl, "https") {
+			log.Println("InfoHandler (gateway) error invalid url:", imgUrl)
+			http.Error(w, "invalid url: "+imgUrl, http.StatusBadRequest)
+			return
+		}
 
-			if _, err := w.Write(img); err != nil {
-				log.Println("ImageHandler (gateway) error writing response:", err)
+		workerUrl, err := workerUrlFor(cluster, imgUrl)
+		if err != nil {
+			log.Println("InfoHandler (gateway) error", err)
+			http.Error(w, internalErrStr, http.StatusInternalServerError)
+			return
+		}
+
+		info, err := cachedInfo(service, workerUrl, imgUrl)
+		if err != nil {
+			serviceError(w, "InfoHandler", err)
+			return
+		}
+
+		jsn, err := json.Marshal(info)
+		if err != nil {
+			log.Println("InfoHandler (gateway) error marshaling response:", err)
+			http.Error(w, internalErrStr, http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(jsn); err != nil {
+			log.Println("InfoHandler (gateway) error writing response:", err)
+			return
+		}
+	}
+}
+
+// SrcsetHandler generates the urls of the variants of an image for a list of widths, either from the
+// widths parameter or from the requested preset. The other options apply to every variant. With
+// warm=true the variants are queued on warmer to be cached on the owning worker in the background.
+func SrcsetHandler(cluster internal.Cluster, service *imageservice.Service, presets *imageservice.Presets,
+	warmer *imageservice.Warmer, publicUrl string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		imgUrl, err := url.QueryUnescape(r.URL.Query().Get("url"))
+		if err != nil || !strings.HasPrefix(imgUrl, "https") {
+			log.Println("SrcsetHandler (gateway) error invalid url:", imgUrl)
+			http.Error(w, "invalid url: "+imgUrl, http.StatusBadRequest)
+			return
+		}
+
+		query := r.URL.Query()
+		widthsParam, warmParam := query.Get("widths"), query.Get("warm")
+		query.Del("url")
+		query.Del("widths")
+		query.Del("warm")
+
+		opts, err := presets.ParseOptions(query)
+		if err != nil {
+			log.Println("SrcsetHandler (gateway) error parsing options:", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		widths, err := srcsetWidths(presets, opts.Preset, widthsParam)
+		if err != nil {
+			log.Println("SrcsetHandler (gateway) error parsing widths:", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		warm := false
+		if warmParam != "" {
+			if warm, err = strconv.ParseBool(warmParam); err != nil {
+				http.Error(w, "warm must be true or false", http.StatusBadRequest)
+				return
+			}
+		}
+
+		workerUrl, err := workerUrlFor(cluster, imgUrl)
+		if err != nil {
+			log.Println("SrcsetHandler (gateway) error", err)
+			http.Error(w, internalErrStr, http.StatusInternalServerError)
+			return
+		}
+
+		// the sizes of the variants depend on the size of the original
+		info, err := cachedInfo(service, workerUrl, imgUrl)
+		if err != nil {
+			serviceError(w, "SrcsetHandler", err)
+			return
+		}
+
+		srcset, err := presets.Srcset(publicUrl, imgUrl, info.Width, info.Height, query, widths)
+		if err != nil {
+			serviceError(w, "SrcsetHandler", err)
+			return
+		}
+
+		if warm {
+			warmVariants(warmer, workerUrl, imgUrl, srcset.Variants, r.Header.Get("Accept"))
+		}
+
+		jsn, err := json.Marshal(srcset)
+		if err != nil {
+			log.Println("SrcsetHandler (gateway) error marshaling response:", err)
+			http.Error(w, internalErrStr, http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(jsn); err != nil {
+			log.Println("SrcsetHandler (gateway) error writing response:", err)
+			return
+		}
+	}
+}
+
+// srcsetWidths returns the widths given by the client or else those of the preset. Enforced presets
+// only allow the widths they list.
+func srcsetWidths(presets *imageservice.Presets, preset, widthsParam string) ([]int, error) {
+	if widthsParam == "" {
+		if widths := presets.Widths(preset); widths != nil {
+			return widths, nil
+		}
+		return nil, fmt.Errorf("%w: widths or a preset with widths is required", imageservice.ErrInvalidOptions)
+	}
+
+	widths, err := imageservice.ParseWidths(widthsParam)
+	if err != nil {
+		return nil, err
+	}
+	if presets.Only {
+		allowed := make(map[int]bool)
+		for _, w := range presets.Widths(preset) {
+			allowed[w] = true
+		}
+		for _, w := range widths {
+			if !allowed[w] {
+				return nil, fmt.Errorf("%w: width %d is not listed by the preset", imageservice.ErrInvalidOptions, w)
+			}
+		}
+	}
+	return widths, nil
+}
+
+// warmVariants queues the variants on warmer, automatic formats are resolved for accept. If the queue
+// is full the remaining variants are dropped, they are cached by the first request for them instead.
+func warmVariants(warmer *imageservice.Warmer, workerUrl, imgUrl string, variants []imageservice.SrcsetVariant, accept string) {
+	for i, v := range variants {
+		opts := v.Options
+		if opts.Format == imageservice.FormatAuto {
+			opts.Format = imageservice.NegotiateFormat(accept)
+		}
+
+		if !warmer.Warm(workerUrl, imgUrl, opts) {
+			log.Println("SrcsetHandler (gateway) warm queue full, dropped", len(variants)-i, "variants of", imgUrl)
+			return
+		}
+	}
+}
+
+// PurgeHandler removes an image and all of its variants from the cache of the worker which owns it
+func PurgeHandler(cluster internal.Cluster, service *imageservice.Service) http.HandlerFunc {
+	type response struct {
+		Purged int `json:"purged"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		imgUrl, err := url.QueryUnescape(r.URL.Query().Get("url"))
+		if err != nil || !strings.HasPrefix(imgUrl, "https") {
+			log.Println("PurgeHandler (gateway) error invalid url:", imgUrl)
+			http.Error(w, "invalid url: "+imgUrl, http.StatusBadRequest)
+			return
+		}
+
+		workerUrl, err := workerUrlFor(cluster, imgUrl)
+		if err != nil {
+			log.Println("PurgeHandler (gateway) error", err)
+			http.Error(w, internalErrStr, http.StatusInternalServerError)
+			return
+		}
+
+		purged, err := service.Purge(workerUrl, imgUrl)
+		if err != nil {
+			serviceError(w, "PurgeHandler", err)
+			return
+		}
+
+		jsn, err := json.Marshal(response{Purged: purged})
+		if err != nil {
+			log.Println("PurgeHandler (gateway) error marshaling response:", err)
+			http.Error(w, internalErrStr, http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(jsn); err != nil {
+			log.Println("PurgeHandler (gateway) error writing response:", err)
+			return
+		}
+	}
+}
+
+// DuplicatesHandler finds near-duplicates of an image on all workers of the cluster. The image is given
+// either by its url, which is cached first if needed, or by its perceptual hash, so hashes of removed
+// images can still be looked up.
+func DuplicatesHandler(cluster internal.Cluster, service *imageservice.Service) http.HandlerFunc {
+	type response struct {
+		DHash      string                   `json:"dhash"`
+		Distance   int                      `json:"distance"`
+		Duplicates []imageservice.Duplicate `json:"duplicates"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		distance, err := imageservice.ParseDistance(query.Get("distance"))
+		if err != nil {
+			log.Println("DuplicatesHandler (gateway) error parsing distance:", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var imgUrl, hash string
+		switch {
+		case query.Get("hash") != "" && query.Get("url") == "":
+			if hash, err = imageservice.ParseHash(query.Get("hash")); err != nil {
+				log.Println("DuplicatesHandler (gateway) error parsing hash:", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		case query.Get("url") != "" && query.Get("hash") == "":
+			imgUrl, err = url.QueryUnescape(query.Get("url"))
+			if err != nil || !strings.HasPrefix(imgUrl, "https") {
+				log.Println("DuplicatesHandler (gateway) error invalid url:", imgUrl)
+				http.Error(w, "invalid url: "+imgUrl, http.StatusBadRequest)
+				return
+			}
+
+			workerUrl, err := workerUrlFor(cluster, imgUrl)
+			if err != nil {
+				log.Println("DuplicatesHandler (gateway) error", err)
 				http.Error(w, internalErrStr, http.StatusInternalServerError)
-				prom.ImageHandlerErrors.Inc()
 				return
 			}
+			info, err := cachedInfo(service, workerUrl, imgUrl)
+			if err != nil {
+				serviceError(w, "DuplicatesHandler", err)
+				return
+			}
+			if info.DHash == "" {
+				log.Println("DuplicatesHandler (gateway) worker has no hash for", imgUrl)
+				http.Error(w, "image could not be hashed", http.StatusUnprocessableEntity)
+				return
+			}
+			hash = info.DHash
+		default:
+			http.Error(w, "either url or hash is required", http.StatusBadRequest)
+			return
+		}
 
-		} else if err != nil {
-			log.Println("ImageHandler (gateway) error getting image:", err)
+		workers, err := workerUrls(cluster)
+		if err != nil {
+			log.Println("DuplicatesHandler (gateway) error", err)
 			http.Error(w, internalErrStr, http.StatusInternalServerError)
-			prom.ImageHandlerErrors.Inc()
 			return
 		}
 
-		if _, err := w.Write(raw); err != nil {
-			log.Println("ImageHandler (gateway) error writing response:", err)
+		// every worker only knows the images it owns, a partial answer would hide duplicates
+		found := make([][]imageservice.Duplicate, len(workers))
+		errs := make([]error, len(workers))
+		var wg sync.WaitGroup
+		for i, workerUrl := range workers {
+			wg.Add(1)
+			go func(i int, workerUrl string) {
+				defer wg.Done()
+				found[i], errs[i] = service.FindDuplicates(workerUrl, hash, distance)
+			}(i, workerUrl)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				serviceError(w, "DuplicatesHandler", err)
+				return
+			}
+		}
+
+		resp := response{DHash: hash, Distance: distance, Duplicates: imageservice.MergeDuplicates(found, imgUrl)}
+		jsn, err := json.Marshal(resp)
+		if err != nil {
+			log.Println("DuplicatesHandler (gateway) error marshaling response:", err)
 			http.Error(w, internalErrStr, http.StatusInternalServerError)
-			prom.ImageHandlerErrors.Inc()
 			return
 		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(jsn); err != nil {
+			log.Println("DuplicatesHandler (gateway) error writing response:", err)
+			return
+		}
+	}
+}
+
+// cachedInfo gets the metadata of an image from its worker, caching the image first if needed
+func cachedInfo(service *imageservice.Service, workerUrl, imgUrl string) (*imageservice.Info, error) {
+	info, err := service.GetInfo(workerUrl, imgUrl)
+	if errors.Is(err, imageservice.ErrNotFound) {
+		if _, err = service.CacheImage(workerUrl, imgUrl, imageservice.Options{}); err != nil {
+			return nil, err
+		}
+		info, err = service.GetInfo(workerUrl, imgUrl)
+	}
+	return info, err
+}
+
+// workerUrlFor returns the url of the worker which owns imgUrl
+func workerUrlFor(cluster internal.Cluster, imgUrl string) (string, error) {
+	workers, err := workerUrls(cluster)
+	if err != nil {
+		return "", err
+	}
+
+	workerId := idFromUrl(imgUrl, len(workers))
+	workerUrl := workers[workerId]
+	log.Println("nodeId from string is", workerId, workerUrl)
+
+	return workerUrl, nil
+}
+
+// workerUrls returns the urls of all workers of the cluster
+func workerUrls(cluster internal.Cluster) ([]string, error) {
+	workers := cluster.WorkerNodes()
+	if len(workers) == 0 {
+		return nil, errors.New("cluster not available")
+	}
+
+	urls := make([]string, len(workers))
+	for i, worker := range workers {
+		urls[i] = fmt.Sprintf("http://%s:%d", worker.Addr.String(), 8080)
+	}
+	return urls, nil
+}
+
+// serviceError maps errors of the worker a request was forwarded to to a response
+func serviceError(w http.ResponseWriter, handler string, err error) {
+	switch {
+	case errors.Is(err, imageservice.ErrBusy):
+		log.Println(handler, "(gateway) worker busy:", err)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "service busy, retry later", http.StatusServiceUnavailable)
+	case errors.Is(err, imageservice.ErrUnavailable):
+		log.Println(handler, "(gateway) origin unavailable:", err)
+		http.Error(w, "origin unavailable", http.StatusServiceUnavailable)
+	case errors.Is(err, imageservice.ErrUnsupported):
+		log.Println(handler, "(gateway) origin did not return a supported image:", err)
+		http.Error(w, "url does not point to a supported image", http.StatusUnsupportedMediaType)
+	case errors.Is(err, imageservice.ErrForbidden):
+		log.Println(handler, "(gateway) url rejected by worker policy:", err)
+		http.Error(w, "url not allowed", http.StatusForbidden)
+	case errors.Is(err, imageservice.ErrTooLarge):
+		log.Println(handler, "(gateway) image exceeds the worker limits:", err)
+		http.Error(w, "image too large", http.StatusUnprocessableEntity)
+	case errors.Is(err, imageservice.ErrBadOptions):
+		log.Println(handler, "(gateway) options rejected by worker:", err)
+		http.Error(w, "options do not fit the image", http.StatusBadRequest)
+	default:
+		log.Println(handler, "(gateway) error client responded with:", err)
+		http.Error(w, internalErrStr, http.StatusInternalServerError)
 	}
 }
 
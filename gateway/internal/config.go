@@ -7,9 +7,11 @@ import (
 )
 
 type AppConfig struct {
-	hostList []string
-	httpPort string
-	secret   []byte
+	hostList    []string
+	httpPort    string
+	secret      []byte
+	presetsFile string
+	publicUrl   string
 }
 
 func ConfigFromEnv() (*AppConfig, error) {
@@ -33,6 +35,9 @@ func ConfigFromEnv() (*AppConfig, error) {
 		return nil, errors.New("env CLUSTER_SECRET not set")
 	}
 
+	conf.presetsFile = os.Getenv("PRESETS_FILE")
+	conf.publicUrl = strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/")
+
 	return conf, nil
 }
 
@@ -47,3 +52,12 @@ func (conf *AppConfig) HttpPort() string {
 func (conf *AppConfig) Secret() []byte {
 	return conf.secret
 }
+
+func (conf *AppConfig) PresetsFile() string {
+	return conf.presetsFile
+}
+
+// PublicUrl is the address clients reach the gateway at, empty if generated urls are relative
+func (conf *AppConfig) PublicUrl() string {
+	return conf.publicUrl
+}
@@ -34,6 +34,21 @@ func TestConfigFromEnv(t *testing.T) {
 	}
 }
 
+func TestConfigFromEnv_PublicUrl(t *testing.T) {
+	t.Setenv("CLUSTER_SECRET", "walrus123")
+	t.Setenv("KNOWN_HOSTS", "host1")
+	t.Setenv("HTTP_PORT", "8080")
+	t.Setenv("PUBLIC_URL", "https://img.example.com/")
+
+	conf, err := ConfigFromEnv()
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if conf.PublicUrl() != "https://img.example.com" {
+		t.Error("expected:", "https://img.example.com", "got:", conf.PublicUrl())
+	}
+}
+
 func TestConfig_Hosts(t *testing.T) {
 	conf := &AppConfig{hostList: []string{"host1", "host2", "host3"}}
 	expectedHostsStr := strings.Join(conf.HostList(), ",")
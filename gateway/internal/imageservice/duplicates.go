@@ -0,0 +1,99 @@
+package imageservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MaxHashDistance is the largest Hamming distance between two perceptual hashes
+	MaxHashDistance = 64
+	// DefaultHashDistance is the distance up to which images are near-duplicates if none is requested
+	DefaultHashDistance = 10
+	// maxDuplicates is the largest number of near-duplicates returned, the closest ones are kept
+	maxDuplicates = 100
+)
+
+// Duplicate is a cached image whose perceptual hash is close to the one looked up
+type Duplicate struct {
+	Url      string `json:"url"`
+	DHash    string `json:"dhash"`
+	Distance int    `json:"distance"`
+}
+
+// ParseHash validates a perceptual hash as reported by the workers, 16 hex digits
+func ParseHash(v string) (string, error) {
+	if _, err := strconv.ParseUint(v, 16, 64); err != nil || len(v) != 16 {
+		return "", fmt.Errorf("%w: hash must be 16 hex digits", ErrInvalidOptions)
+	}
+	return strings.ToLower(v), nil
+}
+
+// ParseDistance parses the Hamming distance up to which images are near-duplicates, empty means the
+// default distance
+func ParseDistance(v string) (int, error) {
+	if v == "" {
+		return DefaultHashDistance, nil
+	}
+	d, err := strconv.Atoi(v)
+	if err != nil || d < 0 || d > MaxHashDistance {
+		return 0, fmt.Errorf("%w: distance must be between 0 and %d", ErrInvalidOptions, MaxHashDistance)
+	}
+	return d, nil
+}
+
+// MergeDuplicates combines the near-duplicates found by several workers, closest first. The image
+// looked up by its url is not a duplicate of itself and left out.
+func MergeDuplicates(lists [][]Duplicate, exclude string) []Duplicate {
+	merged := make([]Duplicate, 0)
+	for _, list := range lists {
+		for _, d := range list {
+			if d.Url != exclude {
+				merged = append(merged, d)
+			}
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		if merged[i].Distance != merged[j].Distance {
+			return merged[i].Distance < merged[j].Distance
+		}
+		return merged[i].Url < merged[j].Url
+	})
+	if len(merged) > maxDuplicates {
+		merged = merged[:maxDuplicates]
+	}
+	return merged
+}
+
+// FindDuplicates gets the images cached by the worker whose perceptual hash is within distance of hash
+func (s *Service) FindDuplicates(workerUrl, hash string, distance int) ([]Duplicate, error) {
+	endpointUrl := fmt.Sprintf("%s/v1/duplicates?hash=%s&distance=%d", workerUrl, url.QueryEscape(hash), distance)
+	req, err := http.NewRequest(http.MethodGet, endpointUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP request failed with status code: %s", resp.Status)
+	}
+
+	var found struct {
+		Duplicates []Duplicate `json:"duplicates"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&found); err != nil {
+		return nil, err
+	}
+
+	return found.Duplicates, nil
+}
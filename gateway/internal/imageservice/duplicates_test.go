@@ -0,0 +1,90 @@
+package imageservice
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestParseDistance(t *testing.T) {
+	tests := []struct {
+		v       string
+		want    int
+		wantErr bool
+	}{
+		{v: "", want: DefaultHashDistance},
+		{v: "0", want: 0},
+		{v: "64", want: 64},
+		{v: "65", wantErr: true},
+		{v: "-1", wantErr: true},
+		{v: "abc", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.v, func(t *testing.T) {
+			got, err := ParseDistance(tt.v)
+			if tt.wantErr != errors.Is(err, ErrInvalidOptions) {
+				t.Fatalf("ParseDistance() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseDistance() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if got, err := ParseHash("00FF00ff00ff00ff"); err != nil || got != "00ff00ff00ff00ff" {
+		t.Error("expected:", "00ff00ff00ff00ff", "got:", got, err)
+	}
+	for _, hash := range []string{"ff", "zzzzzzzzzzzzzzzz", "+0ff00ff00ff00ff"} {
+		if _, err := ParseHash(hash); !errors.Is(err, ErrInvalidOptions) {
+			t.Error("expected:", ErrInvalidOptions, "got:", err)
+		}
+	}
+}
+
+func TestMergeDuplicates(t *testing.T) {
+	merged := MergeDuplicates([][]Duplicate{
+		{{Url: "https://a.com/self.png", Distance: 0}, {Url: "https://a.com/b.png", Distance: 4}},
+		{{Url: "https://b.com/a.png", Distance: 4}, {Url: "https://b.com/c.png", Distance: 1}},
+		nil,
+	}, "https://a.com/self.png")
+
+	want := []string{"https://b.com/c.png", "https://a.com/b.png", "https://b.com/a.png"}
+	if len(merged) != len(want) {
+		t.Fatal("expected:", want, "got:", merged)
+	}
+	for i, d := range merged {
+		if d.Url != want[i] {
+			t.Error("expected:", want[i], "got:", d.Url)
+		}
+	}
+}
+
+type duplicatesClient struct {
+	req *http.Request
+}
+
+func (c *duplicatesClient) Do(req *http.Request) (*http.Response, error) {
+	c.req = req
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(bytes.NewBufferString(`{"duplicates":[{"url":"https://a.com/b.png","dhash":"00000000000000ff","distance":2}]}`)),
+	}, nil
+}
+
+func TestService_FindDuplicates(t *testing.T) {
+	client := &duplicatesClient{}
+	service := &Service{client: client}
+
+	found, err := service.FindDuplicates("http://notaurl:2929", "00000000000000fc", 5)
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if len(found) != 1 || found[0].Distance != 2 || found[0].DHash != "00000000000000ff" {
+		t.Error("expected:", "one duplicate at distance 2", "got:", found)
+	}
+	if client.req.URL.Path != "/v1/duplicates" || client.req.URL.Query().Get("distance") != "5" {
+		t.Error("expected:", "/v1/duplicates?distance=5", "got:", client.req.URL)
+	}
+}
@@ -0,0 +1,81 @@
+package imageservice
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// FormatAuto lets the gateway pick the output format from the Accept header of the client
+const FormatAuto = "auto"
+
+// negotiableFormats are the output formats workers can encode, in order of preference
+var negotiableFormats = []string{"jpeg", "png", "gif"}
+
+// NegotiateFormat returns the output format which suits the Accept header of a client best. An empty
+// string keeps the format of the original, which is the case if the client accepts any image at
+// least as much as one of the formats the workers can encode.
+func NegotiateFormat(accept string) string {
+	ranges := parseAccept(accept)
+	if len(ranges) == 0 {
+		return ""
+	}
+
+	best, bestQ := "", 0.0
+	for _, format := range negotiableFormats {
+		if q := quality(ranges, "image", format); q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+
+	if best == "" || quality(ranges, "image", "") >= bestQ {
+		return ""
+	}
+	return best
+}
+
+type mediaRange struct {
+	typ, subtype string
+	q            float64
+}
+
+func parseAccept(accept string) []mediaRange {
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		typ, subtype, _ := strings.Cut(mediaType, "/")
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		ranges = append(ranges, mediaRange{typ: typ, subtype: subtype, q: q})
+	}
+	return ranges
+}
+
+// quality returns the q value of the most specific range matching typ/subtype. An empty subtype
+// only matches wildcards, it stands for an image of unknown format.
+func quality(ranges []mediaRange, typ, subtype string) float64 {
+	q, specificity := 0.0, -1
+	for _, r := range ranges {
+		s := -1
+		switch {
+		case r.typ == typ && r.subtype == subtype && subtype != "":
+			s = 2
+		case r.typ == typ && r.subtype == "*":
+			s = 1
+		case r.typ == "*" && r.subtype == "*":
+			s = 0
+		}
+		if s > specificity {
+			q, specificity = r.q, s
+		}
+	}
+	return q
+}
@@ -0,0 +1,27 @@
+package imageservice
+
+import "testing"
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{accept: "", want: ""},
+		{accept: "image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8", want: ""},
+		{accept: "image/png", want: "png"},
+		{accept: "image/gif, image/png;q=0.5", want: "gif"},
+		{accept: "image/png;q=1, image/*;q=0.5", want: "png"},
+		{accept: "image/jpeg, image/png", want: "jpeg"},
+		{accept: "image/webp", want: ""},
+		{accept: "text/html", want: ""},
+		{accept: "*/*;q=0.1, image/jpeg;q=0.9", want: "jpeg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			if got := NegotiateFormat(tt.accept); got != tt.want {
+				t.Errorf("NegotiateFormat() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,310 @@
+package imageservice
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxDimension is the largest width or height workers accept
+	maxDimension = 8192
+	// maxCropValue is the largest offset or size of a crop workers accept
+	maxCropValue = maxDimension * 4
+	// maxBlur and maxSharpen are the strongest filters workers accept
+	maxBlur    = 100
+	maxSharpen = 10
+	// maxPosterTime is the latest timestamp in seconds a poster can be picked at
+	maxPosterTime = 3600
+	// minBudget and maxBudget bound the byte budget of animated gifs
+	minBudget = 1024
+	maxBudget = 64 << 20
+)
+
+var ErrInvalidOptions = errors.New("invalid image options")
+
+var (
+	fits      = map[string]bool{"contain": true, "cover": true, "fill": true, "inside": true}
+	formats   = map[string]bool{"jpeg": true, "jpg": true, "png": true, "gif": true, FormatAuto: true}
+	rotations = map[string]bool{"0": true, "90": true, "180": true, "270": true}
+	flips     = map[string]bool{"h": true, "v": true, "hv": true, "vh": true}
+	gravities = map[string]bool{
+		"center": true, "north": true, "south": true, "east": true, "west": true, "northeast": true,
+		"northwest": true, "southeast": true, "southwest": true, "focal": true, "entropy": true, "attention": true,
+	}
+)
+
+// Options are the transformations a client requested for an image. They are validated by the
+// gateway so bad requests never reach a worker, the worker does the actual normalization.
+type Options struct {
+	Width   int
+	Height  int
+	Fit     string
+	Format  string
+	Quality int
+	Crop    string
+	Gravity string
+	FocusX  string
+	FocusY  string
+	Anim    string
+	// Frame or Time pick the poster frame of anim poster
+	Frame  string
+	Time   string
+	Budget int
+	// Watermark asks the worker to composite its configured overlay onto the variant
+	Watermark bool
+	Rotate    string
+	Flip      string
+	Blur      string
+	Sharpen   string
+	Grayscale bool
+	// Brightness and Contrast are between -100 and 100
+	Brightness int
+	Contrast   int
+	// Preset is the name of the preset the options were expanded from
+	Preset string
+}
+
+// ParseOptions reads the options from the query parameters of a client request
+func ParseOptions(q url.Values) (Options, error) {
+	var o Options
+	var err error
+
+	if o.Width, err = parseDimension(q.Get("w")); err != nil {
+		return Options{}, err
+	}
+	if o.Height, err = parseDimension(q.Get("h")); err != nil {
+		return Options{}, err
+	}
+
+	o.Fit = q.Get("fit")
+	if o.Fit != "" && !fits[o.Fit] {
+		return Options{}, fmt.Errorf("%w: unknown fit %s", ErrInvalidOptions, o.Fit)
+	}
+
+	o.Format = q.Get("format")
+	if o.Format != "" && !formats[o.Format] {
+		return Options{}, fmt.Errorf("%w: unsupported output format %s", ErrInvalidOptions, o.Format)
+	}
+
+	if v := q.Get("quality"); v != "" {
+		if o.Quality, err = strconv.Atoi(v); err != nil || o.Quality < 1 || o.Quality > 100 {
+			return Options{}, fmt.Errorf("%w: quality must be between 1 and 100", ErrInvalidOptions)
+		}
+	}
+
+	o.Crop = q.Get("crop")
+	if o.Crop != "" && !validCrop(o.Crop) {
+		return Options{}, fmt.Errorf("%w: crop must be x,y,width,height", ErrInvalidOptions)
+	}
+
+	o.Gravity = q.Get("gravity")
+	if o.Gravity != "" && !gravities[o.Gravity] {
+		return Options{}, fmt.Errorf("%w: unknown gravity %s", ErrInvalidOptions, o.Gravity)
+	}
+
+	o.FocusX, o.FocusY = q.Get("fx"), q.Get("fy")
+	if o.FocusX != "" || o.FocusY != "" {
+		if o.Gravity != "" && o.Gravity != "focal" {
+			return Options{}, fmt.Errorf("%w: a focal point cannot be combined with gravity %s", ErrInvalidOptions, o.Gravity)
+		}
+		if !validFocus(o.FocusX) || !validFocus(o.FocusY) {
+			return Options{}, fmt.Errorf("%w: focal point coordinates must be between 0 and 1", ErrInvalidOptions)
+		}
+	} else if o.Gravity == "focal" {
+		return Options{}, fmt.Errorf("%w: gravity focal requires fx and fy", ErrInvalidOptions)
+	}
+
+	o.Anim = q.Get("anim")
+	if o.Anim != "" && o.Anim != "all" && o.Anim != "first" && o.Anim != "poster" {
+		return Options{}, fmt.Errorf("%w: anim must be all, first or poster", ErrInvalidOptions)
+	}
+
+	o.Frame, o.Time = q.Get("frame"), q.Get("time")
+	if o.Frame != "" && o.Time != "" {
+		return Options{}, fmt.Errorf("%w: frame and time cannot be combined", ErrInvalidOptions)
+	}
+	if (o.Frame != "" || o.Time != "") && o.Anim != "" && o.Anim != "poster" {
+		return Options{}, fmt.Errorf("%w: frame and time require anim poster", ErrInvalidOptions)
+	}
+	if o.Frame != "" {
+		if frame, err := strconv.Atoi(o.Frame); err != nil || frame < 0 {
+			return Options{}, fmt.Errorf("%w: frame must be a frame index", ErrInvalidOptions)
+		}
+	}
+	if o.Time != "" && !validRange(o.Time, 0, maxPosterTime) {
+		return Options{}, fmt.Errorf("%w: time must be between 0 and %d seconds", ErrInvalidOptions, maxPosterTime)
+	}
+
+	if v := q.Get("budget"); v != "" {
+		if o.Budget, err = strconv.Atoi(v); err != nil || o.Budget < minBudget || o.Budget > maxBudget {
+			return Options{}, fmt.Errorf("%w: budget must be between %d and %d bytes", ErrInvalidOptions, minBudget, maxBudget)
+		}
+	}
+
+	if v := q.Get("watermark"); v != "" {
+		if o.Watermark, err = strconv.ParseBool(v); err != nil {
+			return Options{}, fmt.Errorf("%w: watermark must be true or false", ErrInvalidOptions)
+		}
+	}
+
+	o.Rotate = q.Get("rotate")
+	if o.Rotate != "" && !rotations[o.Rotate] {
+		return Options{}, fmt.Errorf("%w: rotate must be 0, 90, 180 or 270", ErrInvalidOptions)
+	}
+
+	o.Flip = q.Get("flip")
+	if o.Flip != "" && !flips[o.Flip] {
+		return Options{}, fmt.Errorf("%w: flip must be h, v or hv", ErrInvalidOptions)
+	}
+
+	o.Blur = q.Get("blur")
+	if o.Blur != "" && !validRange(o.Blur, 0, maxBlur) {
+		return Options{}, fmt.Errorf("%w: blur must be between 0 and %d", ErrInvalidOptions, maxBlur)
+	}
+	o.Sharpen = q.Get("sharpen")
+	if o.Sharpen != "" && !validRange(o.Sharpen, 0, maxSharpen) {
+		return Options{}, fmt.Errorf("%w: sharpen must be between 0 and %d", ErrInvalidOptions, maxSharpen)
+	}
+
+	if v := q.Get("grayscale"); v != "" {
+		if o.Grayscale, err = strconv.ParseBool(v); err != nil {
+			return Options{}, fmt.Errorf("%w: grayscale must be true or false", ErrInvalidOptions)
+		}
+	}
+
+	if o.Brightness, err = parsePercent(q.Get("brightness"), "brightness"); err != nil {
+		return Options{}, err
+	}
+	if o.Contrast, err = parsePercent(q.Get("contrast"), "contrast"); err != nil {
+		return Options{}, err
+	}
+
+	return o, nil
+}
+
+func validCrop(v string) bool {
+	parts := strings.Split(v, ",")
+	if len(parts) != 4 {
+		return false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil || n < 0 || n > maxCropValue || (i >= 2 && n == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func validFocus(v string) bool {
+	return validRange(v, 0, 1)
+}
+
+func validRange(v string, min, max float64) bool {
+	f, err := strconv.ParseFloat(v, 64)
+	return err == nil && f >= min && f <= max
+}
+
+func parsePercent(v, name string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil || i < -100 || i > 100 {
+		return 0, fmt.Errorf("%w: %s must be between -100 and 100", ErrInvalidOptions, name)
+	}
+	return i, nil
+}
+
+func parseDimension(v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil || i <= 0 || i > maxDimension {
+		return 0, fmt.Errorf("%w: dimension must be between 1 and %d", ErrInvalidOptions, maxDimension)
+	}
+	return i, nil
+}
+
+// Values encodes the options as query parameters for the worker
+func (o Options) Values() url.Values {
+	q := url.Values{}
+	if o.Width > 0 {
+		q.Set("w", strconv.Itoa(o.Width))
+	}
+	if o.Height > 0 {
+		q.Set("h", strconv.Itoa(o.Height))
+	}
+	if o.Fit != "" {
+		q.Set("fit", o.Fit)
+	}
+	if o.Format != "" {
+		q.Set("format", o.Format)
+	}
+	if o.Quality > 0 {
+		q.Set("quality", strconv.Itoa(o.Quality))
+	}
+	if o.Crop != "" {
+		q.Set("crop", o.Crop)
+	}
+	if o.Gravity != "" {
+		q.Set("gravity", o.Gravity)
+	}
+	if o.FocusX != "" {
+		q.Set("fx", o.FocusX)
+		q.Set("fy", o.FocusY)
+	}
+	if o.Anim != "" {
+		q.Set("anim", o.Anim)
+	}
+	if o.Frame != "" {
+		q.Set("frame", o.Frame)
+	}
+	if o.Time != "" {
+		q.Set("time", o.Time)
+	}
+	if o.Budget > 0 {
+		q.Set("budget", strconv.Itoa(o.Budget))
+	}
+	if o.Watermark {
+		q.Set("watermark", "1")
+	}
+	if o.Rotate != "" {
+		q.Set("rotate", o.Rotate)
+	}
+	if o.Flip != "" {
+		q.Set("flip", o.Flip)
+	}
+	if o.Blur != "" {
+		q.Set("blur", o.Blur)
+	}
+	if o.Sharpen != "" {
+		q.Set("sharpen", o.Sharpen)
+	}
+	if o.Grayscale {
+		q.Set("grayscale", "1")
+	}
+	if o.Brightness != 0 {
+		q.Set("brightness", strconv.Itoa(o.Brightness))
+	}
+	if o.Contrast != 0 {
+		q.Set("contrast", strconv.Itoa(o.Contrast))
+	}
+	if o.Preset != "" {
+		q.Set("preset", o.Preset)
+	}
+	return q
+}
+
+// asMap encodes the options for the json body of cache requests
+func (o Options) asMap() map[string]string {
+	m := make(map[string]string)
+	for k, v := range o.Values() {
+		m[k] = v[0]
+	}
+	return m
+}
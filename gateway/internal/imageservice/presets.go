@@ -0,0 +1,129 @@
+package imageservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+// presetWidths is the key of the widths a srcset of a preset is generated for
+const presetWidths = "widths"
+
+// Presets are named sets of options, loaded from the same file as on the workers
+type Presets struct {
+	// Only forbids ad-hoc options, clients can only request presets
+	Only    bool                         `json:"presets_only"`
+	Presets map[string]map[string]string `json:"presets"`
+}
+
+// LoadPresets reads presets from a json file, without a path there are no presets
+func LoadPresets(path string) (*Presets, error) {
+	p := &Presets{}
+	if path == "" {
+		return p, nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading presets: %w", err)
+	}
+	if err := json.Unmarshal(raw, p); err != nil {
+		return nil, fmt.Errorf("parsing presets: %w", err)
+	}
+
+	for name, values := range p.Presets {
+		if _, ok := values["preset"]; ok {
+			return nil, fmt.Errorf("preset %s: presets cannot reference other presets", name)
+		}
+		q := url.Values{}
+		for k, v := range values {
+			q.Set(k, v)
+		}
+		if _, err := ParseOptions(q); err != nil {
+			return nil, fmt.Errorf("preset %s: %w", name, err)
+		}
+		if v, ok := values[presetWidths]; ok {
+			if _, err := ParseWidths(v); err != nil {
+				return nil, fmt.Errorf("preset %s: %w", name, err)
+			}
+		}
+	}
+
+	return p, nil
+}
+
+// ParseOptions parses the options of a client request. The options of a requested preset are
+// merged in, options set explicitly take precedence unless presets are enforced. Enforced presets
+// still allow the widths they list, so the urls of a srcset keep working.
+func (p *Presets) ParseOptions(q url.Values) (Options, error) {
+	name := q.Get("preset")
+
+	if p.Only {
+		for k := range q {
+			if k == "w" && p.listsWidth(name, q.Get(k)) {
+				continue
+			}
+			if k != "url" && k != "preset" {
+				return Options{}, fmt.Errorf("%w: only presets are allowed, got %s", ErrInvalidOptions, k)
+			}
+		}
+		if name == "" {
+			return Options{}, fmt.Errorf("%w: a preset is required", ErrInvalidOptions)
+		}
+	}
+
+	if name == "" {
+		return ParseOptions(q)
+	}
+
+	values, ok := p.Presets[name]
+	if !ok {
+		return Options{}, fmt.Errorf("%w: unknown preset %s", ErrInvalidOptions, name)
+	}
+
+	merged := url.Values{}
+	for k, v := range values {
+		merged.Set(k, v)
+	}
+	for k, v := range q {
+		merged[k] = v
+	}
+	if _, ok := values[presetWidths]; ok && q.Get("w") != "" && q.Get("h") == "" {
+		// a srcset of the preset keeps the aspect ratio of its box for every width
+		presetW, _ := strconv.Atoi(values["w"])
+		presetH, _ := strconv.Atoi(values["h"])
+		w, err := strconv.Atoi(q.Get("w"))
+		if presetW > 0 && presetH > 0 && err == nil {
+			merged.Set("h", strconv.Itoa(scaleDimension(presetH, w, presetW)))
+		}
+	}
+
+	opts, err := ParseOptions(merged)
+	if err != nil {
+		return Options{}, err
+	}
+	opts.Preset = name
+	return opts, nil
+}
+
+// Widths returns the widths the srcset of the named preset is generated for, nil if it lists none
+func (p *Presets) Widths(name string) []int {
+	v, ok := p.Presets[name][presetWidths]
+	if !ok {
+		return nil
+	}
+	// validated when the presets were loaded
+	widths, _ := ParseWidths(v)
+	return widths
+}
+
+func (p *Presets) listsWidth(name, width string) bool {
+	for _, w := range p.Widths(name) {
+		if strconv.Itoa(w) == width {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+package imageservice
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPresets_ParseOptions(t *testing.T) {
+	presets := &Presets{Presets: map[string]map[string]string{
+		"thumb": {"w": "150", "h": "150", "fit": "cover"},
+	}}
+
+	q, _ := url.ParseQuery("url=https://example.com/a.png&preset=thumb&h=100")
+	opts, err := presets.ParseOptions(q)
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if opts.Width != 150 || opts.Height != 100 || opts.Fit != "cover" || opts.Preset != "thumb" {
+		t.Error("expected:", "150x100 cover thumb", "got:", opts)
+	}
+
+	q, _ = url.ParseQuery("url=https://example.com/a.png&preset=banner")
+	if _, err := presets.ParseOptions(q); !errors.Is(err, ErrInvalidOptions) {
+		t.Error("expected:", ErrInvalidOptions, "got:", err)
+	}
+}
+
+func TestPresets_Only(t *testing.T) {
+	presets := &Presets{Only: true, Presets: map[string]map[string]string{
+		"thumb": {"w": "150"},
+	}}
+
+	tests := []struct {
+		query   string
+		wantErr bool
+	}{
+		{query: "url=https://example.com/a.png&preset=thumb"},
+		{query: "url=https://example.com/a.png&preset=thumb&w=10", wantErr: true},
+		{query: "url=https://example.com/a.png&w=10", wantErr: true},
+		{query: "url=https://example.com/a.png", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, _ := url.ParseQuery(tt.query)
+			if _, err := presets.ParseOptions(q); tt.wantErr != errors.Is(err, ErrInvalidOptions) {
+				t.Errorf("ParseOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseOptions_Filters(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    string
+		wantErr bool
+	}{
+		{query: "rotate=90&flip=h", want: "flip=h&rotate=90"},
+		{query: "blur=2.5&sharpen=1&grayscale=true", want: "blur=2.5&grayscale=1&sharpen=1"},
+		{query: "brightness=10&contrast=-10", want: "brightness=10&contrast=-10"},
+		{query: "rotate=45", wantErr: true},
+		{query: "rotate=360", wantErr: true},
+		{query: "flip=diagonal", wantErr: true},
+		{query: "blur=500", wantErr: true},
+		{query: "contrast=101", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, _ := url.ParseQuery(tt.query)
+			opts, err := ParseOptions(q)
+			if tt.wantErr != errors.Is(err, ErrInvalidOptions) {
+				t.Errorf("ParseOptions() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got := opts.Values().Encode(); got != tt.want {
+				t.Errorf("ParseOptions() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseOptions_Animation(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    string
+		wantErr bool
+	}{
+		{query: "anim=poster&frame=2", want: "anim=poster&frame=2"},
+		{query: "time=1.5", want: "time=1.5"},
+		{query: "budget=500000", want: "budget=500000"},
+		{query: "anim=first&frame=2", wantErr: true},
+		{query: "frame=1&time=1", wantErr: true},
+		{query: "frame=-1", wantErr: true},
+		{query: "time=5000", wantErr: true},
+		{query: "budget=10", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, _ := url.ParseQuery(tt.query)
+			opts, err := ParseOptions(q)
+			if tt.wantErr != errors.Is(err, ErrInvalidOptions) {
+				t.Errorf("ParseOptions() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got := opts.Values().Encode(); got != tt.want {
+				t.Errorf("ParseOptions() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseOptions_Gravity(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    string
+		wantErr bool
+	}{
+		{query: "gravity=focal&fx=0.2&fy=0.8", want: "fx=0.2&fy=0.8&gravity=focal"},
+		{query: "fx=0.2&fy=0.8", want: "fx=0.2&fy=0.8"},
+		{query: "crop=0,0,32768,10", want: "crop=0%2C0%2C32768%2C10"},
+		{query: "gravity=focal", wantErr: true},
+		{query: "gravity=north&fx=0.2&fy=0.8", wantErr: true},
+		{query: "fx=0.2", wantErr: true},
+		{query: "crop=0,0,32769,10", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, _ := url.ParseQuery(tt.query)
+			opts, err := ParseOptions(q)
+			if tt.wantErr != errors.Is(err, ErrInvalidOptions) {
+				t.Errorf("ParseOptions() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got := opts.Values().Encode(); got != tt.want {
+				t.Errorf("ParseOptions() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadPresets_Nested(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "presets.json")
+	if err := os.WriteFile(path, []byte(`{"presets":{"thumb":{"w":"100"},"card":{"preset":"thumb"}}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadPresets(path); err == nil {
+		t.Error("expected:", "error for a nested preset", "got:", err)
+	}
+}
+
+func TestLoadPresets_Auto(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "presets.json")
+	if err := os.WriteFile(path, []byte(`{"presets":{"hero":{"w":"800","format":"auto"}}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	presets, err := LoadPresets(path)
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	opts, err := presets.ParseOptions(url.Values{"preset": {"hero"}})
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if opts.Format != FormatAuto {
+		t.Error("expected:", FormatAuto, "got:", opts.Format)
+	}
+}
@@ -14,11 +14,43 @@ import (
 
 type (
 	ImageGetter interface {
-		GetImage(urlHash string) ([]byte, error)
+		GetImage(workerUrl, imgUrl string, opts Options) (*Image, error)
 	}
 
 	ImageCacher interface {
-		CacheImage(workerUrl, url string) ([]byte, error)
+		CacheImage(workerUrl, imgUrl string, opts Options) (*Image, error)
+	}
+
+	// Image is an image as served by a worker
+	Image struct {
+		Data        []byte
+		ContentType string
+	}
+
+	// Placeholder is a tiny stand-in clients show while the real image loads
+	Placeholder struct {
+		BlurHash      string `json:"blurhash"`
+		DominantColor string `json:"dominant_color"`
+	}
+
+	// Info describes an image cached by a worker
+	Info struct {
+		Url           string    `json:"url"`
+		FinalUrl      string    `json:"final_url"`
+		Width         int       `json:"width"`
+		Height        int       `json:"height"`
+		Format        string    `json:"format"`
+		Size          int       `json:"size"`
+		Frames        int       `json:"frames"`
+		HasAlpha      bool      `json:"has_alpha"`
+		ColorSpace    string    `json:"color_space"`
+		ICCProfile    string    `json:"icc_profile,omitempty"`
+		SRGBConverted bool      `json:"srgb_converted"`
+		DHash         string    `json:"dhash,omitempty"`
+		ContentType   string    `json:"content_type"`
+		CachedAt      time.Time `json:"cached_at"`
+		// TTL is the remaining freshness in seconds, null if the origin gave no lifetime
+		TTL *int64 `json:"ttl"`
 	}
 
 	HttpClient interface {
@@ -31,15 +63,24 @@ type (
 )
 
 var (
-	ErrNotFound = errors.New("not found")
+	ErrNotFound    = errors.New("not found")
+	ErrUnavailable = errors.New("origin unavailable")
+	ErrUnsupported = errors.New("unsupported media type")
+	ErrForbidden   = errors.New("url not allowed")
+	ErrTooLarge    = errors.New("image too large")
+	ErrBadOptions  = errors.New("options do not fit the image")
+	// ErrBusy is returned if the processing queue of the worker is full, the request can be retried shortly
+	ErrBusy = errors.New("worker busy")
 )
 
 func NewService(timeout time.Duration) *Service {
 	return &Service{client: &http.Client{Timeout: timeout}}
 }
 
-func (s *Service) GetImage(workerUrl, imgUrl string) ([]byte, error) {
-	endpointUrl := fmt.Sprintf("%s/?url=%s", workerUrl, url.QueryEscape(imgUrl))
+func (s *Service) GetImage(workerUrl, imgUrl string, opts Options) (*Image, error) {
+	query := opts.Values()
+	query.Set("url", imgUrl)
+	endpointUrl := fmt.Sprintf("%s/v1/image?%s", workerUrl, query.Encode())
 	log.Println("downloading from ", workerUrl)
 	req, err := http.NewRequest(http.MethodGet, endpointUrl, nil)
 	if err != nil {
@@ -61,6 +102,10 @@ func (s *Service) GetImage(workerUrl, imgUrl string) ([]byte, error) {
 		return nil, ErrNotFound
 	}
 
+	if resp.StatusCode == http.StatusBadRequest {
+		return nil, ErrBadOptions
+	}
+
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("HTTP request failed with status code: %s", resp.Status)
 	}
@@ -70,13 +115,13 @@ func (s *Service) GetImage(workerUrl, imgUrl string) ([]byte, error) {
 		return nil, err
 	}
 
-	return raw, nil
+	return &Image{Data: raw, ContentType: resp.Header.Get("Content-Type")}, nil
 }
 
-func (s *Service) CacheImage(workerUrl, imgUrl string) ([]byte, error) {
+func (s *Service) CacheImage(workerUrl, imgUrl string, opts Options) (*Image, error) {
 	endpointUrl := fmt.Sprintf("%s/v1/cache", workerUrl) //TODO: url
 
-	requestBody, err := json.Marshal(map[string]interface{}{"url": imgUrl})
+	requestBody, err := json.Marshal(map[string]interface{}{"url": imgUrl, "options": opts.asMap()})
 	if err != nil {
 		return nil, err
 	}
@@ -93,8 +138,8 @@ func (s *Service) CacheImage(workerUrl, imgUrl string) ([]byte, error) {
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("HTTP request failed with status code: %s", resp.Status)
+	if err := processingError(resp); err != nil {
+		return nil, err
 	}
 
 	raw, err := io.ReadAll(resp.Body)
@@ -102,5 +147,124 @@ func (s *Service) CacheImage(workerUrl, imgUrl string) ([]byte, error) {
 		return nil, err
 	}
 
-	return raw, nil
+	return &Image{Data: raw, ContentType: resp.Header.Get("Content-Type")}, nil
+}
+
+// GetPlaceholder gets the placeholder of an image cached by the worker
+func (s *Service) GetPlaceholder(workerUrl, imgUrl string) (*Placeholder, error) {
+	endpointUrl := fmt.Sprintf("%s/v1/placeholder?url=%s", workerUrl, url.QueryEscape(imgUrl))
+	req, err := http.NewRequest(http.MethodGet, endpointUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+
+	if err := processingError(resp); err != nil {
+		return nil, err
+	}
+
+	var placeholder Placeholder
+	if err := json.NewDecoder(resp.Body).Decode(&placeholder); err != nil {
+		return nil, err
+	}
+
+	return &placeholder, nil
+}
+
+// GetInfo gets the metadata of an image cached by the worker
+func (s *Service) GetInfo(workerUrl, imgUrl string) (*Info, error) {
+	endpointUrl := fmt.Sprintf("%s/v1/info?url=%s", workerUrl, url.QueryEscape(imgUrl))
+	req, err := http.NewRequest(http.MethodGet, endpointUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+
+	// hashing the image may find the processing queue of the worker full
+	if err := processingError(resp); err != nil {
+		return nil, err
+	}
+
+	var info Info
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+// Purge removes an image and all of its variants from the cache of the worker. It returns the number
+// of removed cache entries.
+func (s *Service) Purge(workerUrl, imgUrl string) (int, error) {
+	endpointUrl := fmt.Sprintf("%s/v1/purge", workerUrl)
+
+	requestBody, err := json.Marshal(map[string]string{"url": imgUrl})
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpointUrl, bytes.NewBuffer(requestBody))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("HTTP request failed with status code: %s", resp.Status)
+	}
+
+	var purged struct {
+		Purged int `json:"purged"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&purged); err != nil {
+		return 0, err
+	}
+
+	return purged.Purged, nil
+}
+
+// processingError maps the response of a worker endpoint which downloads or processes an image to an
+// error, nil for 200 OK
+func processingError(resp *http.Response) error {
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode == http.StatusServiceUnavailable && resp.Header.Get("Retry-After") != "":
+		return ErrBusy
+	case resp.StatusCode == http.StatusServiceUnavailable:
+		return ErrUnavailable
+	case resp.StatusCode == http.StatusUnsupportedMediaType:
+		return ErrUnsupported
+	case resp.StatusCode == http.StatusForbidden:
+		return ErrForbidden
+	case resp.StatusCode == http.StatusUnprocessableEntity:
+		return ErrTooLarge
+	case resp.StatusCode == http.StatusBadRequest:
+		return ErrBadOptions
+	}
+	return fmt.Errorf("HTTP request failed with status code: %s", resp.Status)
 }
@@ -22,12 +22,120 @@ func (c *mockClient) Do(req *http.Request) (*http.Response, error) {
 func TestService_GetImage(t *testing.T) {
 	service := &Service{client: &mockClient{}}
 
-	img, err := service.GetImage("notaurl:2929", "https://notarealhost.com/image.png")
+	img, err := service.GetImage("notaurl:2929", "https://notarealhost.com/image.png", Options{})
 	if err != nil {
 		t.Error("error is not null", err.Error())
 	}
 
-	if len(img) != len(testBytes) {
-		t.Error("response is not equal to mocked data. expected:", len(testBytes), "got:", len(img))
+	if len(img.Data) != len(testBytes) {
+		t.Error("response is not equal to mocked data. expected:", len(testBytes), "got:", len(img.Data))
+	}
+}
+
+func TestService_GetImage_BadOptions(t *testing.T) {
+	service := &Service{client: &statusClient{status: http.StatusBadRequest}}
+
+	if _, err := service.GetImage("notaurl:2929", "https://notarealhost.com/image.png", Options{}); err != ErrBadOptions {
+		t.Error("expected:", ErrBadOptions, "got:", err)
+	}
+}
+
+type placeholderClient struct {
+	status int
+}
+
+func (c *placeholderClient) Do(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: c.status,
+		Body:       io.NopCloser(bytes.NewBufferString(`{"blurhash":"LEHV6nWB2yk8","dominant_color":"#336699"}`)),
+	}, nil
+}
+
+func TestService_GetPlaceholder(t *testing.T) {
+	service := &Service{client: &placeholderClient{status: http.StatusOK}}
+
+	ph, err := service.GetPlaceholder("notaurl:2929", "https://notarealhost.com/image.png")
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if ph.BlurHash != "LEHV6nWB2yk8" || ph.DominantColor != "#336699" {
+		t.Error("expected:", "LEHV6nWB2yk8 #336699", "got:", ph.BlurHash, ph.DominantColor)
+	}
+
+	service = &Service{client: &placeholderClient{status: http.StatusNotFound}}
+	if _, err := service.GetPlaceholder("notaurl:2929", "https://notarealhost.com/image.png"); err != ErrNotFound {
+		t.Error("expected:", ErrNotFound, "got:", err)
+	}
+
+	service = &Service{client: &placeholderClient{status: http.StatusBadRequest}}
+	if _, err := service.GetPlaceholder("notaurl:2929", "https://notarealhost.com/image.png"); err != ErrBadOptions {
+		t.Error("expected:", ErrBadOptions, "got:", err)
+	}
+}
+
+type statusClient struct {
+	status int
+	header http.Header
+}
+
+func (c *statusClient) Do(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: c.status,
+		Header:     c.header,
+		Body:       io.NopCloser(bytes.NewBufferString("")),
+	}, nil
+}
+
+func TestService_CacheImage_Busy(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   error
+	}{
+		{name: "queue full", header: http.Header{"Retry-After": []string{"1"}}, want: ErrBusy},
+		{name: "origin unavailable", header: http.Header{}, want: ErrUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &Service{client: &statusClient{status: http.StatusServiceUnavailable, header: tt.header}}
+			if _, err := service.CacheImage("notaurl:2929", "https://notarealhost.com/image.png", Options{}); err != tt.want {
+				t.Errorf("CacheImage() got = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestService_GetInfo_Busy(t *testing.T) {
+	service := &Service{client: &statusClient{status: http.StatusServiceUnavailable, header: http.Header{"Retry-After": []string{"1"}}}}
+	if _, err := service.GetInfo("notaurl:2929", "https://notarealhost.com/image.png"); err != ErrBusy {
+		t.Error("expected:", ErrBusy, "got:", err)
+	}
+}
+
+type purgeClient struct {
+	req *http.Request
+}
+
+func (c *purgeClient) Do(req *http.Request) (*http.Response, error) {
+	c.req = req
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(bytes.NewBufferString(`{"purged":3}`)),
+	}, nil
+}
+
+func TestService_Purge(t *testing.T) {
+	client := &purgeClient{}
+	service := &Service{client: client}
+
+	purged, err := service.Purge("http://notaurl:2929", "https://notarealhost.com/image.png")
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if purged != 3 {
+		t.Error("expected:", 3, "got:", purged)
+	}
+	if client.req.Method != http.MethodPost || client.req.URL.Path != "/v1/purge" {
+		t.Error("expected:", "POST /v1/purge", "got:", client.req.Method, client.req.URL.Path)
 	}
 }
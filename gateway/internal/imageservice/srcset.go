@@ -0,0 +1,165 @@
+package imageservice
+
+import (
+	"fmt"
+	"image"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxSrcsetWidths is the largest number of widths a srcset can be generated for
+const maxSrcsetWidths = 16
+
+type (
+	// Srcset lists the variants of an image at several widths
+	Srcset struct {
+		Url      string          `json:"url"`
+		Width    int             `json:"width"`
+		Height   int             `json:"height"`
+		Variants []SrcsetVariant `json:"variants"`
+		// Srcset is the value of the srcset attribute of an img element
+		Srcset string `json:"srcset"`
+	}
+
+	// SrcsetVariant is a variant of an image together with the size the worker produces it in
+	SrcsetVariant struct {
+		Url     string  `json:"url"`
+		Width   int     `json:"width"`
+		Height  int     `json:"height"`
+		Options Options `json:"-"`
+	}
+)
+
+// ParseWidths parses a comma separated list of widths. The result is sorted and without duplicates.
+func ParseWidths(v string) ([]int, error) {
+	parts := strings.Split(v, ",")
+	if len(parts) > maxSrcsetWidths {
+		return nil, fmt.Errorf("%w: at most %d widths are allowed", ErrInvalidOptions, maxSrcsetWidths)
+	}
+
+	seen := make(map[int]bool)
+	var widths []int
+	for _, p := range parts {
+		w, err := parseDimension(strings.TrimSpace(p))
+		if err != nil || w == 0 {
+			return nil, fmt.Errorf("%w: widths must be between 1 and %d", ErrInvalidOptions, maxDimension)
+		}
+		if !seen[w] {
+			seen[w] = true
+			widths = append(widths, w)
+		}
+	}
+	sort.Ints(widths)
+	return widths, nil
+}
+
+// Srcset describes the variants of the image at imgUrl in the given widths. Every variant is requested
+// with the query q and its width, so its url is parsed exactly like q. If q has a width and a height,
+// the aspect ratio of that box is kept for every width, a height alone is dropped. width and height
+// are the size of the original, base is prepended to the variant urls. Widths which result in the
+// same variant, like widths beyond the original with fit inside, are only listed once.
+func (p *Presets) Srcset(base, imgUrl string, width, height int, q url.Values, widths []int) (*Srcset, error) {
+	srcset := &Srcset{Url: imgUrl, Width: width, Height: height}
+
+	boxW, _ := strconv.Atoi(q.Get("w"))
+	boxH, _ := strconv.Atoi(q.Get("h"))
+
+	var descriptors []string
+	seen := make(map[int]bool)
+	for _, w := range widths {
+		vq := url.Values{}
+		for k, v := range q {
+			vq[k] = v
+		}
+		vq.Del("h")
+		vq.Set("w", strconv.Itoa(w))
+		if boxW > 0 && boxH > 0 {
+			vq.Set("h", strconv.Itoa(scaleDimension(boxH, w, boxW)))
+		}
+
+		o, err := p.ParseOptions(vq)
+		if err != nil {
+			return nil, err
+		}
+		vw, vh, err := variantSize(width, height, o)
+		if err != nil {
+			return nil, err
+		}
+		if seen[vw] {
+			continue
+		}
+		seen[vw] = true
+
+		vq.Set("url", imgUrl)
+		variantUrl := base + "/image?" + vq.Encode()
+		srcset.Variants = append(srcset.Variants, SrcsetVariant{Url: variantUrl, Width: vw, Height: vh, Options: o})
+		descriptors = append(descriptors, variantUrl+" "+strconv.Itoa(vw)+"w")
+	}
+	srcset.Srcset = strings.Join(descriptors, ", ")
+
+	return srcset, nil
+}
+
+// variantSize returns the size of the variant the worker produces from an original of width x height
+// with the options o. It follows the rotation, crop and resize steps of the worker.
+func variantSize(width, height int, o Options) (int, int, error) {
+	if o.Rotate == "90" || o.Rotate == "270" {
+		width, height = height, width
+	}
+
+	region := image.Rect(0, 0, width, height)
+	if o.Crop != "" {
+		var x, y, w, h int
+		if _, err := fmt.Sscanf(strings.ReplaceAll(o.Crop, " ", ""), "%d,%d,%d,%d", &x, &y, &w, &h); err != nil {
+			return 0, 0, fmt.Errorf("%w: crop must be x,y,width,height", ErrInvalidOptions)
+		}
+		region = image.Rect(x, y, x+w, y+h).Intersect(region)
+		if region.Empty() {
+			return 0, 0, fmt.Errorf("%w: crop %s is outside of the image", ErrBadOptions, o.Crop)
+		}
+	}
+	sw, sh := region.Dx(), region.Dy()
+	if sw == 0 || sh == 0 {
+		return sw, sh, nil
+	}
+
+	w, h := o.Width, o.Height
+	cw, ch := sw, sh
+	switch {
+	case w == 0 && h == 0:
+		w, h = sw, sh
+	case w == 0:
+		w = scaleDimension(sw, h, sh)
+	case h == 0:
+		h = scaleDimension(sh, w, sw)
+	case o.Fit == "cover":
+		// the part of the original which is kept has the aspect ratio of the box
+		if sw*h > sh*w {
+			cw = scaleDimension(sh, w, h)
+		} else {
+			ch = scaleDimension(sw, h, w)
+		}
+	case o.Fit == "" || o.Fit == "contain" || o.Fit == "inside":
+		if sw*h > sh*w {
+			h = scaleDimension(sh, w, sw)
+		} else {
+			w = scaleDimension(sw, h, sh)
+		}
+	}
+
+	if o.Fit == "inside" && (w > cw || h > ch) {
+		w, h = cw, ch
+	}
+	return w, h, nil
+}
+
+// scaleDimension returns the size of a side with length side after scaling by num/den, at least 1
+func scaleDimension(side, num, den int) int {
+	v := (side*num + den/2) / den
+	if v < 1 {
+		return 1
+	}
+	return v
+}
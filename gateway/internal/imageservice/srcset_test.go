@@ -0,0 +1,108 @@
+package imageservice
+
+import (
+	"errors"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseWidths(t *testing.T) {
+	tests := []struct {
+		v       string
+		want    []int
+		wantErr bool
+	}{
+		{v: "640,320, 1280,320", want: []int{320, 640, 1280}},
+		{v: "100", want: []int{100}},
+		{v: "0", wantErr: true},
+		{v: "abc", wantErr: true},
+		{v: "9000", wantErr: true},
+		{v: "1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16,17", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.v, func(t *testing.T) {
+			got, err := ParseWidths(tt.v)
+			if tt.wantErr != errors.Is(err, ErrInvalidOptions) {
+				t.Fatalf("ParseWidths() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseWidths() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVariantSize(t *testing.T) {
+	tests := []struct {
+		name          string
+		opts          Options
+		wantW, wantH  int
+		wantErrorType error
+	}{
+		{name: "width only", opts: Options{Width: 400}, wantW: 400, wantH: 300},
+		{name: "contain", opts: Options{Width: 400, Height: 400}, wantW: 400, wantH: 300},
+		{name: "cover", opts: Options{Width: 400, Height: 400, Fit: "cover"}, wantW: 400, wantH: 400},
+		{name: "fill", opts: Options{Width: 100, Height: 400, Fit: "fill"}, wantW: 100, wantH: 400},
+		{name: "inside never enlarges", opts: Options{Width: 1600, Fit: "inside"}, wantW: 800, wantH: 600},
+		{name: "rotated", opts: Options{Width: 300, Rotate: "90"}, wantW: 300, wantH: 400},
+		{name: "crop", opts: Options{Crop: "700,0,200,100"}, wantW: 100, wantH: 100},
+		{name: "crop outside", opts: Options{Crop: "900,0,10,10"}, wantErrorType: ErrBadOptions},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, h, err := variantSize(800, 600, tt.opts)
+			if !errors.Is(err, tt.wantErrorType) {
+				t.Fatal("expected:", tt.wantErrorType, "got:", err)
+			}
+			if w != tt.wantW || h != tt.wantH {
+				t.Errorf("variantSize() got = %dx%d, want %dx%d", w, h, tt.wantW, tt.wantH)
+			}
+		})
+	}
+}
+
+func TestPresets_Srcset(t *testing.T) {
+	presets := &Presets{Only: true, Presets: map[string]map[string]string{
+		"hero": {"w": "800", "h": "400", "fit": "cover", "widths": "400,800"},
+	}}
+
+	q, _ := url.ParseQuery("preset=hero")
+	srcset, err := presets.Srcset("https://img.example.com", "https://example.com/a.png", 1600, 1200, q, []int{400, 800})
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if len(srcset.Variants) != 2 {
+		t.Fatal("expected:", 2, "got:", len(srcset.Variants))
+	}
+	if v := srcset.Variants[0]; v.Width != 400 || v.Height != 200 {
+		t.Error("expected:", "400x200", "got:", v.Width, v.Height)
+	}
+	if !strings.HasPrefix(srcset.Srcset, "https://img.example.com/image?") || !strings.HasSuffix(srcset.Srcset, " 800w") {
+		t.Error("expected:", "absolute urls with width descriptors", "got:", srcset.Srcset)
+	}
+
+	// the urls have to pass the enforced presets of the image endpoint
+	for _, v := range srcset.Variants {
+		u, _ := url.Parse(v.Url)
+		if _, err := presets.ParseOptions(u.Query()); err != nil {
+			t.Error("expected:", nil, "got:", err)
+		}
+	}
+}
+
+func TestPresets_Srcset_Inside(t *testing.T) {
+	q, _ := url.ParseQuery("fit=inside")
+	srcset, err := (&Presets{}).Srcset("", "https://example.com/a.png", 500, 250, q, []int{250, 500, 1000})
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	// 1000 results in the same variant as 500
+	if len(srcset.Variants) != 2 {
+		t.Error("expected:", 2, "got:", len(srcset.Variants))
+	}
+	if !strings.HasPrefix(srcset.Variants[0].Url, "/image?") {
+		t.Error("expected:", "/image?...", "got:", srcset.Variants[0].Url)
+	}
+}
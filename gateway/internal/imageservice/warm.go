@@ -0,0 +1,57 @@
+package imageservice
+
+import (
+	"errors"
+	"log"
+)
+
+type (
+	// Warmer caches variants on their workers in the background. A single goroutine works through a
+	// bounded queue, so at most one variant per gateway is processed for warming at a time and a burst
+	// of requests cannot pile up goroutines.
+	Warmer struct {
+		service warmService
+		jobs    chan warmJob
+	}
+
+	warmService interface {
+		ImageGetter
+		ImageCacher
+	}
+
+	warmJob struct {
+		workerUrl string
+		imgUrl    string
+		opts      Options
+	}
+)
+
+// NewWarmer starts a warmer which queues up to size variants
+func NewWarmer(service warmService, size int) *Warmer {
+	w := &Warmer{service: service, jobs: make(chan warmJob, size)}
+	go w.run()
+	return w
+}
+
+// Warm queues a variant to be cached if it is not cached yet. It returns false without blocking if
+// the queue is full and the variant was dropped.
+func (w *Warmer) Warm(workerUrl, imgUrl string, opts Options) bool {
+	select {
+	case w.jobs <- warmJob{workerUrl: workerUrl, imgUrl: imgUrl, opts: opts}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (w *Warmer) run() {
+	for job := range w.jobs {
+		_, err := w.service.GetImage(job.workerUrl, job.imgUrl, job.opts)
+		if errors.Is(err, ErrNotFound) {
+			_, err = w.service.CacheImage(job.workerUrl, job.imgUrl, job.opts)
+		}
+		if err != nil {
+			log.Println("Warmer (gateway) error warming variant of", job.imgUrl, err)
+		}
+	}
+}
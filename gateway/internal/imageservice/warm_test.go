@@ -0,0 +1,53 @@
+package imageservice
+
+import (
+	"testing"
+	"time"
+)
+
+// blockingService reports every variant as missing and blocks caching until release is closed
+type blockingService struct {
+	started chan struct{}
+	release chan struct{}
+	cached  chan Options
+}
+
+func (s *blockingService) GetImage(workerUrl, imgUrl string, opts Options) (*Image, error) {
+	return nil, ErrNotFound
+}
+
+func (s *blockingService) CacheImage(workerUrl, imgUrl string, opts Options) (*Image, error) {
+	s.started <- struct{}{}
+	<-s.release
+	s.cached <- opts
+	return &Image{}, nil
+}
+
+func TestWarmer_Warm(t *testing.T) {
+	service := &blockingService{started: make(chan struct{}, 3), release: make(chan struct{}), cached: make(chan Options, 3)}
+	warmer := NewWarmer(service, 1)
+
+	if !warmer.Warm("notaurl:2929", "https://notarealhost.com/image.png", Options{Width: 100}) {
+		t.Fatal("expected:", true, "got:", false)
+	}
+	// the first variant is being cached, the second one waits in the queue and the third one is dropped
+	<-service.started
+	if !warmer.Warm("notaurl:2929", "https://notarealhost.com/image.png", Options{Width: 200}) {
+		t.Error("expected:", true, "got:", false)
+	}
+	if warmer.Warm("notaurl:2929", "https://notarealhost.com/image.png", Options{Width: 300}) {
+		t.Error("expected:", false, "got:", true)
+	}
+
+	close(service.release)
+	for _, want := range []int{100, 200} {
+		select {
+		case opts := <-service.cached:
+			if opts.Width != want {
+				t.Error("expected:", want, "got:", opts.Width)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected:", want, "got:", "timeout")
+		}
+	}
+}
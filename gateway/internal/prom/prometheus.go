@@ -14,6 +14,14 @@ var (
 		Name: "imgproxy_image_handler_errors_total",
 		Help: "The total number of errors which occurred in the image handler",
 	})
+	PlaceholderHandlerHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "imgproxy_placeholder_handler_hits_total",
+		Help: "The total number of processed requests from the placeholder handler",
+	})
+	PlaceholderHandlerErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "imgproxy_placeholder_handler_errors_total",
+		Help: "The total number of errors which occurred in the placeholder handler",
+	})
 	HealthHandlerErrors = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "imgproxy_health_handler_errors_total",
 		Help: "The total number of errors which occurred in the handler",
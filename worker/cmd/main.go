@@ -5,6 +5,7 @@ import (
 	"github.com/hashicorp/memberlist"
 	"github.com/phips4/img-proxy/worker/internal"
 	"github.com/phips4/img-proxy/worker/internal/api"
+	"github.com/phips4/img-proxy/worker/internal/imaging"
 	"github.com/phips4/img-proxy/worker/internal/middleware"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"log"
@@ -23,6 +24,18 @@ func main() {
 		return
 	}
 
+	presets, err := imaging.LoadPresets(conf.PresetsFile())
+	if err != nil {
+		log.Fatalln("error loading presets:", err.Error())
+		return
+	}
+
+	watermark, err := imaging.LoadWatermark(conf.Watermark())
+	if err != nil {
+		log.Fatalln("error loading watermark:", err.Error())
+		return
+	}
+
 	log.Printf("starting worker URL: %s:%s/ \n", conf.Host(), conf.HttpPort())
 
 	ml, err := joinCluster(conf.Host(), conf.Name(), conf.Secret(), conf.KnownHosts())
@@ -32,11 +45,36 @@ func main() {
 	}
 
 	cache := internal.NewCache()
-
-	http.HandleFunc("/v1/image", middleware.OnlyGet(api.ImageHandler(cache, internal.Sha256UrlHasher)))
-	http.HandleFunc("/v1/cache", middleware.OnlyPost(api.ImageCacheHandler(cache, internal.Sha256UrlHasher, internal.DownloadImg)))
+	limiter := internal.NewOriginLimiter(conf.OriginMaxConcurrent(), conf.OriginAcquireTimeout(),
+		conf.OriginFailureThreshold(), conf.OriginOpenTimeout())
+	downloader := limiter.Wrap(internal.NewHttpDownloader(conf.Downloader()))
+	processor := imaging.NewProcessor(imaging.ProcessorConfig{
+		KeepICC: conf.KeepICC(),
+		Debug:   conf.Debug(),
+		Limits: imaging.Limits{
+			MaxWidth:  conf.MaxWidth(),
+			MaxHeight: conf.MaxHeight(),
+			MaxPixels: conf.MaxMegapixels() * 1_000_000,
+		},
+		MaxFrames:       conf.MaxFrames(),
+		Watermark:       watermark,
+		Concurrency:     conf.ProcessingConcurrency(),
+		QueueDepth:      conf.ProcessingQueueDepth(),
+		Svg:             conf.RasterizeSvg(),
+		Optimize:        conf.Optimize(),
+		OptimizeQuality: conf.OptimizeQuality(),
+	})
+	hashes := api.NewHashQueue(cache, processor, 1024)
+
+	http.HandleFunc("/v1/image", middleware.OnlyGet(api.ImageHandler(cache, internal.Sha256UrlHasher, presets, processor)))
+	http.HandleFunc("/v1/cache", middleware.OnlyPost(api.ImageCacheHandler(cache, internal.Sha256UrlHasher, downloader, presets, processor, hashes)))
+	http.HandleFunc("/v1/revalidate", middleware.OnlyPost(api.RevalidateHandler(cache, internal.Sha256UrlHasher, downloader, processor, hashes)))
+	http.HandleFunc("/v1/purge", middleware.OnlyPost(api.PurgeHandler(cache, internal.Sha256UrlHasher)))
+	http.HandleFunc("/v1/placeholder", middleware.OnlyGet(api.PlaceholderHandler(cache, internal.Sha256UrlHasher, processor)))
+	http.HandleFunc("/v1/info", middleware.OnlyGet(api.InfoHandler(cache, internal.Sha256UrlHasher, hashes)))
+	http.HandleFunc("/v1/duplicates", middleware.OnlyGet(api.DuplicatesHandler(cache, hashes)))
 	http.HandleFunc("/health", middleware.OnlyGet(api.HealthHandler(ml)))
-	http.HandleFunc("/dashboard", middleware.OnlyGet(api.DashboardHandler(cache, ml)))
+	http.HandleFunc("/dashboard", middleware.OnlyGet(api.DashboardHandler(cache, limiter, ml)))
 	http.Handle("/metrics", promhttp.Handler())
 
 	go func() {
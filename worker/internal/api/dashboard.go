@@ -17,6 +17,7 @@ type dashboardData struct {
 	ImageCount   int
 	Meta         string
 	Name         string
+	Origins      []internal.OriginStatus
 }
 
 const htmlTemplate = `
@@ -44,6 +45,15 @@ const htmlTemplate = `
 		.info {
 			margin-top: 20px;
 		}
+		table {
+			width: 100%;
+			border-collapse: collapse;
+		}
+		th, td {
+			text-align: left;
+			padding: 4px;
+			border-bottom: 1px solid #ddd;
+		}
 	</style>
 </head>
 <body>
@@ -57,13 +67,24 @@ const htmlTemplate = `
 			<p>Gateway Node Count: {{.GatewayCount}}</p>
 			<p>total: {{.NodeCount}}</p>
 		</div>
+		<div class="info">
+			<h2>Origins</h2>
+			<table>
+				<tr><th>Host</th><th>Breaker</th><th>In flight</th><th>Failures</th></tr>
+				{{range .Origins}}
+				<tr><td>{{.Host}}</td><td>{{.State}}</td><td>{{.InFlight}}</td><td>{{.Failures}}</td></tr>
+				{{else}}
+				<tr><td colspan="4">no origins contacted yet</td></tr>
+				{{end}}
+			</table>
+		</div>
 	</div>
 </body>
 </html>
 `
 
 // DashboardHandler is an HTTP handler function that renders the dashboard template
-func DashboardHandler(cache *internal.Cache, ml *memberlist.Memberlist) http.HandlerFunc {
+func DashboardHandler(cache *internal.Cache, limiter *internal.OriginLimiter, ml *memberlist.Memberlist) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		data := dashboardData{
 			Ip:         ml.LocalNode().Addr.String(),
@@ -71,6 +92,7 @@ func DashboardHandler(cache *internal.Cache, ml *memberlist.Memberlist) http.Han
 			ImageCount: cache.Count(),
 			Name:       ml.LocalNode().Name,
 			Meta:       string(ml.LocalNode().Meta),
+			Origins:    limiter.Status(),
 		}
 
 		var gateways []*memberlist.Node
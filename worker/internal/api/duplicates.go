@@ -0,0 +1,163 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/phips4/img-proxy/worker/internal"
+	"github.com/phips4/img-proxy/worker/internal/imaging"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxDuplicates is the largest number of near-duplicates returned, the closest ones are kept
+const maxDuplicates = 100
+
+// Duplicate is a cached original whose perceptual hash is close to the one looked up
+type Duplicate struct {
+	Url      string `json:"url"`
+	DHash    string `json:"dhash"`
+	Distance int    `json:"distance"`
+}
+
+// HashQueue computes the perceptual hashes of cached originals in the background, so caching an image
+// does not decode it a second time. A single goroutine works through a bounded queue and shares the
+// processing pool with all other work.
+type HashQueue struct {
+	cache *internal.Cache
+	dHash func(ctx context.Context, data []byte, format internal.ImageFormat) (uint64, error)
+	keys  chan string
+}
+
+// NewHashQueue starts a queue which holds up to size originals
+func NewHashQueue(cache *internal.Cache, processor *imaging.Processor, size int) *HashQueue {
+	q := &HashQueue{cache: cache, dHash: processor.DHash, keys: make(chan string, size)}
+	go q.run()
+	return q
+}
+
+// Queue asks for the original cached under key to be hashed. If the queue is full it is dropped, the
+// next search for duplicates queues it again.
+func (q *HashQueue) Queue(key string) {
+	select {
+	case q.keys <- key:
+	default:
+	}
+}
+
+func (q *HashQueue) run() {
+	for key := range q.keys {
+		q.hashKey(key)
+	}
+}
+
+// hashKey hashes the original cached under key unless it is hashed already or cannot be hashed
+func (q *HashQueue) hashKey(key string) {
+	entry, err := q.cache.Get(key)
+	if err != nil || entry.DHash != "" || entry.HashFailed {
+		return
+	}
+	if _, err := q.Hash(context.Background(), key, entry); err != nil {
+		log.Println("HashQueue (worker) error while hashing image:", err)
+	}
+}
+
+// Hash computes the perceptual hash of the original entry and stores it with the cache entry under
+// key. If the image cannot be hashed, that is stored instead so it is not decoded again until it is
+// replaced. A full processing queue or a canceled request is only reported, the next attempt may work.
+func (q *HashQueue) Hash(ctx context.Context, key string, entry internal.CacheEntry) (string, error) {
+	hash, err := q.dHash(ctx, entry.Data, entry.Format)
+	dHash := ""
+	if err == nil {
+		dHash = imaging.FormatHash(hash)
+	} else if errors.Is(err, imaging.ErrPoolFull) || errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return "", err
+	}
+
+	updateErr := q.cache.Update(key, func(e *internal.CacheEntry) {
+		// the image may have been replaced by a revalidation in the meantime
+		if e.CachedAt.Equal(entry.CachedAt) {
+			e.DHash = dHash
+			e.HashFailed = err != nil
+		}
+	})
+	if updateErr != nil {
+		log.Println("HashQueue (worker) error while updating cache:", updateErr)
+	}
+	return dHash, err
+}
+
+// DuplicatesHandler finds the cached originals whose perceptual hash is within a Hamming distance of
+// the hash parameter. The result is sorted by distance, only this worker's cache is searched. Originals
+// which are not hashed yet are queued on hashes and found by later searches, ones which cannot be
+// hashed are skipped.
+func DuplicatesHandler(cache *internal.Cache, hashes *HashQueue) http.HandlerFunc {
+	type response struct {
+		Duplicates []Duplicate `json:"duplicates"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		hash, err := imaging.ParseHash(r.URL.Query().Get("hash"))
+		if err != nil {
+			log.Println("DuplicatesHandler (worker) error while parsing hash:", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		distance := imaging.DefaultHashDistance
+		if v := r.URL.Query().Get("distance"); v != "" {
+			distance, err = strconv.Atoi(v)
+			if err != nil || distance < 0 || distance > imaging.MaxHashDistance {
+				log.Println("DuplicatesHandler (worker) error invalid distance:", v)
+				http.Error(w, "distance must be between 0 and "+strconv.Itoa(imaging.MaxHashDistance), http.StatusBadRequest)
+				return
+			}
+		}
+
+		duplicates := make([]Duplicate, 0)
+		cache.Range(func(key string, entry internal.CacheEntry) bool {
+			// variants are derived from their original and not hashed
+			if strings.Contains(key, variantSeparator) || entry.HashFailed {
+				return true
+			}
+			if entry.DHash == "" {
+				hashes.Queue(key)
+				return true
+			}
+			other, err := imaging.ParseHash(entry.DHash)
+			if err != nil {
+				return true
+			}
+			if d := imaging.HashDistance(hash, other); d <= distance {
+				duplicates = append(duplicates, Duplicate{Url: entry.Url, DHash: entry.DHash, Distance: d})
+			}
+			return true
+		})
+		sort.Slice(duplicates, func(i, j int) bool {
+			if duplicates[i].Distance != duplicates[j].Distance {
+				return duplicates[i].Distance < duplicates[j].Distance
+			}
+			return duplicates[i].Url < duplicates[j].Url
+		})
+		if len(duplicates) > maxDuplicates {
+			duplicates = duplicates[:maxDuplicates]
+		}
+
+		jsn, err := json.Marshal(response{Duplicates: duplicates})
+		if err != nil {
+			log.Println("DuplicatesHandler (worker) error marshalling json:", err)
+			http.Error(w, internalErrorStr, http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(jsn); err != nil {
+			log.Println("DuplicatesHandler (worker) error writing response:", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"github.com/phips4/img-proxy/worker/internal"
+	"github.com/phips4/img-proxy/worker/internal/imaging"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHashQueue_Failure(t *testing.T) {
+	cache := internal.NewCache()
+	if err := cache.Set("broken", internal.CacheEntry{Data: []byte("broken"), Format: internal.FormatPng, CachedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	decodes := 0
+	hashes := &HashQueue{
+		cache: cache,
+		dHash: func(ctx context.Context, data []byte, format internal.ImageFormat) (uint64, error) {
+			decodes++
+			return 0, errors.New("decoding png: invalid format")
+		},
+		keys: make(chan string, 8),
+	}
+	handler := DuplicatesHandler(cache, hashes)
+
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/v1/duplicates?hash=00000000000000ff", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatal("expected:", http.StatusOK, "got:", rec.Code)
+		}
+		// work through the queue like the goroutine of NewHashQueue does
+		for len(hashes.keys) > 0 {
+			hashes.hashKey(<-hashes.keys)
+		}
+	}
+
+	if decodes != 1 {
+		t.Error("expected:", 1, "got:", decodes)
+	}
+	if entry, _ := cache.Get("broken"); !entry.HashFailed || entry.DHash != "" {
+		t.Error("expected:", "failure recorded", "got:", entry.HashFailed, entry.DHash)
+	}
+}
+
+func TestHashQueue_Busy(t *testing.T) {
+	cache := internal.NewCache()
+	entry := internal.CacheEntry{Data: []byte("image"), Format: internal.FormatPng, CachedAt: time.Now()}
+	if err := cache.Set("image", entry); err != nil {
+		t.Fatal(err)
+	}
+
+	// a full processing queue says nothing about the image, it is hashed on the next attempt
+	hashes := &HashQueue{
+		cache: cache,
+		dHash: func(ctx context.Context, data []byte, format internal.ImageFormat) (uint64, error) {
+			return 0, imaging.ErrPoolFull
+		},
+	}
+	if _, err := hashes.Hash(context.Background(), "image", entry); !errors.Is(err, imaging.ErrPoolFull) {
+		t.Error("expected:", imaging.ErrPoolFull, "got:", err)
+	}
+	if got, _ := cache.Get("image"); got.HashFailed {
+		t.Error("expected:", false, "got:", got.HashFailed)
+	}
+}
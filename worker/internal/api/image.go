@@ -1,20 +1,29 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"github.com/phips4/img-proxy/worker/internal"
+	"github.com/phips4/img-proxy/worker/internal/imaging"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 )
 
 const internalErrorStr = "internal server error"
 
+// variantSeparator separates the hash of the url from the hash of the options in the keys of variants
+const variantSeparator = "/"
+
+// retryAfter is the number of seconds clients are asked to wait if the processing queue is full
+const retryAfter = "1"
+
 // ImageHandler gets an image from the local cache
-func ImageHandler(cache *internal.Cache, hasherFunc internal.UrlHasherFunc) http.HandlerFunc {
+func ImageHandler(cache *internal.Cache, hasherFunc internal.UrlHasherFunc, presets *imaging.Presets, processor *imaging.Processor) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		imgUrl, err := url.QueryUnescape(r.URL.Query().Get("url"))
 		if err != nil {
@@ -23,14 +32,33 @@ func ImageHandler(cache *internal.Cache, hasherFunc internal.UrlHasherFunc) http
 			return
 		}
 
-		urlHash, err := hasherFunc(imgUrl)
+		opts, err := presets.ParseOptions(r.URL.Query())
+		if err != nil {
+			log.Println("ImageHandler (worker) error while parsing options:", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		originalKey, err := hasherFunc(imgUrl)
 		if err != nil {
 			log.Println("ImageHandler (worker) error while hashing url:", err)
 			http.Error(w, internalErrorStr, http.StatusInternalServerError)
 			return
 		}
+		// the policy depends on where the original was served from, variants only exist with their original
+		finalUrl := ""
+		if original, err := cache.Get(originalKey); err == nil {
+			finalUrl = original.FinalUrl
+		}
 
-		raw, err := cache.Get(urlHash)
+		urlHash, err := variantKey(hasherFunc, imgUrl, processor.Policy(imgUrl, finalUrl, opts))
+		if err != nil {
+			log.Println("ImageHandler (worker) error while hashing url:", err)
+			http.Error(w, internalErrorStr, http.StatusInternalServerError)
+			return
+		}
+
+		entry, err := cache.Get(urlHash)
 		if err != nil {
 			if strings.HasPrefix(err.Error(), "key not found:") {
 				log.Println("ImageHandler (worker) cache miss")
@@ -42,17 +70,8 @@ func ImageHandler(cache *internal.Cache, hasherFunc internal.UrlHasherFunc) http
 			return
 		}
 
-		if isJpeg(raw) {
-			w.Header().Set("Content-Type", "image/jpeg")
-		} else if isPng(raw) {
-			w.Header().Set("Content-Type", "image/png")
-		} else {
-			log.Println("ImageHandler (worker) unknown image type")
-			http.Error(w, "Unknown image type. Only jpeg and png are supported", http.StatusBadRequest)
-			return
-		}
-
-		_, err = w.Write(raw)
+		w.Header().Set("Content-Type", entry.Format.ContentType())
+		_, err = w.Write(entry.Data)
 		if err != nil {
 			log.Println("ImageHandler (worker) error while writing response:", err)
 			http.Error(w, internalErrorStr, http.StatusInternalServerError)
@@ -62,9 +81,11 @@ func ImageHandler(cache *internal.Cache, hasherFunc internal.UrlHasherFunc) http
 }
 
 // ImageCacheHandler handles uploading images to the local cache
-func ImageCacheHandler(cache *internal.Cache, hFunc internal.UrlHasherFunc, dlFunc internal.DownloaderFunc) http.HandlerFunc {
+func ImageCacheHandler(cache *internal.Cache, hFunc internal.UrlHasherFunc, downloader internal.Downloader, presets *imaging.Presets,
+	processor *imaging.Processor, hashes *HashQueue) http.HandlerFunc {
 	type bodyJson struct {
-		Url string `json:"url"`
+		Url     string            `json:"url"`
+		Options map[string]string `json:"options"`
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -82,35 +103,51 @@ func ImageCacheHandler(cache *internal.Cache, hFunc internal.UrlHasherFunc, dlFu
 			return
 		}
 
-		raw, err := dlFunc(bj.Url)
+		query := url.Values{}
+		for k, v := range bj.Options {
+			query.Set(k, v)
+		}
+		opts, err := presets.ParseOptions(query)
 		if err != nil {
-			if errors.Is(err, internal.ErrFileNotFound) {
-				log.Println("ImageHandler (worker) file not found")
-				http.NotFound(w, r)
-				return
-			}
-
-			log.Println("ImageHandler (worker) error while downloading image:", err)
-			http.Error(w, internalErrorStr, http.StatusInternalServerError)
+			log.Println("ImageCacheHandler (worker) error while parsing options:", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		original, err := cachedOriginal(cache, hFunc, downloader, processor, hashes, bj.Url)
+		if err != nil {
+			downloadError(w, r, "ImageCacheHandler", err)
 			return
 		}
+		opts = processor.Policy(bj.Url, original.FinalUrl, opts)
 
-		hashedUrl, err := hFunc(bj.Url)
+		hashedUrl, err := variantKey(hFunc, bj.Url, opts)
 		if err != nil {
 			log.Println("ImageHandler (worker) error while hashing image:", err)
 			http.Error(w, internalErrorStr, http.StatusInternalServerError)
 			return
 		}
 
-		//TODO: do resizing, compression etc here
+		raw, outFormat, err := processor.Process(r.Context(), original.Data, original.Format, opts)
+		if err != nil {
+			processError(w, "ImageCacheHandler", err)
+			return
+		}
 
-		if err = cache.Set(hashedUrl, raw); err != nil {
+		// the variant is as fresh as the original it was derived from
+		entry := original
+		entry.Data = raw
+		entry.Format = outFormat
+		entry.Placeholder = nil
+		entry.DHash = ""
+		entry.HashFailed = false
+		if err = cache.Set(hashedUrl, entry); err != nil {
 			log.Println("ImageHandler (worker) error while writing response:", err)
 			http.Error(w, internalErrorStr, http.StatusInternalServerError)
 			return
 		}
 
-		if _, err = w.Write(raw); err != nil {
+		w.Header().Set("Content-Type", entry.Format.ContentType())
+		if _, err = w.Write(entry.Data); err != nil {
 			log.Println("ImageHandler (worker) error while writing response:", err)
 			http.Error(w, internalErrorStr, http.StatusInternalServerError)
 			return
@@ -118,16 +155,301 @@ func ImageCacheHandler(cache *internal.Cache, hFunc internal.UrlHasherFunc, dlFu
 	}
 }
 
-func isJpeg(data []byte) bool {
-	if len(data) < 2 {
-		return false
+// RevalidateHandler checks with the origin whether a cached image changed. The cached original is only
+// replaced if the origin responds with a new image, its variants are removed then. A 304 Not Modified
+// just refreshes the entry. A new image is queued on hashes to get its perceptual hash.
+func RevalidateHandler(cache *internal.Cache, hFunc internal.UrlHasherFunc, downloader internal.Downloader, processor *imaging.Processor,
+	hashes *HashQueue) http.HandlerFunc {
+	type bodyJson struct {
+		Url string `json:"url"`
+	}
+	type response struct {
+		Modified bool `json:"modified"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var bj bodyJson
+		if err := json.NewDecoder(r.Body).Decode(&bj); err != nil {
+			log.Println("RevalidateHandler (worker) error while parsing body:", err)
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		hashedUrl, err := hFunc(bj.Url)
+		if err != nil {
+			log.Println("RevalidateHandler (worker) error while hashing url:", err)
+			http.Error(w, internalErrorStr, http.StatusInternalServerError)
+			return
+		}
+
+		entry, err := cache.Get(hashedUrl)
+		if err != nil {
+			log.Println("RevalidateHandler (worker) cache miss")
+			http.Error(w, "image not found", http.StatusNotFound)
+			return
+		}
+
+		dl, err := downloader.Download(bj.Url, entry.Validators())
+		if err != nil {
+			downloadError(w, r, "RevalidateHandler", err)
+			return
+		}
+
+		readAt := entry.CachedAt
+		if dl.NotModified {
+			// a 304 may omit headers which did not change
+			if dl.ETag != "" {
+				entry.ETag = dl.ETag
+			}
+			if dl.LastModified != "" {
+				entry.LastModified = dl.LastModified
+			}
+			if dl.CacheControl != "" {
+				entry.CacheControl = dl.CacheControl
+			}
+		} else {
+			format, err := validateOriginal(dl, processor)
+			if err != nil {
+				downloadError(w, r, "RevalidateHandler", err)
+				return
+			}
+			entry.Data = dl.Data
+			entry.Placeholder = nil
+			entry.DHash = ""
+			entry.HashFailed = false
+			entry.FinalUrl = dl.FinalUrl
+			entry.Format = format
+			entry.ContentType = dl.ContentType
+			entry.ETag = dl.ETag
+			entry.LastModified = dl.LastModified
+			entry.CacheControl = dl.CacheControl
+		}
+		entry.CachedAt = time.Now()
+
+		// the entry may have been purged or replaced while the origin was asked, neither is undone
+		stored := false
+		err = cache.Update(hashedUrl, func(e *internal.CacheEntry) {
+			if e.CachedAt.Equal(readAt) {
+				*e = entry
+				stored = true
+			}
+		})
+		if err != nil {
+			log.Println("RevalidateHandler (worker) image was purged during revalidation")
+			http.Error(w, "image not found", http.StatusNotFound)
+			return
+		}
+		if stored && !dl.NotModified {
+			// variants of the old image are derived again on their next request
+			removed := cache.RemovePrefix(hashedUrl + variantSeparator)
+			log.Println("RevalidateHandler (worker)", bj.Url, "changed, removed", removed, "variants")
+		}
+		if stored && entry.DHash == "" {
+			hashes.Queue(hashedUrl)
+		}
+
+		jsn, err := json.Marshal(response{Modified: !dl.NotModified})
+		if err != nil {
+			log.Println("RevalidateHandler (worker) error marshalling json:", err)
+			http.Error(w, internalErrorStr, http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(jsn); err != nil {
+			log.Println("RevalidateHandler (worker) error writing response:", err)
+			return
+		}
+	}
+}
+
+// PurgeHandler removes the original of an image and all of its variants from the cache
+func PurgeHandler(cache *internal.Cache, hFunc internal.UrlHasherFunc) http.HandlerFunc {
+	type bodyJson struct {
+		Url string `json:"url"`
+	}
+	type response struct {
+		Purged int `json:"purged"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var bj bodyJson
+		if err := json.NewDecoder(r.Body).Decode(&bj); err != nil || bj.Url == "" {
+			log.Println("PurgeHandler (worker) error while parsing body:", err)
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		hashedUrl, err := hFunc(bj.Url)
+		if err != nil {
+			log.Println("PurgeHandler (worker) error while hashing url:", err)
+			http.Error(w, internalErrorStr, http.StatusInternalServerError)
+			return
+		}
+
+		// the keys of all variants start with the key of the original
+		jsn, err := json.Marshal(response{Purged: cache.RemovePrefix(hashedUrl)})
+		if err != nil {
+			log.Println("PurgeHandler (worker) error marshalling json:", err)
+			http.Error(w, internalErrorStr, http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(jsn); err != nil {
+			log.Println("PurgeHandler (worker) error writing response:", err)
+			return
+		}
+	}
+}
+
+// variantKey returns the cache key of the variant of imgUrl described by opts. It is the hash of the
+// url followed by the hash of the normalized options, the original is stored under just the hash of
+// the url. All variants of an image therefore share the prefix of its original.
+func variantKey(hFunc internal.UrlHasherFunc, imgUrl string, opts imaging.Options) (string, error) {
+	urlHash, err := hFunc(imgUrl)
+	if err != nil {
+		return "", err
+	}
+	optsHash, err := hFunc(opts.Key())
+	if err != nil {
+		return "", err
+	}
+	return urlHash + variantSeparator + optsHash, nil
+}
+
+// cachedOriginal returns the original of imgUrl from the cache, downloading it first if it is not cached
+// yet. A new original is queued on hashes to get its perceptual hash. Errors are those of downloading
+// and validating the image.
+func cachedOriginal(cache *internal.Cache, hFunc internal.UrlHasherFunc, downloader internal.Downloader,
+	processor *imaging.Processor, hashes *HashQueue, imgUrl string) (internal.CacheEntry, error) {
+	key, err := hFunc(imgUrl)
+	if err != nil {
+		return internal.CacheEntry{}, err
+	}
+	if entry, err := cache.Get(key); err == nil {
+		return entry, nil
+	}
+
+	dl, err := downloader.Download(imgUrl, internal.Validators{})
+	if err != nil {
+		return internal.CacheEntry{}, err
+	}
+	format, err := validateOriginal(dl, processor)
+	if err != nil {
+		return internal.CacheEntry{}, err
+	}
+	if dl.FinalUrl != imgUrl {
+		log.Println("ImageCacheHandler (worker)", imgUrl, "resolved to", dl.FinalUrl)
+	}
+
+	entry := internal.CacheEntry{
+		Data:         dl.Data,
+		Url:          imgUrl,
+		FinalUrl:     dl.FinalUrl,
+		Format:       format,
+		ContentType:  dl.ContentType,
+		ETag:         dl.ETag,
+		LastModified: dl.LastModified,
+		CacheControl: dl.CacheControl,
+		CachedAt:     time.Now(),
+	}
+	if err := cache.Set(key, entry); err != nil {
+		return internal.CacheEntry{}, err
+	}
+	hashes.Queue(key)
+	return entry, nil
+}
+
+// validateOriginal makes sure a download is an image the processor can handle
+func validateOriginal(dl *internal.Download, processor *imaging.Processor) (internal.ImageFormat, error) {
+	format, err := internal.ValidateImage(dl.Data, dl.ContentType)
+	if err != nil {
+		return "", err
+	}
+	if !processor.Accepts(format) {
+		return "", &internal.UnsupportedMediaError{Reason: string(format) + " images are disabled"}
+	}
+	return format, nil
+}
+
+// lookupOriginal gets the cached original of the image in the url parameter of r. If it is not cached,
+// an error response is written and ok is false.
+func lookupOriginal(w http.ResponseWriter, r *http.Request, cache *internal.Cache, hFunc internal.UrlHasherFunc,
+	handler string) (key string, entry internal.CacheEntry, ok bool) {
+	imgUrl, err := url.QueryUnescape(r.URL.Query().Get("url"))
+	if err != nil {
+		log.Println(handler, "(worker) error while un-escaping url:", err)
+		http.Error(w, internalErrorStr, http.StatusInternalServerError)
+		return "", internal.CacheEntry{}, false
+	}
+
+	key, err = hFunc(imgUrl)
+	if err != nil {
+		log.Println(handler, "(worker) error while hashing url:", err)
+		http.Error(w, internalErrorStr, http.StatusInternalServerError)
+		return "", internal.CacheEntry{}, false
+	}
+
+	entry, err = cache.Get(key)
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "key not found:") {
+			log.Println(handler, "(worker) cache miss")
+			http.Error(w, "image not found", http.StatusNotFound)
+			return "", internal.CacheEntry{}, false
+		}
+		log.Println(handler, "(worker) error while getting image:", err)
+		http.Error(w, internalErrorStr, http.StatusInternalServerError)
+		return "", internal.CacheEntry{}, false
+	}
+
+	return key, entry, true
+}
+
+// downloadError maps errors of downloading and validating an origin image to a response
+func downloadError(w http.ResponseWriter, r *http.Request, handler string, err error) {
+	var mediaErr *internal.UnsupportedMediaError
+	switch {
+	case errors.Is(err, internal.ErrFileNotFound):
+		log.Println(handler, "(worker) file not found")
+		http.NotFound(w, r)
+	case errors.Is(err, internal.ErrCircuitOpen) || errors.Is(err, internal.ErrOriginBusy):
+		log.Println(handler, "(worker) origin unavailable:", err)
+		http.Error(w, "origin unavailable", http.StatusServiceUnavailable)
+	case errors.Is(err, internal.ErrForbiddenHost) || errors.Is(err, internal.ErrRedirect):
+		log.Println(handler, "(worker) download forbidden by policy:", err)
+		http.Error(w, "url not allowed", http.StatusForbidden)
+	case errors.As(err, &mediaErr):
+		log.Println(handler, "(worker) rejected download:", err)
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+	default:
+		log.Println(handler, "(worker) error while downloading image:", err)
+		http.Error(w, internalErrorStr, http.StatusInternalServerError)
 	}
-	return data[0] == 0xFF && data[1] == 0xD8
 }
 
-func isPng(data []byte) bool {
-	if len(data) < 8 {
-		return false
+// processError maps errors of transforming an image to a response
+func processError(w http.ResponseWriter, handler string, err error) {
+	var mediaErr *internal.UnsupportedMediaError
+	switch {
+	case errors.Is(err, imaging.ErrImageTooLarge):
+		log.Println(handler, "(worker) rejected image:", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	case errors.As(err, &mediaErr):
+		log.Println(handler, "(worker) rejected image:", err)
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+	case errors.Is(err, imaging.ErrPoolFull):
+		log.Println(handler, "(worker) processing queue full:", err)
+		w.Header().Set("Retry-After", retryAfter)
+		http.Error(w, "worker busy", http.StatusServiceUnavailable)
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		log.Println(handler, "(worker) request ended while waiting for processing:", err)
+		http.Error(w, "request canceled", http.StatusServiceUnavailable)
+	case errors.Is(err, imaging.ErrInvalidOptions):
+		log.Println(handler, "(worker) options do not fit the image:", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Println(handler, "(worker) error while processing image:", err)
+		http.Error(w, internalErrorStr, http.StatusInternalServerError)
 	}
-	return string(data[0:8]) == "\x89PNG\r\n\x1a\n"
 }
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/phips4/img-proxy/worker/internal"
+	"github.com/phips4/img-proxy/worker/internal/imaging"
+	"log"
+	"net/http"
+	"time"
+)
+
+// InfoHandler describes a cached original image and how long it stays fresh. The perceptual hash is
+// computed on hashes if the original is not hashed yet.
+func InfoHandler(cache *internal.Cache, hFunc internal.UrlHasherFunc, hashes *HashQueue) http.HandlerFunc {
+	type response struct {
+		Url           string               `json:"url"`
+		FinalUrl      string               `json:"final_url"`
+		Width         int                  `json:"width"`
+		Height        int                  `json:"height"`
+		Format        internal.ImageFormat `json:"format"`
+		Size          int                  `json:"size"`
+		Frames        int                  `json:"frames"`
+		HasAlpha      bool                 `json:"has_alpha"`
+		ColorSpace    string               `json:"color_space"`
+		ICCProfile    string               `json:"icc_profile,omitempty"`
+		SRGBConverted bool                 `json:"srgb_converted"`
+		DHash         string               `json:"dhash,omitempty"`
+		ContentType   string               `json:"content_type"`
+		CachedAt      time.Time            `json:"cached_at"`
+		// TTL is the remaining freshness in seconds, null if the origin gave no lifetime
+		TTL *int64 `json:"ttl"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		hashedUrl, entry, ok := lookupOriginal(w, r, cache, hFunc, "InfoHandler")
+		if !ok {
+			return
+		}
+
+		info, err := imaging.Inspect(entry.Data, entry.Format)
+		if err != nil {
+			log.Println("InfoHandler (worker) error while inspecting image:", err)
+			http.Error(w, internalErrorStr, http.StatusInternalServerError)
+			return
+		}
+
+		dHash := entry.DHash
+		if dHash == "" && !entry.HashFailed {
+			dHash, err = hashes.Hash(r.Context(), hashedUrl, entry)
+			if errors.Is(err, imaging.ErrPoolFull) {
+				processError(w, "InfoHandler", err)
+				return
+			}
+			if err != nil {
+				// the info is still useful without the hash
+				log.Println("InfoHandler (worker) error while hashing image:", err)
+			}
+		}
+
+		resp := response{
+			Url:           entry.Url,
+			FinalUrl:      entry.FinalUrl,
+			Width:         info.Width,
+			Height:        info.Height,
+			Format:        entry.Format,
+			Size:          len(entry.Data),
+			Frames:        info.Frames,
+			HasAlpha:      info.HasAlpha,
+			ColorSpace:    info.ColorSpace,
+			ICCProfile:    info.Profile,
+			SRGBConverted: info.ConvertedToSRGB,
+			DHash:         dHash,
+			ContentType:   entry.ContentType,
+			CachedAt:      entry.CachedAt,
+		}
+		if ttl, ok := entry.TTL(time.Now()); ok {
+			seconds := int64(ttl / time.Second)
+			resp.TTL = &seconds
+		}
+
+		jsn, err := json.Marshal(resp)
+		if err != nil {
+			log.Println("InfoHandler (worker) error marshalling json:", err)
+			http.Error(w, internalErrorStr, http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(jsn); err != nil {
+			log.Println("InfoHandler (worker) error writing response:", err)
+			return
+		}
+	}
+}
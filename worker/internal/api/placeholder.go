@@ -0,0 +1,53 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/phips4/img-proxy/worker/internal"
+	"github.com/phips4/img-proxy/worker/internal/imaging"
+	"log"
+	"net/http"
+)
+
+// PlaceholderHandler returns the BlurHash and dominant color of a cached original image. They are
+// computed on the first request and stored with the cache entry.
+func PlaceholderHandler(cache *internal.Cache, hFunc internal.UrlHasherFunc, processor *imaging.Processor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hashedUrl, entry, ok := lookupOriginal(w, r, cache, hFunc, "PlaceholderHandler")
+		if !ok {
+			return
+		}
+
+		placeholder := entry.Placeholder
+		if placeholder == nil {
+			ph, err := processor.Placeholder(r.Context(), entry.Data, entry.Format)
+			if err != nil {
+				processError(w, "PlaceholderHandler", err)
+				return
+			}
+			placeholder = &ph
+
+			err = cache.Update(hashedUrl, func(e *internal.CacheEntry) {
+				// the image may have been replaced by a revalidation in the meantime
+				if e.CachedAt.Equal(entry.CachedAt) {
+					e.Placeholder = placeholder
+				}
+			})
+			if err != nil {
+				log.Println("PlaceholderHandler (worker) error while updating cache:", err)
+			}
+		}
+
+		jsn, err := json.Marshal(placeholder)
+		if err != nil {
+			log.Println("PlaceholderHandler (worker) error marshalling json:", err)
+			http.Error(w, internalErrorStr, http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(jsn); err != nil {
+			log.Println("PlaceholderHandler (worker) error writing response:", err)
+			return
+		}
+	}
+}
@@ -3,44 +3,131 @@ package internal
 import (
 	"errors"
 	"github.com/phips4/img-proxy/worker/internal/prom"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
+// CacheEntry is a cached image together with the origin headers needed to revalidate it
+type CacheEntry struct {
+	Data []byte
+	// Url is the requested location of the image, FinalUrl where it was served from after redirects
+	Url          string
+	FinalUrl     string
+	Format       ImageFormat
+	ContentType  string
+	ETag         string
+	LastModified string
+	CacheControl string
+	CachedAt     time.Time
+	// Placeholder is computed on first request and cached with the original image
+	Placeholder *Placeholder
+	// DHash is the perceptual hash of the original in hex, computed in the background after it is cached.
+	// It is empty for variants and until the image is hashed.
+	DHash string
+	// HashFailed is set if the original cannot be hashed, it is not tried again until it is replaced
+	HashFailed bool
+}
+
+// Placeholder is a tiny stand-in shown by clients while the real image loads
+type Placeholder struct {
+	BlurHash      string `json:"blurhash"`
+	DominantColor string `json:"dominant_color"`
+}
+
+// TTL returns how long the entry stays fresh according to the Cache-Control header of the origin. It
+// reports false if the origin gave no lifetime.
+func (e CacheEntry) TTL(now time.Time) (time.Duration, bool) {
+	var maxAge, sMaxAge = -1, -1
+	for _, directive := range strings.Split(e.CacheControl, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store", "no-cache":
+			return 0, true
+		case "max-age":
+			maxAge, _ = strconv.Atoi(strings.Trim(value, `"`))
+		case "s-maxage":
+			sMaxAge, _ = strconv.Atoi(strings.Trim(value, `"`))
+		}
+	}
+
+	// the cache is shared between all clients, so s-maxage wins
+	if sMaxAge >= 0 {
+		maxAge = sMaxAge
+	}
+	if maxAge < 0 {
+		return 0, false
+	}
+
+	ttl := e.CachedAt.Add(time.Duration(maxAge) * time.Second).Sub(now)
+	if ttl < 0 {
+		ttl = 0
+	}
+	return ttl, true
+}
+
+// Validators returns the headers for a conditional request against the origin of the entry
+func (e CacheEntry) Validators() Validators {
+	return Validators{ETag: e.ETag, LastModified: e.LastModified}
+}
+
 type Cache struct {
 	mu sync.RWMutex
-	m  map[string][]byte
+	m  map[string]CacheEntry
 }
 
 func NewCache() *Cache {
 	return &Cache{
-		m: make(map[string][]byte),
+		m: make(map[string]CacheEntry),
 	}
 }
 
-func (c *Cache) Set(key string, value []byte) error {
+func (c *Cache) Set(key string, entry CacheEntry) error {
 	if key == "" {
 		return errors.New("key cannot be empty")
 	}
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.m[key] = value
+	if old, exists := c.m[key]; exists {
+		// a replaced entry only changes the size of the cache
+		prom.CachedImageBytes.Sub(float64(len(old.Data)))
+	} else {
+		prom.CachedImages.Inc()
+	}
+	c.m[key] = entry
 
-	prom.CachedImages.Inc()
-	prom.CachedImageBytes.Add(float64(len(value)))
+	prom.CachedImageBytes.Add(float64(len(entry.Data)))
 
 	return nil
 }
 
-func (c *Cache) Get(key string) ([]byte, error) {
+func (c *Cache) Get(key string) (CacheEntry, error) {
 	if key == "" {
-		return nil, errors.New("key cannot be empty")
+		return CacheEntry{}, errors.New("key cannot be empty")
 	}
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 	if v, exists := c.m[key]; exists {
 		return v, nil
 	}
-	return nil, errors.New("key not found: " + key)
+	return CacheEntry{}, errors.New("key not found: " + key)
+}
+
+// Update applies fn to the entry stored under key while holding the lock, so fields can be added to
+// an entry without overwriting concurrent changes to the rest of it
+func (c *Cache) Update(key string, fn func(entry *CacheEntry)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, exists := c.m[key]
+	if !exists {
+		return errors.New("key not found: " + key)
+	}
+	size := len(entry.Data)
+	fn(&entry)
+	c.m[key] = entry
+	prom.CachedImageBytes.Add(float64(len(entry.Data) - size))
+	return nil
 }
 
 func (c *Cache) Remove(key string) error {
@@ -49,10 +136,46 @@ func (c *Cache) Remove(key string) error {
 	}
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if old, exists := c.m[key]; exists {
+		prom.CachedImages.Dec()
+		prom.CachedImageBytes.Sub(float64(len(old.Data)))
+	}
 	delete(c.m, key)
 	return nil
 }
 
+// RemovePrefix removes all entries whose key starts with prefix and returns how many there were. It
+// has to look at every key, so it is meant for rare operations like purges.
+func (c *Cache) RemovePrefix(prefix string) int {
+	if prefix == "" {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	for key, entry := range c.m {
+		if strings.HasPrefix(key, prefix) {
+			prom.CachedImages.Dec()
+			prom.CachedImageBytes.Sub(float64(len(entry.Data)))
+			delete(c.m, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Range calls fn for every entry until fn returns false. The cache is locked for reading meanwhile, so
+// fn must not modify it.
+func (c *Cache) Range(fn func(key string, entry CacheEntry) bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for key, entry := range c.m {
+		if !fn(key, entry) {
+			return
+		}
+	}
+}
+
 func (c *Cache) Count() int {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
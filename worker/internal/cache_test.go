@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"github.com/phips4/img-proxy/worker/internal/prom"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"testing"
+	"time"
+)
+
+func TestCacheEntry_TTL(t *testing.T) {
+	cachedAt := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := cachedAt.Add(time.Minute)
+
+	tests := []struct {
+		name         string
+		cacheControl string
+		want         time.Duration
+		wantOk       bool
+	}{
+		{name: "no header", cacheControl: "", want: 0, wantOk: false},
+		{name: "max-age", cacheControl: "public, max-age=3600", want: time.Minute * 59, wantOk: true},
+		{name: "s-maxage wins", cacheControl: "max-age=60, s-maxage=600", want: time.Minute * 9, wantOk: true},
+		{name: "expired", cacheControl: "max-age=30", want: 0, wantOk: true},
+		{name: "no-store", cacheControl: "no-store", want: 0, wantOk: true},
+		{name: "unrelated directives", cacheControl: "public, immutable", want: 0, wantOk: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := CacheEntry{CacheControl: tt.cacheControl, CachedAt: cachedAt}
+			got, ok := e.TTL(now)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("TTL() got = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestCache_RemovePrefix(t *testing.T) {
+	cache := NewCache()
+	for _, key := range []string{"aa", "aa/1", "aa/2", "ab/1"} {
+		if err := cache.Set(key, CacheEntry{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if removed := cache.RemovePrefix("aa"); removed != 3 {
+		t.Error("expected:", 3, "got:", removed)
+	}
+	if _, err := cache.Get("ab/1"); err != nil {
+		t.Error("expected:", nil, "got:", err)
+	}
+	if cache.Count() != 1 {
+		t.Error("expected:", 1, "got:", cache.Count())
+	}
+}
+
+func TestCache_RemovePrefixMetrics(t *testing.T) {
+	cache := NewCache()
+	images, bytes := testutil.ToFloat64(prom.CachedImages), testutil.ToFloat64(prom.CachedImageBytes)
+
+	for _, key := range []string{"aa", "aa/1", "ab/1"} {
+		if err := cache.Set(key, CacheEntry{Data: make([]byte, 10)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cache.RemovePrefix("aa")
+
+	if got := testutil.ToFloat64(prom.CachedImages) - images; got != 1 {
+		t.Error("expected:", 1, "got:", got)
+	}
+	if got := testutil.ToFloat64(prom.CachedImageBytes) - bytes; got != 10 {
+		t.Error("expected:", 10, "got:", got)
+	}
+}
+
+func TestCache_Range(t *testing.T) {
+	cache := NewCache()
+	for _, key := range []string{"a", "b", "c"} {
+		if err := cache.Set(key, CacheEntry{Url: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := make(map[string]bool)
+	cache.Range(func(key string, entry CacheEntry) bool {
+		seen[key] = entry.Url == key
+		return true
+	})
+	if len(seen) != 3 || !seen["a"] || !seen["b"] || !seen["c"] {
+		t.Error("expected:", "a b c", "got:", seen)
+	}
+
+	calls := 0
+	cache.Range(func(string, CacheEntry) bool {
+		calls++
+		return false
+	})
+	if calls != 1 {
+		t.Error("expected:", 1, "got:", calls)
+	}
+}
+
+func TestCache_SetReplaceMetrics(t *testing.T) {
+	cache := NewCache()
+	images, bytes := testutil.ToFloat64(prom.CachedImages), testutil.ToFloat64(prom.CachedImageBytes)
+
+	if err := cache.Set("a", CacheEntry{Data: make([]byte, 10)}); err != nil {
+		t.Fatal(err)
+	}
+	// replacing the entry must not count it twice
+	if err := cache.Set("a", CacheEntry{Data: make([]byte, 4)}); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(prom.CachedImages) - images; got != 1 {
+		t.Error("expected:", 1, "got:", got)
+	}
+	if got := testutil.ToFloat64(prom.CachedImageBytes) - bytes; got != 4 {
+		t.Error("expected:", 4, "got:", got)
+	}
+
+	if err := cache.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(prom.CachedImageBytes) - bytes; got != 0 {
+		t.Error("expected:", 0, "got:", got)
+	}
+}
+
+func TestCache_UpdateMetrics(t *testing.T) {
+	cache := NewCache()
+	bytes := testutil.ToFloat64(prom.CachedImageBytes)
+
+	if err := cache.Set("a", CacheEntry{Data: make([]byte, 10)}); err != nil {
+		t.Fatal(err)
+	}
+	err := cache.Update("a", func(entry *CacheEntry) {
+		entry.Data = make([]byte, 4)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(prom.CachedImageBytes) - bytes; got != 4 {
+		t.Error("expected:", 4, "got:", got)
+	}
+	if err := cache.Update("b", func(entry *CacheEntry) {}); err == nil {
+		t.Error("expected:", "error", "got:", nil)
+	}
+}
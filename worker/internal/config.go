@@ -3,8 +3,12 @@ package internal
 import (
 	"errors"
 	"log"
+	"net/url"
 	"os"
+	"runtime"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type AppConfig struct {
@@ -13,6 +17,49 @@ type AppConfig struct {
 	httpPort   string
 	knownHosts []string
 	name       string
+
+	originMaxConcurrent    int
+	originAcquireTimeout   time.Duration
+	originFailureThreshold int
+	originOpenTimeout      time.Duration
+
+	downloader DownloaderConfig
+
+	presetsFile string
+
+	keepICC bool
+	debug   bool
+
+	maxWidth      int
+	maxHeight     int
+	maxMegapixels int
+	maxFrames     int
+
+	watermark WatermarkConfig
+
+	processingConcurrency int
+	processingQueueDepth  int
+
+	rasterizeSvg bool
+
+	optimize        bool
+	optimizeQuality int
+}
+
+// WatermarkConfig describes the overlay composited onto variants, the image itself is loaded by the
+// imaging package
+type WatermarkConfig struct {
+	File     string
+	Position string
+	Margin   int
+	// Opacity is between 0 and 1
+	Opacity float64
+	// Scale is the width of the overlay relative to the width of the variant, 0 keeps its size
+	Scale float64
+	// MinSize is the length of the longer side from which on variants get the overlay
+	MinSize int
+	// Domains are origin hosts whose images always get the overlay
+	Domains []string
 }
 
 func ConfigFromEnv() (*AppConfig, error) {
@@ -45,9 +92,241 @@ func ConfigFromEnv() (*AppConfig, error) {
 		conf.name = conf.host
 	}
 
+	if conf.originMaxConcurrent, err = envInt("ORIGIN_MAX_CONCURRENT", 8); err != nil {
+		return nil, err
+	}
+	if conf.originAcquireTimeout, err = envDuration("ORIGIN_ACQUIRE_TIMEOUT", time.Second*5); err != nil {
+		return nil, err
+	}
+	if conf.originFailureThreshold, err = envInt("ORIGIN_FAILURE_THRESHOLD", 5); err != nil {
+		return nil, err
+	}
+	if conf.originOpenTimeout, err = envDuration("ORIGIN_OPEN_TIMEOUT", time.Second*30); err != nil {
+		return nil, err
+	}
+
+	if conf.downloader, err = downloaderConfigFromEnv(); err != nil {
+		return nil, err
+	}
+
+	conf.presetsFile = os.Getenv("PRESETS_FILE")
+
+	if conf.keepICC, err = envBool("KEEP_ICC_PROFILE", false); err != nil {
+		return nil, err
+	}
+	if conf.debug, err = envBool("DEBUG", false); err != nil {
+		return nil, err
+	}
+
+	if conf.maxWidth, err = envInt("MAX_WIDTH", 16384); err != nil {
+		return nil, err
+	}
+	if conf.maxHeight, err = envInt("MAX_HEIGHT", 16384); err != nil {
+		return nil, err
+	}
+	if conf.maxMegapixels, err = envInt("MAX_MEGAPIXELS", 50); err != nil {
+		return nil, err
+	}
+	if conf.maxFrames, err = envInt("MAX_ANIMATION_FRAMES", 100); err != nil {
+		return nil, err
+	}
+
+	if conf.watermark, err = watermarkConfigFromEnv(); err != nil {
+		return nil, err
+	}
+
+	if conf.processingConcurrency, err = envInt("PROCESSING_CONCURRENCY", runtime.NumCPU()); err != nil {
+		return nil, err
+	}
+	if conf.processingQueueDepth, err = envInt("PROCESSING_QUEUE_DEPTH", 64); err != nil {
+		return nil, err
+	}
+
+	if conf.rasterizeSvg, err = envBool("RASTERIZE_SVG", false); err != nil {
+		return nil, err
+	}
+
+	if conf.optimize, err = envBool("OPTIMIZE", false); err != nil {
+		return nil, err
+	}
+	if conf.optimizeQuality, err = envInt("OPTIMIZE_JPEG_QUALITY", 80); err != nil {
+		return nil, err
+	}
+	if conf.optimizeQuality > 100 {
+		return nil, errors.New("env OPTIMIZE_JPEG_QUALITY is not between 1 and 100")
+	}
+
 	return conf, nil
 }
 
+func downloaderConfigFromEnv() (DownloaderConfig, error) {
+	dc := DownloaderConfig{
+		UserAgent: os.Getenv("DOWNLOAD_USER_AGENT"),
+	}
+	if dc.UserAgent == "" {
+		dc.UserAgent = "img-proxy-worker/1.0"
+	}
+
+	if proxy := os.Getenv("DOWNLOAD_PROXY"); proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil || u.Host == "" {
+			return dc, errors.New("env DOWNLOAD_PROXY is not a valid url")
+		}
+		dc.Proxy = u
+	}
+
+	dc.Policy = &HostPolicy{
+		Allowed: envList("ALLOWED_HOSTS"),
+		Denied:  envList("DENIED_HOSTS"),
+	}
+	var err error
+	if dc.Policy.DenyPrivate, err = envBool("DENY_PRIVATE_NETWORKS", true); err != nil {
+		return dc, err
+	}
+	if dc.AllowSchemeDowngrade, err = envBool("REDIRECT_ALLOW_DOWNGRADE", false); err != nil {
+		return dc, err
+	}
+
+	durations := []struct {
+		key string
+		def time.Duration
+		dst *time.Duration
+	}{
+		{"DOWNLOAD_TIMEOUT", time.Second * 10, &dc.Timeout},
+		{"DOWNLOAD_DIAL_TIMEOUT", time.Second * 5, &dc.DialTimeout},
+		{"DOWNLOAD_KEEPALIVE", time.Second * 30, &dc.KeepAlive},
+		{"DOWNLOAD_TLS_HANDSHAKE_TIMEOUT", time.Second * 5, &dc.TLSHandshakeTimeout},
+		{"DOWNLOAD_RESPONSE_HEADER_TIMEOUT", time.Second * 5, &dc.ResponseHeaderTimeout},
+		{"DOWNLOAD_IDLE_CONN_TIMEOUT", time.Second * 90, &dc.IdleConnTimeout},
+	}
+	for _, d := range durations {
+		if *d.dst, err = envDuration(d.key, d.def); err != nil {
+			return dc, err
+		}
+	}
+
+	ints := []struct {
+		key string
+		def int
+		dst *int
+	}{
+		{"DOWNLOAD_MAX_IDLE_CONNS", 100, &dc.MaxIdleConns},
+		{"DOWNLOAD_MAX_IDLE_CONNS_PER_HOST", 8, &dc.MaxIdleConnsPerHost},
+		{"DOWNLOAD_TLS_SESSION_CACHE_SIZE", 256, &dc.TLSSessionCacheSize},
+		{"REDIRECT_MAX_HOPS", 5, &dc.MaxRedirects},
+	}
+	for _, i := range ints {
+		if *i.dst, err = envInt(i.key, i.def); err != nil {
+			return dc, err
+		}
+	}
+
+	return dc, nil
+}
+
+func watermarkConfigFromEnv() (WatermarkConfig, error) {
+	wc := WatermarkConfig{
+		File:     os.Getenv("WATERMARK_FILE"),
+		Position: os.Getenv("WATERMARK_POSITION"),
+		Domains:  envList("WATERMARK_DOMAINS"),
+	}
+	if wc.Position == "" {
+		wc.Position = "southeast"
+	}
+
+	var err error
+	if wc.Margin, err = envNonNegativeInt("WATERMARK_MARGIN", 16); err != nil {
+		return wc, err
+	}
+	if wc.MinSize, err = envNonNegativeInt("WATERMARK_MIN_SIZE", 0); err != nil {
+		return wc, err
+	}
+	if wc.Opacity, err = envFloat("WATERMARK_OPACITY", 0.5); err != nil {
+		return wc, err
+	}
+	if wc.Scale, err = envFloat("WATERMARK_SCALE", 0.25); err != nil {
+		return wc, err
+	}
+
+	return wc, nil
+}
+
+// envInt reads a positive integer from the environment, falling back to def if the variable is not set
+func envInt(key string, def int) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil || i <= 0 {
+		return 0, errors.New("env " + key + " is not a positive number")
+	}
+	return i, nil
+}
+
+// envNonNegativeInt reads a number which may be 0 from the environment, falling back to def if the variable is not set
+func envNonNegativeInt(key string, def int) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil || i < 0 {
+		return 0, errors.New("env " + key + " is not a non-negative number")
+	}
+	return i, nil
+}
+
+// envFloat reads a number between 0 and 1 from the environment, falling back to def if the variable is not set
+func envFloat(key string, def float64) (float64, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 || f > 1 {
+		return 0, errors.New("env " + key + " is not a number between 0 and 1")
+	}
+	return f, nil
+}
+
+// envBool reads a boolean like "true" or "0" from the environment, falling back to def if the variable is not set
+func envBool(key string, def bool) (bool, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, errors.New("env " + key + " is not a boolean")
+	}
+	return b, nil
+}
+
+// envList reads a comma separated list from the environment, empty entries are dropped
+func envList(key string) []string {
+	var list []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// envDuration reads a duration like "5s" from the environment, falling back to def if the variable is not set
+func envDuration(key string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, errors.New("env " + key + " is not a valid duration")
+	}
+	return d, nil
+}
+
 func (c *AppConfig) Secret() []byte {
 	return c.secret
 }
@@ -67,3 +346,75 @@ func (c *AppConfig) KnownHosts() []string {
 func (c *AppConfig) Name() string {
 	return c.name
 }
+
+func (c *AppConfig) OriginMaxConcurrent() int {
+	return c.originMaxConcurrent
+}
+
+func (c *AppConfig) OriginAcquireTimeout() time.Duration {
+	return c.originAcquireTimeout
+}
+
+func (c *AppConfig) OriginFailureThreshold() int {
+	return c.originFailureThreshold
+}
+
+func (c *AppConfig) OriginOpenTimeout() time.Duration {
+	return c.originOpenTimeout
+}
+
+func (c *AppConfig) Downloader() DownloaderConfig {
+	return c.downloader
+}
+
+func (c *AppConfig) PresetsFile() string {
+	return c.presetsFile
+}
+
+func (c *AppConfig) KeepICC() bool {
+	return c.keepICC
+}
+
+func (c *AppConfig) Debug() bool {
+	return c.debug
+}
+
+func (c *AppConfig) MaxWidth() int {
+	return c.maxWidth
+}
+
+func (c *AppConfig) MaxHeight() int {
+	return c.maxHeight
+}
+
+func (c *AppConfig) MaxMegapixels() int {
+	return c.maxMegapixels
+}
+
+func (c *AppConfig) MaxFrames() int {
+	return c.maxFrames
+}
+
+func (c *AppConfig) Watermark() WatermarkConfig {
+	return c.watermark
+}
+
+func (c *AppConfig) ProcessingConcurrency() int {
+	return c.processingConcurrency
+}
+
+func (c *AppConfig) ProcessingQueueDepth() int {
+	return c.processingQueueDepth
+}
+
+func (c *AppConfig) RasterizeSvg() bool {
+	return c.rasterizeSvg
+}
+
+func (c *AppConfig) Optimize() bool {
+	return c.optimize
+}
+
+func (c *AppConfig) OptimizeQuality() int {
+	return c.optimizeQuality
+}
@@ -34,6 +34,24 @@ func TestConfigFromEnv(t *testing.T) {
 	}
 }
 
+func TestWatermarkConfigFromEnv_Zero(t *testing.T) {
+	t.Setenv("WATERMARK_MARGIN", "0")
+	t.Setenv("WATERMARK_MIN_SIZE", "0")
+
+	wc, err := watermarkConfigFromEnv()
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if wc.Margin != 0 || wc.MinSize != 0 {
+		t.Error("expected:", "0 0", "got:", wc.Margin, wc.MinSize)
+	}
+
+	t.Setenv("WATERMARK_MARGIN", "-1")
+	if _, err := watermarkConfigFromEnv(); err == nil {
+		t.Error("expected:", "error for a negative margin", "got:", nil)
+	}
+}
+
 func TestConfig_Hosts(t *testing.T) {
 	conf := &AppConfig{knownHosts: []string{"host1", "host2", "host3"}}
 	expectedHostsStr := strings.Join(conf.KnownHosts(), ",")
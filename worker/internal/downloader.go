@@ -1,44 +1,244 @@
 package internal
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"github.com/phips4/img-proxy/worker/internal/prom"
+	"golang.org/x/net/http/httpproxy"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"sync"
 	"time"
 )
 
 var ErrFileNotFound = errors.New("file not found")
 
-type DownloaderFunc func(input string) ([]byte, error)
+// Validators are the origin response headers of a cached image which are sent with conditional requests
+type Validators struct {
+	ETag         string
+	LastModified string
+}
+
+// Download is the result of a request to an origin. If the request was conditional and the image
+// did not change, NotModified is set and Data is empty. FinalUrl is the location the image was
+// served from after following redirects.
+type Download struct {
+	Data         []byte
+	FinalUrl     string
+	ETag         string
+	LastModified string
+	CacheControl string
+	ContentType  string
+	NotModified  bool
+}
+
+type Downloader interface {
+	// Download fetches url from its origin. Empty validators result in an unconditional request.
+	Download(url string, validators Validators) (*Download, error)
+}
+
+// DownloaderFunc allows the use of ordinary functions as Downloader
+type DownloaderFunc func(url string, validators Validators) (*Download, error)
+
+func (f DownloaderFunc) Download(url string, validators Validators) (*Download, error) {
+	return f(url, validators)
+}
+
+type DownloaderConfig struct {
+	Timeout               time.Duration
+	DialTimeout           time.Duration
+	KeepAlive             time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleConnTimeout       time.Duration
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	TLSSessionCacheSize   int
+	UserAgent             string
+	// Proxy is used for all outgoing requests if set, otherwise the proxy of the HTTPS_PROXY,
+	// HTTP_PROXY and NO_PROXY environment variables. Private addresses of proxied requests can only be
+	// rejected by host name, the proxy resolves them.
+	Proxy *url.URL
+	// Policy is checked for the requested url and again for every redirect
+	Policy               *HostPolicy
+	MaxRedirects         int
+	AllowSchemeDowngrade bool
+}
 
-func DownloadImg(url string) ([]byte, error) {
-	client := &http.Client{
-		Timeout: time.Second * 10,
+// HttpDownloader downloads images from origins over a shared http.Client, so connections and
+// TLS sessions are reused between downloads.
+type HttpDownloader struct {
+	client               *http.Client
+	userAgent            string
+	policy               *HostPolicy
+	maxRedirects         int
+	allowSchemeDowngrade bool
+}
+
+func NewHttpDownloader(conf DownloaderConfig) *HttpDownloader {
+	policy := conf.Policy
+	if policy == nil {
+		policy = &HostPolicy{}
 	}
 
-	resp, err := client.Get(url)
+	// proxies are dialed without the policy, they resolve the origin themselves and are usually in a
+	// private network. Everything else, like NO_PROXY hosts, is dialed and checked directly.
+	direct := &net.Dialer{
+		Timeout:   conf.DialTimeout,
+		KeepAlive: conf.KeepAlive,
+	}
+	checked := &net.Dialer{
+		Timeout:   conf.DialTimeout,
+		KeepAlive: conf.KeepAlive,
+		Control:   policy.dialControl,
+	}
+	envProxy := httpproxy.FromEnvironment().ProxyFunc()
+	proxy := func(req *http.Request) (*url.URL, error) {
+		return envProxy(req.URL)
+	}
+	if conf.Proxy != nil {
+		proxy = http.ProxyURL(conf.Proxy)
+	}
+	var proxies sync.Map
+	proxyFunc := func(req *http.Request) (*url.URL, error) {
+		u, err := proxy(req)
+		if u != nil {
+			proxies.Store(proxyAddr(u), true)
+		}
+		return u, err
+	}
+	dialContext := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if _, ok := proxies.Load(addr); ok {
+			return direct.DialContext(ctx, network, addr)
+		}
+		return checked.DialContext(ctx, network, addr)
+	}
+
+	transport := &http.Transport{
+		Proxy:                 proxyFunc,
+		DialContext:           dialContext,
+		ForceAttemptHTTP2:     true,
+		TLSClientConfig:       &tls.Config{ClientSessionCache: tls.NewLRUClientSessionCache(conf.TLSSessionCacheSize)},
+		TLSHandshakeTimeout:   conf.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: conf.ResponseHeaderTimeout,
+		IdleConnTimeout:       conf.IdleConnTimeout,
+		MaxIdleConns:          conf.MaxIdleConns,
+		MaxIdleConnsPerHost:   conf.MaxIdleConnsPerHost,
+	}
+
+	d := &HttpDownloader{
+		userAgent:            conf.UserAgent,
+		policy:               policy,
+		maxRedirects:         conf.MaxRedirects,
+		allowSchemeDowngrade: conf.AllowSchemeDowngrade,
+	}
+	d.client = &http.Client{
+		Transport:     transport,
+		Timeout:       conf.Timeout,
+		CheckRedirect: d.checkRedirect,
+	}
+
+	return d
+}
+
+// proxyAddr returns the address the transport dials to reach the proxy u
+func proxyAddr(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return net.JoinHostPort(u.Hostname(), port)
+	}
+	port := "80"
+	switch u.Scheme {
+	case "https":
+		port = "443"
+	case "socks5":
+		port = "1080"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// checkRedirect applies the redirect policy to every hop before it is followed
+func (d *HttpDownloader) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > d.maxRedirects {
+		return fmt.Errorf("%w: more than %d redirects", ErrRedirect, d.maxRedirects)
+	}
+
+	prev := via[len(via)-1].URL
+	if !d.allowSchemeDowngrade && prev.Scheme == "https" && req.URL.Scheme != "https" {
+		return fmt.Errorf("%w: downgrade from %s to %s", ErrRedirect, prev, req.URL)
+	}
+
+	if err := d.policy.Check(req.URL); err != nil {
+		return err
+	}
+
+	log.Println("HttpDownloader following redirect from", prev, "to", req.URL)
+	return nil
+}
+
+func (d *HttpDownloader) Download(url string, validators Validators) (*Download, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.policy.Check(req.URL); err != nil {
+		return nil, err
+	}
+	if d.userAgent != "" {
+		req.Header.Set("User-Agent", d.userAgent)
+	}
+	if validators.ETag != "" {
+		req.Header.Set("If-None-Match", validators.ETag)
+	}
+	if validators.LastModified != "" {
+		req.Header.Set("If-Modified-Since", validators.LastModified)
+	}
+	conditional := validators.ETag != "" || validators.LastModified != ""
+
+	resp, err := d.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer func(body io.ReadCloser) {
+		// drain the body so the connection can be reused
+		_, _ = io.Copy(io.Discard, body)
 		err := body.Close()
 		if err != nil {
 			log.Println("couldnt close download body: " + err.Error())
 		}
 	}(resp.Body)
 
+	dl := &Download{
+		FinalUrl:     resp.Request.URL.String(),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		CacheControl: resp.Header.Get("Cache-Control"),
+		ContentType:  resp.Header.Get("Content-Type"),
+	}
+
+	if conditional && resp.StatusCode == http.StatusNotModified {
+		prom.Revalidations.WithLabelValues("not_modified").Inc()
+		dl.NotModified = true
+		return dl, nil
+	}
 	if resp.StatusCode == http.StatusNotFound {
 		return nil, ErrFileNotFound
 	}
 	if resp.StatusCode != http.StatusOK {
 		return nil, errors.New("HTTP request failed with status: " + resp.Status)
 	}
+	if conditional {
+		prom.Revalidations.WithLabelValues("modified").Inc()
+	}
 
-	imageBytes, err := io.ReadAll(resp.Body)
+	dl.Data, err = io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
 
-	return imageBytes, nil
+	return dl, nil
 }
@@ -0,0 +1,193 @@
+package internal
+
+import (
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testDownloaderConfig() DownloaderConfig {
+	return DownloaderConfig{
+		Timeout:             time.Second,
+		DialTimeout:         time.Second,
+		MaxIdleConns:        1,
+		MaxIdleConnsPerHost: 1,
+		TLSSessionCacheSize: 1,
+		UserAgent:           "img-proxy-test",
+	}
+}
+
+func TestHttpDownloader_Download(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.png" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(r.UserAgent()))
+	}))
+	defer srv.Close()
+
+	dl := NewHttpDownloader(testDownloaderConfig())
+
+	res, err := dl.Download(srv.URL+"/image.png", Validators{})
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if string(res.Data) != "img-proxy-test" {
+		t.Error("expected:", "img-proxy-test", "got:", string(res.Data))
+	}
+
+	if _, err := dl.Download(srv.URL+"/missing.png", Validators{}); !errors.Is(err, ErrFileNotFound) {
+		t.Error("expected:", ErrFileNotFound, "got:", err)
+	}
+}
+
+func TestHttpDownloader_Revalidate(t *testing.T) {
+	const etag = `"v1"`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = w.Write([]byte("image"))
+	}))
+	defer srv.Close()
+
+	dl := NewHttpDownloader(testDownloaderConfig())
+
+	res, err := dl.Download(srv.URL, Validators{})
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if res.ETag != etag || res.CacheControl != "max-age=60" || res.NotModified {
+		t.Error("expected:", etag, "max-age=60", "got:", res.ETag, res.CacheControl, res.NotModified)
+	}
+
+	res, err = dl.Download(srv.URL, Validators{ETag: etag})
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if !res.NotModified || len(res.Data) != 0 {
+		t.Error("expected:", "not modified", "got:", res.NotModified, len(res.Data))
+	}
+
+	res, err = dl.Download(srv.URL, Validators{ETag: `"v0"`})
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if res.NotModified || string(res.Data) != "image" {
+		t.Error("expected:", "image", "got:", res.NotModified, string(res.Data))
+	}
+}
+
+func TestHttpDownloader_Redirects(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hop":
+			http.Redirect(w, r, "/image.png", http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		case "/denied":
+			http.Redirect(w, r, "https://denied.example.com/image.png", http.StatusFound)
+		default:
+			_, _ = w.Write([]byte("image"))
+		}
+	}))
+	defer srv.Close()
+	srvUrl := srv.URL
+
+	conf := testDownloaderConfig()
+	conf.MaxRedirects = 3
+	conf.Policy = &HostPolicy{Denied: []string{"denied.example.com"}}
+	dl := NewHttpDownloader(conf)
+
+	res, err := dl.Download(srvUrl+"/hop", Validators{})
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if res.FinalUrl != srvUrl+"/image.png" {
+		t.Error("expected:", srvUrl+"/image.png", "got:", res.FinalUrl)
+	}
+
+	if _, err := dl.Download(srvUrl+"/loop", Validators{}); !errors.Is(err, ErrRedirect) {
+		t.Error("expected:", ErrRedirect, "got:", err)
+	}
+
+	if _, err := dl.Download(srvUrl+"/denied", Validators{}); !errors.Is(err, ErrForbiddenHost) {
+		t.Error("expected:", ErrForbiddenHost, "got:", err)
+	}
+}
+
+func TestHttpDownloader_DenyPrivate(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("image"))
+	}))
+	defer srv.Close()
+
+	conf := testDownloaderConfig()
+	conf.Policy = &HostPolicy{DenyPrivate: true}
+	dl := NewHttpDownloader(conf)
+
+	if _, err := dl.Download(srv.URL, Validators{}); !errors.Is(err, ErrForbiddenHost) {
+		t.Error("expected:", ErrForbiddenHost, "got:", err)
+	}
+}
+
+func TestHttpDownloader_DenyPrivateWithProxy(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("image"))
+	}))
+	defer srv.Close()
+
+	// loopback hosts are never proxied, so they are dialed directly and must still be checked
+	t.Setenv("HTTP_PROXY", "http://proxy.invalid:3128")
+	conf := testDownloaderConfig()
+	conf.Policy = &HostPolicy{DenyPrivate: true}
+	dl := NewHttpDownloader(conf)
+
+	target := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+	if _, err := dl.Download(target, Validators{}); !errors.Is(err, ErrForbiddenHost) {
+		t.Error("expected:", ErrForbiddenHost, "got:", err)
+	}
+}
+
+func TestHttpDownloader_SchemeDowngrade(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("image"))
+	}))
+	defer plain.Close()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, plain.URL+"/image.png", http.StatusFound)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name  string
+		allow bool
+		want  error
+	}{
+		{name: "rejected", allow: false, want: ErrRedirect},
+		{name: "allowed", allow: true, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := testDownloaderConfig()
+			conf.MaxRedirects = 3
+			conf.AllowSchemeDowngrade = tt.allow
+			dl := NewHttpDownloader(conf)
+			roots := x509.NewCertPool()
+			roots.AddCert(srv.Certificate())
+			dl.client.Transport.(*http.Transport).TLSClientConfig.RootCAs = roots
+
+			if _, err := dl.Download(srv.URL+"/image.png", Validators{}); !errors.Is(err, tt.want) {
+				t.Errorf("Download() got = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"mime"
+)
+
+type ImageFormat string
+
+const (
+	FormatJpeg ImageFormat = "jpeg"
+	FormatPng  ImageFormat = "png"
+	FormatGif  ImageFormat = "gif"
+	FormatWebp ImageFormat = "webp"
+	FormatBmp  ImageFormat = "bmp"
+	FormatTiff ImageFormat = "tiff"
+	FormatSvg  ImageFormat = "svg"
+)
+
+var formatSignatures = []struct {
+	format ImageFormat
+	magic  string
+}{
+	{FormatJpeg, "\xff\xd8\xff"},
+	{FormatPng, "\x89PNG\r\n\x1a\n"},
+	{FormatGif, "GIF87a"},
+	{FormatGif, "GIF89a"},
+	{FormatWebp, "RIFF????WEBP"},
+	{FormatBmp, "BM????\x00\x00\x00\x00"},
+	{FormatTiff, "II*\x00"},
+	{FormatTiff, "MM\x00*"},
+}
+
+// svgSniffLen is how far into a document the svg root element is searched for
+const svgSniffLen = 1024
+
+// ContentType returns the media type images of this format are served with
+func (f ImageFormat) ContentType() string {
+	if f == FormatSvg {
+		return "image/svg+xml"
+	}
+	return "image/" + string(f)
+}
+
+// UnsupportedMediaError is returned for downloads which are not an image in one of the supported formats
+type UnsupportedMediaError struct {
+	Reason string
+}
+
+func (e *UnsupportedMediaError) Error() string {
+	return "unsupported media: " + e.Reason
+}
+
+// DetectFormat sniffs the image format from the magic bytes at the start of data. SVG has no magic
+// bytes, it is recognized by an svg element within the first bytes of an xml document.
+func DetectFormat(data []byte) (ImageFormat, bool) {
+	for _, sig := range formatSignatures {
+		if matchMagic(data, sig.magic) {
+			return sig.format, true
+		}
+	}
+	if isSvg(data) {
+		return FormatSvg, true
+	}
+	return "", false
+}
+
+// matchMagic reports whether data starts with magic, a "?" in magic matches any byte
+func matchMagic(data []byte, magic string) bool {
+	if len(data) < len(magic) {
+		return false
+	}
+	for i := 0; i < len(magic); i++ {
+		if magic[i] != '?' && magic[i] != data[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func isSvg(data []byte) bool {
+	head := data
+	if len(head) > svgSniffLen {
+		head = head[:svgSniffLen]
+	}
+	head = bytes.TrimPrefix(head, []byte("\xef\xbb\xbf"))
+	if !bytes.HasPrefix(bytes.TrimSpace(head), []byte("<")) {
+		return false
+	}
+	return bytes.Contains(head, []byte("<svg"))
+}
+
+// svgRoot makes sure data is an xml document whose root element is svg
+func svgRoot(data []byte) error {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			return errors.New("no root element")
+		}
+		if err != nil {
+			return err
+		}
+		if se, ok := tok.(xml.StartElement); ok {
+			if se.Name.Local != "svg" {
+				return errors.New("root element is " + se.Name.Local)
+			}
+			return nil
+		}
+	}
+}
+
+// ValidateImage makes sure data is an image in a supported format before it gets cached. The image
+// header is decoded to confirm the dimensions and the Content-Type the origin sent must not
+// contradict the sniffed format. An empty or generic Content-Type is accepted.
+func ValidateImage(data []byte, contentType string) (ImageFormat, error) {
+	format, ok := DetectFormat(data)
+	if !ok {
+		return "", &UnsupportedMediaError{Reason: "unknown image format"}
+	}
+
+	if contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return "", &UnsupportedMediaError{Reason: "invalid content type " + contentType}
+		}
+		if mediaType != "application/octet-stream" && mediaType != "binary/octet-stream" &&
+			!contentTypeMatches(format, mediaType) {
+			return "", &UnsupportedMediaError{Reason: "content type " + mediaType + " does not match " + string(format)}
+		}
+	}
+
+	// svg is rasterized by the worker, there is no header with dimensions to check
+	if format == FormatSvg {
+		if err := svgRoot(data); err != nil {
+			return "", &UnsupportedMediaError{Reason: "broken svg: " + err.Error()}
+		}
+		return format, nil
+	}
+
+	conf, decoded, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", &UnsupportedMediaError{Reason: "broken " + string(format) + " header: " + err.Error()}
+	}
+	if decoded != string(format) {
+		return "", &UnsupportedMediaError{Reason: "decoded " + decoded + " but sniffed " + string(format)}
+	}
+	if conf.Width <= 0 || conf.Height <= 0 {
+		return "", &UnsupportedMediaError{Reason: "image has no dimensions"}
+	}
+
+	return format, nil
+}
+
+func contentTypeMatches(format ImageFormat, mediaType string) bool {
+	if mediaType == format.ContentType() {
+		return true
+	}
+	// non-standard aliases some origins still send
+	return format == FormatJpeg && (mediaType == "image/jpg" || mediaType == "image/pjpeg") ||
+		format == FormatPng && mediaType == "image/x-png" ||
+		format == FormatBmp && (mediaType == "image/x-bmp" || mediaType == "image/x-ms-bmp") ||
+		format == FormatSvg && (mediaType == "text/xml" || mediaType == "application/xml")
+}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testPng(t *testing.T, w, h int) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testJpeg(t *testing.T, w, h int) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, w, h)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testGif(t *testing.T, w, h int) []byte {
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, image.NewRGBA(image.Rect(0, 0, w, h)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testdata reads a fixture shared by the tests of the worker packages, like a lossless 1x1 webp which
+// no pure Go encoder can create
+func testdata(t *testing.T, name string) []byte {
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func testBmp(t *testing.T, w, h int) []byte {
+	var buf bytes.Buffer
+	if err := bmp.Encode(&buf, image.NewRGBA(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testTiff(t *testing.T, w, h int) []byte {
+	var buf bytes.Buffer
+	if err := tiff.Encode(&buf, image.NewRGBA(image.Rect(0, 0, w, h)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestValidateImage(t *testing.T) {
+	pngBytes := testPng(t, 4, 2)
+	jpegBytes := testJpeg(t, 4, 2)
+	gifBytes := testGif(t, 4, 2)
+
+	tests := []struct {
+		name        string
+		data        []byte
+		contentType string
+		want        ImageFormat
+		wantErr     bool
+	}{
+		{name: "png", data: pngBytes, contentType: "image/png", want: FormatPng},
+		{name: "jpeg without content type", data: jpegBytes, want: FormatJpeg},
+		{name: "jpeg with alias", data: jpegBytes, contentType: "image/jpg", want: FormatJpeg},
+		{name: "gif", data: gifBytes, contentType: "image/gif", want: FormatGif},
+		{name: "webp", data: testdata(t, "pixel.webp"), contentType: "image/webp", want: FormatWebp},
+		{name: "bmp with alias", data: testBmp(t, 4, 2), contentType: "image/x-ms-bmp", want: FormatBmp},
+		{name: "tiff", data: testTiff(t, 4, 2), contentType: "image/tiff", want: FormatTiff},
+		{name: "svg", data: testdata(t, "rect.svg"), contentType: "image/svg+xml", want: FormatSvg},
+		{name: "svg as xml", data: testdata(t, "rect.svg"), contentType: "text/xml", want: FormatSvg},
+		{name: "html with inline svg", data: []byte("<html><svg></svg></html>"), wantErr: true},
+		{name: "octet stream", data: pngBytes, contentType: "application/octet-stream", want: FormatPng},
+		{name: "html error page", data: []byte("<html>503</html>"), contentType: "text/html", wantErr: true},
+		{name: "mismatched content type", data: pngBytes, contentType: "image/jpeg", wantErr: true},
+		{name: "html content type", data: pngBytes, contentType: "text/html; charset=utf-8", wantErr: true},
+		{name: "truncated header", data: pngBytes[:12], contentType: "image/png", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ValidateImage(tt.data, tt.contentType)
+			var mediaErr *UnsupportedMediaError
+			if tt.wantErr != errors.As(err, &mediaErr) {
+				t.Errorf("ValidateImage() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("ValidateImage() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
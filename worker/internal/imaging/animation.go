@@ -0,0 +1,335 @@
+package imaging
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/phips4/img-proxy/worker/internal"
+	"golang.org/x/image/draw"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"math"
+)
+
+// Anim decides what happens to the frames of animated images
+type Anim string
+
+const (
+	// AnimAll transforms every frame and keeps the timing
+	AnimAll Anim = "all"
+	// AnimFirst turns the animation into a still of its first frame
+	AnimFirst Anim = "first"
+	// AnimPoster turns the animation into a jpeg or png still of the frame picked by Frame or Time
+	AnimPoster Anim = "poster"
+)
+
+const (
+	// MaxPosterTime is the latest timestamp in seconds a poster frame can be picked at
+	MaxPosterTime = 3600
+	// MinBudget and MaxBudget bound the byte budget of animated gif variants
+	MinBudget = 1024
+	MaxBudget = 64 << 20
+	// maxBudgetSteps is how often a gif is reduced at most to fit into its byte budget
+	maxBudgetSteps = 16
+	// minBudgetSide is the length below which the longer side of a gif is not reduced any further
+	minBudgetSide = 16
+	// budgetScale is the factor the sides of a gif are scaled with in every reduction step
+	budgetScale = 0.75
+)
+
+// processGif transforms a gif. Animations are only kept if the variant is a gif again, every frame
+// is composed onto the full canvas, transformed and quantized back to the palette of the frame, or
+// to a new one if filters or a watermark changed its colors. A poster is a still of a single frame,
+// composed onto what the frames before it left on the canvas.
+func (p *Processor) processGif(data []byte, outFormat internal.ImageFormat, o Options) ([]byte, error) {
+	conf, err := gif.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decoding gif header: %w", err)
+	}
+
+	region, err := cropRegion(turnedBounds(image.Rect(0, 0, conf.Width, conf.Height), o), o)
+	if err != nil {
+		return nil, err
+	}
+	// every frame is held at the size of the canvas and again at the size it is scaled to
+	w, h := targetSize(region, o)
+	framePixels := maxInt(conf.Width*conf.Height, w*h)
+
+	maxFrames := 1
+	switch {
+	case o.Anim == AnimPoster && o.Time > 0:
+		maxFrames = p.frameBudget(framePixels)
+	case o.Anim == AnimPoster:
+		maxFrames = minInt(o.Frame+1, p.frameBudget(framePixels))
+	case outFormat == internal.FormatGif && o.Anim != AnimFirst:
+		maxFrames = p.frameBudget(framePixels)
+	}
+	_, _, cut, err := scanGif(data, maxFrames)
+	if err != nil {
+		return nil, fmt.Errorf("reading gif: %w", err)
+	}
+	// cutting the data behind the last wanted frame keeps the decoder from even decompressing the rest
+	truncated := append(data[:cut:cut], 0x3b)
+	g, err := gif.DecodeAll(bytes.NewReader(truncated))
+	if err != nil {
+		return nil, fmt.Errorf("decoding gif: %w", err)
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, conf.Width, conf.Height))
+
+	if maxFrames == 1 || o.Anim == AnimPoster {
+		// the frames before the poster build up the canvas it is drawn onto
+		poster := posterFrame(g, o)
+		for i := 0; i < poster; i++ {
+			disposeFrame(canvas, g, i, composeFrame(canvas, g, i))
+		}
+		composeFrame(canvas, g, poster)
+		resized, err := resize(turn(canvas, o), region, o, p.conf.Limits)
+		if err != nil {
+			return nil, err
+		}
+		return p.encode(p.watermark(adjust(resized, o), o), outFormat, o.Quality)
+	}
+
+	out := &gif.GIF{LoopCount: g.LoopCount}
+	for i := range g.Image {
+		previous := composeFrame(canvas, g, i)
+		turned := turn(canvas, o)
+		if i == 0 && o.Fit == FitCover && o.Width > 0 && o.Height > 0 {
+			// the smart gravities would pick a different region for every frame and make it jitter,
+			// so the region of the first frame is used for all of them
+			region = coverCrop(turned, region, o.Width, o.Height, o)
+			o.Gravity = ""
+		}
+
+		resized, err := resize(turned, region, o, p.conf.Limits)
+		if err != nil {
+			return nil, err
+		}
+		frame := p.watermark(adjust(resized, o), o)
+		paletted := p.quantizeFrame(frame, g.Image[i].Palette, o)
+
+		out.Image = append(out.Image, paletted)
+		out.Delay = append(out.Delay, g.Delay[i])
+		// every output frame covers the whole canvas, so it can simply replace the previous one
+		out.Disposal = append(out.Disposal, gif.DisposalBackground)
+
+		disposeFrame(canvas, g, i, previous)
+	}
+
+	if o.Budget > 0 {
+		return fitBudget(out, o.Budget)
+	}
+	return encodeGif(out)
+}
+
+// quantizeFrame converts a transformed frame back to a paletted image. Scaling only blends the colors
+// of the frame, so they are mapped back to its own palette. Filters and watermarks add colors the
+// palette does not have, so those frames are dithered to the same palette encode uses for gifs, with
+// the last entry kept for transparent pixels.
+func (p *Processor) quantizeFrame(frame image.Image, pal color.Palette, o Options) *image.Paletted {
+	var drawer draw.Drawer = draw.Src
+	if o.Blur > 0 || o.Sharpen > 0 || o.Grayscale || o.Brightness != 0 || o.Contrast != 0 ||
+		(o.Watermark && p.conf.Watermark != nil) {
+		pal = append(palette.Plan9[:255:255], color.Transparent)
+		drawer = draw.FloydSteinberg
+	}
+	paletted := image.NewPaletted(frame.Bounds(), pal)
+	drawer.Draw(paletted, paletted.Bounds(), frame, frame.Bounds().Min)
+	return paletted
+}
+
+func encodeGif(g *gif.GIF) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// posterFrame returns the index of the frame o picks as poster, the last one if the animation is
+// shorter. Without a poster it is the first frame.
+func posterFrame(g *gif.GIF, o Options) int {
+	last := len(g.Image) - 1
+	if o.Anim != AnimPoster {
+		return 0
+	}
+	if o.Time == 0 {
+		return minInt(o.Frame, last)
+	}
+
+	at := int(math.Round(o.Time * 100))
+	elapsed := 0
+	for i, delay := range g.Delay {
+		elapsed += delay
+		if elapsed > at {
+			return i
+		}
+	}
+	return last
+}
+
+// fitBudget encodes g and reduces it until it is no larger than budget bytes. The steps alternate
+// between halving the frame rate and scaling the frames down, so neither degrades alone. If the
+// gif cannot be reduced any further, ErrImageTooLarge is returned.
+func fitBudget(g *gif.GIF, budget int) ([]byte, error) {
+	out, err := encodeGif(g)
+	if err != nil {
+		return nil, err
+	}
+
+	for step := 0; len(out) > budget; step++ {
+		canDrop := len(g.Image) > 1
+		canShrink := maxInt(g.Image[0].Rect.Dx(), g.Image[0].Rect.Dy()) > minBudgetSide
+		switch {
+		case step >= maxBudgetSteps || (!canDrop && !canShrink):
+			return nil, fmt.Errorf("%w: gif of %d bytes does not fit into a budget of %d bytes", ErrImageTooLarge, len(out), budget)
+		case canDrop && (step%2 == 0 || !canShrink):
+			g = dropFrames(g)
+		default:
+			g = shrinkGif(g, budgetScale)
+		}
+
+		if out, err = encodeGif(g); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// dropFrames removes every second frame of g and adds its delay to the frame before, so the
+// animation keeps its duration. It relies on every frame covering the whole canvas.
+func dropFrames(g *gif.GIF) *gif.GIF {
+	out := &gif.GIF{LoopCount: g.LoopCount}
+	for i := range g.Image {
+		if i%2 == 1 {
+			out.Delay[len(out.Delay)-1] += g.Delay[i]
+			continue
+		}
+		out.Image = append(out.Image, g.Image[i])
+		out.Delay = append(out.Delay, g.Delay[i])
+		out.Disposal = append(out.Disposal, g.Disposal[i])
+	}
+	return out
+}
+
+// shrinkGif scales every frame of g by scale, each keeps its palette
+func shrinkGif(g *gif.GIF, scale float64) *gif.GIF {
+	b := g.Image[0].Rect
+	r := image.Rect(0, 0, maxInt(1, int(float64(b.Dx())*scale)), maxInt(1, int(float64(b.Dy())*scale)))
+
+	out := &gif.GIF{LoopCount: g.LoopCount, Delay: g.Delay, Disposal: g.Disposal}
+	for _, frame := range g.Image {
+		shrunk := image.NewPaletted(r, frame.Palette)
+		draw.ApproxBiLinear.Scale(shrunk, r, frame, frame.Rect, draw.Src, nil)
+		out.Image = append(out.Image, shrunk)
+	}
+	return out
+}
+
+// frameBudget returns how many frames of an animation are processed if every frame takes up pixels.
+// Besides the configured maximum the frames together must not exceed the pixel limit, which a single
+// image must respect.
+func (p *Processor) frameBudget(pixels int) int {
+	frames := p.conf.MaxFrames
+	if frames <= 0 {
+		frames = 1
+	}
+	if p.conf.Limits.MaxPixels > 0 && pixels > 0 {
+		if byPixels := p.conf.Limits.MaxPixels / pixels; byPixels < frames {
+			frames = maxInt(1, byPixels)
+		}
+	}
+	return frames
+}
+
+// composeFrame draws frame i onto the canvas. It returns a copy of the canvas from before if the
+// frame has to be disposed to the previous state.
+func composeFrame(canvas *image.RGBA, g *gif.GIF, i int) *image.RGBA {
+	var previous *image.RGBA
+	if g.Disposal[i] == gif.DisposalPrevious {
+		previous = image.NewRGBA(canvas.Bounds())
+		copy(previous.Pix, canvas.Pix)
+	}
+	frame := g.Image[i]
+	draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+	return previous
+}
+
+func disposeFrame(canvas *image.RGBA, g *gif.GIF, i int, previous *image.RGBA) {
+	switch g.Disposal[i] {
+	case gif.DisposalBackground:
+		draw.Draw(canvas, g.Image[i].Bounds(), image.Transparent, image.Point{}, draw.Src)
+	case gif.DisposalPrevious:
+		copy(canvas.Pix, previous.Pix)
+	}
+}
+
+// scanGif walks the blocks of a gif without decoding any pixels. It returns the number of frames,
+// whether a frame uses a transparent color and the offset right after frame maxFrames, which is the
+// start of the trailer if the gif has fewer frames. maxFrames 0 scans the whole gif.
+func scanGif(data []byte, maxFrames int) (frames int, transparent bool, cut int, err error) {
+	if len(data) < 13 || !bytes.HasPrefix(data, []byte("GIF8")) {
+		return 0, false, 0, errMalformed
+	}
+
+	i := 13 + colorTableSize(data[10])
+	for i < len(data) {
+		switch data[i] {
+		case 0x21: // extension
+			if i+2 > len(data) {
+				return 0, false, 0, errMalformed
+			}
+			// graphic control extension: size 4, flags, delay, transparent index
+			if data[i+1] == 0xf9 && i+4 <= len(data) && data[i+2] == 4 && data[i+3]&1 == 1 {
+				transparent = true
+			}
+			if i, err = skipSubBlocks(data, i+2); err != nil {
+				return 0, false, 0, err
+			}
+		case 0x2c: // image descriptor
+			if i+10 > len(data) {
+				return 0, false, 0, errMalformed
+			}
+			i += 10 + colorTableSize(data[i+9])
+			// skip the minimum LZW code size
+			if i, err = skipSubBlocks(data, i+1); err != nil {
+				return 0, false, 0, err
+			}
+			frames++
+			if frames == maxFrames {
+				return frames, transparent, i, nil
+			}
+		case 0x3b: // trailer
+			return frames, transparent, i, nil
+		default:
+			return 0, false, 0, errMalformed
+		}
+	}
+
+	return frames, transparent, len(data), nil
+}
+
+// colorTableSize returns the size of the color table announced by the flags of a descriptor
+func colorTableSize(flags byte) int {
+	if flags&0x80 == 0 {
+		return 0
+	}
+	return 3 << (flags&7 + 1)
+}
+
+// skipSubBlocks returns the offset after the data sub-blocks starting at i
+func skipSubBlocks(data []byte, i int) (int, error) {
+	for {
+		if i >= len(data) {
+			return 0, errMalformed
+		}
+		size := int(data[i])
+		i++
+		if size == 0 {
+			return i, nil
+		}
+		i += size
+	}
+}
@@ -0,0 +1,267 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/phips4/img-proxy/worker/internal"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"math/rand"
+	"testing"
+)
+
+// testAnimation returns a 40x20 gif with a full first frame and smaller frames moving a red square
+func testAnimation(t *testing.T, frames int) []byte {
+	palette := color.Palette{color.Transparent, color.White, color.RGBA{R: 255, A: 255}}
+	g := &gif.GIF{LoopCount: 0}
+	for i := 0; i < frames; i++ {
+		bounds := image.Rect(i*4, 0, i*4+4, 4)
+		if i == 0 {
+			bounds = image.Rect(0, 0, 40, 20)
+		}
+		frame := image.NewPaletted(bounds, palette)
+		for j := range frame.Pix {
+			frame.Pix[j] = 2
+		}
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 10+i)
+		g.Disposal = append(g.Disposal, gif.DisposalNone)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestProcess_Animation(t *testing.T) {
+	data := testAnimation(t, 5)
+
+	tests := []struct {
+		name       string
+		conf       ProcessorConfig
+		opts       Options
+		wantFrames int
+	}{
+		{name: "all frames", conf: ProcessorConfig{MaxFrames: 100}, opts: Options{Width: 20, Fit: FitContain}, wantFrames: 5},
+		{name: "capped frames", conf: ProcessorConfig{MaxFrames: 3}, opts: Options{Width: 20, Fit: FitContain}, wantFrames: 3},
+		{name: "capped by pixels", conf: ProcessorConfig{MaxFrames: 100, Limits: Limits{MaxPixels: 40 * 20 * 2}},
+			opts: Options{Width: 20, Fit: FitContain}, wantFrames: 2},
+		{name: "capped by upscaled pixels", conf: ProcessorConfig{MaxFrames: 100, Limits: Limits{MaxPixels: 400 * 200 * 2}},
+			opts: Options{Width: 400, Fit: FitContain}, wantFrames: 2},
+		{name: "first frame", conf: ProcessorConfig{MaxFrames: 100}, opts: Options{Width: 20, Fit: FitContain, Anim: AnimFirst}, wantFrames: 1},
+		{name: "cover", conf: ProcessorConfig{MaxFrames: 100}, opts: Options{Width: 10, Height: 10, Fit: FitCover, Gravity: GravityEntropy}, wantFrames: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, format, err := NewProcessor(tt.conf).Process(context.Background(), data, internal.FormatGif, tt.opts)
+			if err != nil {
+				t.Fatal("expected:", nil, "got:", err)
+			}
+			if format != internal.FormatGif {
+				t.Error("expected:", internal.FormatGif, "got:", format)
+			}
+
+			g, err := gif.DecodeAll(bytes.NewReader(out))
+			if err != nil {
+				t.Fatal("expected:", nil, "got:", err)
+			}
+			if len(g.Image) != tt.wantFrames {
+				t.Errorf("Process() got = %d frames, want %d", len(g.Image), tt.wantFrames)
+			}
+			for i, frame := range g.Image {
+				if frame.Bounds() != g.Image[0].Bounds() {
+					t.Errorf("Process() frame %d got = %v, want %v", i, frame.Bounds(), g.Image[0].Bounds())
+				}
+				if tt.wantFrames > 1 && g.Delay[i] != 10+i {
+					t.Errorf("Process() delay %d got = %d, want %d", i, g.Delay[i], 10+i)
+				}
+			}
+		})
+	}
+}
+
+func TestProcess_AnimationFilters(t *testing.T) {
+	// the red of the frames turned gray, which the palette of the original does not have
+	want := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	want.SetRGBA(0, 0, color.RGBA{R: 255, A: 255})
+	grayscale(want)
+
+	out, _, err := NewProcessor(ProcessorConfig{MaxFrames: 100}).Process(context.Background(), testAnimation(t, 3), internal.FormatGif,
+		Options{Grayscale: true})
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+
+	for i, frame := range g.Image {
+		// dithering spreads the gray over several palette colors, so the average of the frame is compared
+		var sum [3]int
+		for y := frame.Rect.Min.Y; y < frame.Rect.Max.Y; y++ {
+			for x := frame.Rect.Min.X; x < frame.Rect.Max.X; x++ {
+				c := color.RGBAModel.Convert(frame.At(x, y)).(color.RGBA)
+				sum[0], sum[1], sum[2] = sum[0]+int(c.R), sum[1]+int(c.G), sum[2]+int(c.B)
+			}
+		}
+		n := frame.Rect.Dx() * frame.Rect.Dy()
+		for c, v := range sum {
+			if d := v/n - int(want.Pix[c]); d < -8 || d > 8 {
+				t.Errorf("Process() frame %d channel %d got = %d, want %d", i, c, v/n, want.Pix[c])
+			}
+		}
+	}
+}
+
+func TestProcess_AnimationToStill(t *testing.T) {
+	out, format, err := NewProcessor(ProcessorConfig{MaxFrames: 100}).Process(context.Background(), testAnimation(t, 5), internal.FormatGif,
+		Options{Format: internal.FormatPng})
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if format != internal.FormatPng {
+		t.Error("expected:", internal.FormatPng, "got:", format)
+	}
+	img, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if b := img.Bounds(); b.Dx() != 40 || b.Dy() != 20 {
+		t.Error("expected:", "40x20", "got:", b.Dx(), b.Dy())
+	}
+}
+
+// testColorAnimation returns a 40x20 gif with one full frame per color, each shown for 0.1 seconds
+func testColorAnimation(t *testing.T, colors ...color.Color) []byte {
+	g := &gif.GIF{}
+	for i := range colors {
+		frame := image.NewPaletted(image.Rect(0, 0, 40, 20), colors)
+		for j := range frame.Pix {
+			frame.Pix[j] = uint8(i)
+		}
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 10)
+		g.Disposal = append(g.Disposal, gif.DisposalNone)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestProcess_Poster(t *testing.T) {
+	red, green, blue := color.RGBA{R: 255, A: 255}, color.RGBA{G: 255, A: 255}, color.RGBA{B: 255, A: 255}
+	data := testColorAnimation(t, red, green, blue)
+
+	tests := []struct {
+		name       string
+		opts       Options
+		wantFormat internal.ImageFormat
+		want       color.RGBA
+	}{
+		{name: "by index", opts: Options{Anim: AnimPoster, Frame: 1}, wantFormat: internal.FormatJpeg, want: green},
+		{name: "index beyond the last frame", opts: Options{Anim: AnimPoster, Frame: 9}, wantFormat: internal.FormatJpeg, want: blue},
+		{name: "by time", opts: Options{Anim: AnimPoster, Time: 0.25}, wantFormat: internal.FormatJpeg, want: blue},
+		{name: "requested format", opts: Options{Anim: AnimPoster, Time: 0.1, Format: internal.FormatPng}, wantFormat: internal.FormatPng, want: green},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, format, err := NewProcessor(ProcessorConfig{MaxFrames: 100}).Process(context.Background(), data, internal.FormatGif, tt.opts)
+			if err != nil {
+				t.Fatal("expected:", nil, "got:", err)
+			}
+			if format != tt.wantFormat {
+				t.Error("expected:", tt.wantFormat, "got:", format)
+			}
+
+			img, _, err := image.Decode(bytes.NewReader(out))
+			if err != nil {
+				t.Fatal("expected:", nil, "got:", err)
+			}
+			// jpeg shifts the colors slightly, the channel which is on has to stay on
+			r, g, b, _ := img.At(20, 10).RGBA()
+			got := color.RGBA{R: uint8(r>>15) * 255, G: uint8(g>>15) * 255, B: uint8(b>>15) * 255, A: 255}
+			if got != tt.want {
+				t.Errorf("Process() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcess_Budget(t *testing.T) {
+	// noise compresses badly, so the gif has to be reduced to fit
+	rng := rand.New(rand.NewSource(1))
+	palette := color.Palette{}
+	for i := 0; i < 256; i++ {
+		palette = append(palette, color.RGBA{R: uint8(i), G: uint8(255 - i), B: uint8(i * 7), A: 255})
+	}
+	g := &gif.GIF{}
+	for i := 0; i < 8; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 64, 64), palette)
+		rng.Read(frame.Pix)
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 5)
+		g.Disposal = append(g.Disposal, gif.DisposalNone)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	budget := buf.Len() / 4
+
+	out, _, err := NewProcessor(ProcessorConfig{MaxFrames: 100}).Process(context.Background(), buf.Bytes(), internal.FormatGif,
+		Options{Budget: budget})
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if len(out) > budget {
+		t.Error("expected:", budget, "got:", len(out))
+	}
+	reduced, err := gif.DecodeAll(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	duration := 0
+	for _, d := range reduced.Delay {
+		duration += d
+	}
+	if duration != 40 {
+		t.Error("expected:", 40, "got:", duration)
+	}
+
+	if _, err := fitBudget(g, 100); !errors.Is(err, ErrImageTooLarge) {
+		t.Error("expected:", ErrImageTooLarge, "got:", err)
+	}
+	if _, _, err := NewProcessor(ProcessorConfig{}).Process(context.Background(), buf.Bytes(), internal.FormatGif,
+		Options{Budget: budget, Format: internal.FormatPng}); !errors.Is(err, ErrInvalidOptions) {
+		t.Error("expected:", ErrInvalidOptions, "got:", err)
+	}
+}
+
+func TestScanGif(t *testing.T) {
+	data := testAnimation(t, 5)
+
+	frames, transparent, cut, err := scanGif(data, 0)
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if frames != 5 || cut != len(data)-1 {
+		t.Error("expected:", 5, len(data)-1, "got:", frames, cut)
+	}
+	// the palette contains a transparent color, so the encoder flags it in every frame
+	if !transparent {
+		t.Error("expected:", true, "got:", transparent)
+	}
+
+	if frames, _, cut, _ = scanGif(data, 2); frames != 2 || cut >= len(data)-1 {
+		t.Error("expected:", "2 frames and an earlier cut", "got:", frames, cut)
+	}
+}
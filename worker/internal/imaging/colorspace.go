@@ -0,0 +1,293 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/image/draw"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	// ColorSpaceRGB, ColorSpaceCMYK and ColorSpaceGray are the color spaces reported by Inspect
+	ColorSpaceRGB  = "rgb"
+	ColorSpaceCMYK = "cmyk"
+	ColorSpaceGray = "gray"
+
+	// srgbTolerance is how far the colorants of a profile may be from those of sRGB to count as sRGB,
+	// profiles differ in how they round them
+	srgbTolerance = 0.01
+	// linearSteps is the resolution of the table encoding linear light to sRGB
+	linearSteps = 4096
+)
+
+var (
+	errNoProfile = errors.New("no rgb matrix profile")
+
+	// srgbColorants are the red, green and blue colorants of sRGB adapted to D50, the columns of its
+	// matrix to XYZ as stored in ICC profiles
+	srgbColorants = [3][3]float64{
+		{0.4360747, 0.3850649, 0.1430804},
+		{0.2225045, 0.7168786, 0.0606169},
+		{0.0139322, 0.0971045, 0.7141733},
+	}
+	// xyzToSRGB converts XYZ relative to D50, the connection space of ICC profiles, to linear sRGB
+	xyzToSRGB = [3][3]float64{
+		{3.1338561, -1.6168667, -0.4906146},
+		{-0.9787684, 1.9161415, 0.0334540},
+		{0.0719453, -0.2289914, 1.4052427},
+	}
+	// srgbEncode maps linear light in linearSteps steps to 8 bit sRGB
+	srgbEncode = func() [linearSteps + 1]uint8 {
+		var lut [linearSteps + 1]uint8
+		for i := range lut {
+			l := float64(i) / linearSteps
+			v := 12.92 * l
+			if l > 0.0031308 {
+				v = 1.055*math.Pow(l, 1/2.4) - 0.055
+			}
+			lut[i] = uint8(math.Round(v * 255))
+		}
+		return lut
+	}()
+)
+
+// rgbProfile is an ICC profile describing an rgb space by the tone curves and colorants of its
+// channels, which covers the wide gamut spaces like Display P3 and Adobe RGB
+type rgbProfile struct {
+	// colorants are the columns of the matrix from linear rgb to XYZ relative to D50
+	colorants [3][3]float64
+	// curves map the 8 bit values of every channel to linear light
+	curves [3][256]float64
+}
+
+// isSRGB reports whether the profile has the primaries of sRGB, its tone curves are close enough
+func (p *rgbProfile) isSRGB() bool {
+	for i := range p.colorants {
+		for j := range p.colorants[i] {
+			if math.Abs(p.colorants[i][j]-srgbColorants[i][j]) > srgbTolerance {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// convertsToSRGB reports whether the pixels of an image with the color model m and the embedded
+// profile icc are converted to sRGB when it is processed
+func convertsToSRGB(m color.Model, icc []byte) bool {
+	if m == color.CMYKModel {
+		return true
+	}
+	_, ok := wideGamut(icc)
+	return ok
+}
+
+// wideGamut returns the profile in icc if it is an rgb matrix profile other than sRGB
+func wideGamut(icc []byte) (*rgbProfile, bool) {
+	if len(icc) == 0 {
+		return nil, false
+	}
+	profile, err := parseRGBProfile(icc)
+	if err != nil || profile.isSRGB() {
+		return nil, false
+	}
+	return profile, true
+}
+
+// toSRGB converts the pixels of img to sRGB. CMYK images are converted with the formulas of
+// image/color, rgb images tagged with a wide gamut profile through the XYZ space of the profile.
+// Colors outside of sRGB are clipped. It reports whether img was converted.
+func toSRGB(img image.Image, icc []byte) (image.Image, bool) {
+	if img.ColorModel() == color.CMYKModel {
+		rgba := image.NewRGBA(img.Bounds())
+		draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+		return rgba, true
+	}
+
+	profile, ok := wideGamut(icc)
+	if !ok {
+		return img, false
+	}
+
+	var m [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				m[i][j] += xyzToSRGB[i][k] * profile.colorants[k][j]
+			}
+		}
+	}
+
+	// the tone curves work on straight colors
+	out := image.NewNRGBA(img.Bounds())
+	draw.Draw(out, out.Bounds(), img, img.Bounds().Min, draw.Src)
+	for i := 0; i < len(out.Pix); i += 4 {
+		r := profile.curves[0][out.Pix[i]]
+		g := profile.curves[1][out.Pix[i+1]]
+		b := profile.curves[2][out.Pix[i+2]]
+		for c := 0; c < 3; c++ {
+			l := m[c][0]*r + m[c][1]*g + m[c][2]*b
+			out.Pix[i+c] = srgbEncode[int(math.Round(math.Max(0, math.Min(1, l))*linearSteps))]
+		}
+	}
+	return out, true
+}
+
+// colorSpace names the color space of the color model m
+func colorSpace(m color.Model) string {
+	switch m {
+	case color.CMYKModel:
+		return ColorSpaceCMYK
+	case color.GrayModel, color.Gray16Model:
+		return ColorSpaceGray
+	}
+	return ColorSpaceRGB
+}
+
+// parseRGBProfile reads the colorants and tone curves of an rgb matrix profile
+func parseRGBProfile(icc []byte) (*rgbProfile, error) {
+	if len(icc) < 132 || string(icc[16:20]) != "RGB " || string(icc[20:24]) != "XYZ " {
+		return nil, errNoProfile
+	}
+	tags := iccTags(icc)
+
+	profile := &rgbProfile{}
+	for c, name := range []string{"r", "g", "b"} {
+		xyz := tags[name+"XYZ"]
+		if len(xyz) < 20 || string(xyz[:4]) != "XYZ " {
+			return nil, errNoProfile
+		}
+		for i := 0; i < 3; i++ {
+			profile.colorants[i][c] = s15Fixed16(xyz[8+4*i:])
+		}
+
+		curve, err := toneCurve(tags[name+"TRC"])
+		if err != nil {
+			return nil, err
+		}
+		for v := range profile.curves[c] {
+			// broken curves can produce anything, linear light is between 0 and 1
+			l := curve(float64(v) / 255)
+			if !(l > 0) {
+				l = 0
+			}
+			profile.curves[c][v] = math.Min(1, l)
+		}
+	}
+	return profile, nil
+}
+
+// iccDescription returns the description of the profile, empty if it has none
+func iccDescription(icc []byte) string {
+	desc := iccTags(icc)["desc"]
+	switch {
+	case len(desc) >= 12 && string(desc[:4]) == "desc":
+		// ICC v2: an ascii string with its length
+		n := int(binary.BigEndian.Uint32(desc[8:]))
+		if n > len(desc)-12 {
+			return ""
+		}
+		return strings.TrimRight(string(desc[12:12+n]), "\x00")
+	case len(desc) >= 28 && string(desc[:4]) == "mluc":
+		// ICC v4: utf-16 strings per language, the first one is used
+		n, offset := int(binary.BigEndian.Uint32(desc[20:])), int(binary.BigEndian.Uint32(desc[24:]))
+		if offset < 0 || n < 0 || offset+n > len(desc) {
+			return ""
+		}
+		units := make([]uint16, n/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(desc[offset+2*i:])
+		}
+		return strings.TrimRight(string(utf16.Decode(units)), "\x00")
+	}
+	return ""
+}
+
+// iccTags returns the data of the tags of a profile by their signature
+func iccTags(icc []byte) map[string][]byte {
+	tags := make(map[string][]byte)
+	if len(icc) < 132 {
+		return tags
+	}
+	count := int(binary.BigEndian.Uint32(icc[128:]))
+	for i := 0; i < count && 132+12*i+12 <= len(icc); i++ {
+		entry := icc[132+12*i:]
+		offset, size := binary.BigEndian.Uint32(entry[4:]), binary.BigEndian.Uint32(entry[8:])
+		if uint64(offset)+uint64(size) > uint64(len(icc)) {
+			continue
+		}
+		tags[string(entry[:4])] = icc[offset : offset+size]
+	}
+	return tags
+}
+
+// toneCurve returns the function of a curv or para tag, which maps encoded values to linear light
+func toneCurve(tag []byte) (func(float64) float64, error) {
+	switch {
+	case len(tag) >= 12 && bytes.HasPrefix(tag, []byte("curv")):
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if 12+2*n > len(tag) {
+			return nil, errNoProfile
+		}
+		switch n {
+		case 0:
+			return func(x float64) float64 { return x }, nil
+		case 1:
+			gamma := float64(binary.BigEndian.Uint16(tag[12:])) / 256
+			return func(x float64) float64 { return math.Pow(x, gamma) }, nil
+		}
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 0xffff
+		}
+		return func(x float64) float64 {
+			pos := x * float64(n-1)
+			i := minInt(int(pos), n-2)
+			return table[i] + (table[i+1]-table[i])*(pos-float64(i))
+		}, nil
+	case len(tag) >= 12 && bytes.HasPrefix(tag, []byte("para")):
+		kind := int(binary.BigEndian.Uint16(tag[8:]))
+		counts := []int{1, 3, 4, 5, 7}
+		if kind >= len(counts) || len(tag) < 12+4*counts[kind] {
+			return nil, errNoProfile
+		}
+		// g, a, b, c, d, e, f as named by the ICC specification, unused ones keep the identity
+		p := [7]float64{1, 1, 0, 0, 0, 0, 0}
+		for i := 0; i < counts[kind]; i++ {
+			p[i] = s15Fixed16(tag[12+4*i:])
+		}
+		g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+		switch kind {
+		case 1, 2:
+			// below -b/a the curve is flat at c, which is 0 for type 1
+			d = -b / a
+			if a == 0 {
+				d = 0
+			}
+			return func(x float64) float64 {
+				if x < d {
+					return c
+				}
+				return math.Pow(a*x+b, g) + c
+			}, nil
+		case 3, 4:
+			return func(x float64) float64 {
+				if x < d {
+					return c*x + f
+				}
+				return math.Pow(a*x+b, g) + e
+			}, nil
+		}
+		return func(x float64) float64 { return math.Pow(x, g) }, nil
+	}
+	return nil, errNoProfile
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
@@ -0,0 +1,170 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"github.com/phips4/img-proxy/worker/internal"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"testing"
+)
+
+// displayP3Colorants are the colorants of Display P3 adapted to D50
+var displayP3Colorants = [3][3]float64{
+	{0.5151, 0.2920, 0.1571},
+	{0.2412, 0.6922, 0.0666},
+	{-0.0011, 0.0419, 0.7841},
+}
+
+// testProfile returns an ICC v2 rgb matrix profile with the sRGB tone curve for all channels
+func testProfile(colorants [3][3]float64, description string) []byte {
+	fixed := func(f float64) []byte {
+		return binary.BigEndian.AppendUint32(nil, uint32(int32(math.Round(f*65536))))
+	}
+
+	desc := append([]byte("desc\x00\x00\x00\x00"), binary.BigEndian.AppendUint32(nil, uint32(len(description)+1))...)
+	desc = append(append(desc, description...), 0)
+	// parametric curve type 3 with the parameters of sRGB
+	trc := []byte("para\x00\x00\x00\x00\x00\x03\x00\x00")
+	for _, p := range []float64{2.4, 1 / 1.055, 0.055 / 1.055, 1 / 12.92, 0.04045} {
+		trc = append(trc, fixed(p)...)
+	}
+	tags := []struct {
+		sig  string
+		data []byte
+	}{{"desc", desc}, {"rTRC", trc}, {"gTRC", trc}, {"bTRC", trc}}
+	for c, sig := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		xyz := []byte("XYZ \x00\x00\x00\x00")
+		for i := 0; i < 3; i++ {
+			xyz = append(xyz, fixed(colorants[i][c])...)
+		}
+		tags = append(tags, struct {
+			sig  string
+			data []byte
+		}{sig, xyz})
+	}
+
+	header := make([]byte, 128)
+	copy(header[12:], "mntr")
+	copy(header[16:], "RGB ")
+	copy(header[20:], "XYZ ")
+	copy(header[36:], "acsp")
+
+	table := binary.BigEndian.AppendUint32(nil, uint32(len(tags)))
+	var data []byte
+	offset := 128 + 4 + 12*len(tags)
+	for _, tag := range tags {
+		table = append(table, tag.sig...)
+		table = binary.BigEndian.AppendUint32(table, uint32(offset+len(data)))
+		table = binary.BigEndian.AppendUint32(table, uint32(len(tag.data)))
+		data = append(data, tag.data...)
+		for len(data)%4 != 0 {
+			data = append(data, 0)
+		}
+	}
+
+	icc := append(append(header, table...), data...)
+	binary.BigEndian.PutUint32(icc, uint32(len(icc)))
+	return icc
+}
+
+func TestParseRGBProfile(t *testing.T) {
+	p3, err := parseRGBProfile(testProfile(displayP3Colorants, "Display P3"))
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if p3.isSRGB() {
+		t.Error("expected:", "not sRGB", "got:", p3.colorants)
+	}
+	// the sRGB tone curve maps mid gray to about 21.6 percent light
+	if math.Abs(p3.curves[0][128]-0.2158) > 0.001 {
+		t.Error("expected:", 0.2158, "got:", p3.curves[0][128])
+	}
+
+	srgb, err := parseRGBProfile(testProfile(srgbColorants, "sRGB IEC61966-2.1"))
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if !srgb.isSRGB() {
+		t.Error("expected:", "sRGB", "got:", srgb.colorants)
+	}
+
+	if got := iccDescription(testProfile(displayP3Colorants, "Display P3")); got != "Display P3" {
+		t.Error("expected:", "Display P3", "got:", got)
+	}
+	if _, err := parseRGBProfile([]byte("\x01\x01profile")); err == nil {
+		t.Error("expected:", errNoProfile, "got:", err)
+	}
+}
+
+func TestToSRGB(t *testing.T) {
+	rgb := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	rgb.SetNRGBA(0, 0, color.NRGBA{R: 200, G: 100, B: 100, A: 255})
+	rgb.SetNRGBA(1, 0, color.NRGBA{R: 128, G: 128, B: 128, A: 255})
+
+	out, converted := toSRGB(rgb, testProfile(displayP3Colorants, "Display P3"))
+	if !converted {
+		t.Fatal("expected:", true, "got:", converted)
+	}
+	// the same values mean more saturated colors in the wider space
+	if c := color.NRGBAModel.Convert(out.At(0, 0)).(color.NRGBA); c.R <= 200 || c.G >= 100 {
+		t.Error("expected:", "more saturated red", "got:", c)
+	}
+	// both spaces share their white point, grays stay gray
+	if c := color.NRGBAModel.Convert(out.At(1, 0)).(color.NRGBA); c.R < 127 || c.R > 129 || c.R != c.G || c.G != c.B {
+		t.Error("expected:", "gray 128", "got:", c)
+	}
+
+	if _, converted := toSRGB(rgb, testProfile(srgbColorants, "sRGB")); converted {
+		t.Error("expected:", false, "got:", converted)
+	}
+
+	cmyk := image.NewCMYK(image.Rect(0, 0, 1, 1))
+	cmyk.SetCMYK(0, 0, color.CMYK{C: 255})
+	out, converted = toSRGB(cmyk, nil)
+	if r, g, b, _ := out.At(0, 0).RGBA(); !converted || r != 0 || g != 0xffff || b != 0xffff {
+		t.Error("expected:", "cyan", "got:", converted, r, g, b)
+	}
+}
+
+func TestProcess_WideGamut(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for i := 0; i < len(img.Pix); i += 4 {
+		copy(img.Pix[i:], []byte{200, 100, 100, 255})
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	data, err := EmbedICC(buf.Bytes(), internal.FormatPng, testProfile(displayP3Colorants, "Display P3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// even without options the image is converted instead of passed through
+	out, _, err := NewProcessor(ProcessorConfig{KeepICC: true}).Process(context.Background(), data, internal.FormatPng, Options{})
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if md := ReadMetadata(out, internal.FormatPng); md.ICC != nil {
+		t.Error("expected:", "no profile", "got:", len(md.ICC), "bytes")
+	}
+	decoded, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if c := color.NRGBAModel.Convert(decoded.At(0, 0)).(color.NRGBA); c.R <= 200 {
+		t.Error("expected:", "more saturated red", "got:", c)
+	}
+
+	info, err := Inspect(data, internal.FormatPng)
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if info.Profile != "Display P3" || !info.ConvertedToSRGB {
+		t.Error("expected:", "Display P3 true", "got:", info.Profile, info.ConvertedToSRGB)
+	}
+}
@@ -0,0 +1,264 @@
+package imaging
+
+import (
+	"fmt"
+	"golang.org/x/image/draw"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Gravity decides which part of an image is kept when it is cropped to cover a box
+type Gravity string
+
+const (
+	GravityCenter    Gravity = "center"
+	GravityNorth     Gravity = "north"
+	GravitySouth     Gravity = "south"
+	GravityEast      Gravity = "east"
+	GravityWest      Gravity = "west"
+	GravityNorthEast Gravity = "northeast"
+	GravityNorthWest Gravity = "northwest"
+	GravitySouthEast Gravity = "southeast"
+	GravitySouthWest Gravity = "southwest"
+	// GravityFocal keeps the region around the focal point given by fx and fy
+	GravityFocal Gravity = "focal"
+	// GravityEntropy keeps the region with the most detail
+	GravityEntropy Gravity = "entropy"
+	// GravityAttention keeps the region with the strongest edges and most saturated colors
+	GravityAttention Gravity = "attention"
+)
+
+var gravities = map[Gravity]bool{
+	GravityCenter: true, GravityNorth: true, GravitySouth: true, GravityEast: true, GravityWest: true,
+	GravityNorthEast: true, GravityNorthWest: true, GravitySouthEast: true, GravitySouthWest: true,
+	GravityFocal: true, GravityEntropy: true, GravityAttention: true,
+}
+
+// analysisSize is the length of the longer side of the thumbnail the smart crop heuristics work on
+const analysisSize = 128
+
+// parseCrop reads a rectangle in the form x,y,width,height
+func parseCrop(v string) (image.Rectangle, error) {
+	parts := strings.Split(v, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, fmt.Errorf("%w: crop must be x,y,width,height", ErrInvalidOptions)
+	}
+
+	var n [4]int
+	for i, p := range parts {
+		var err error
+		if n[i], err = strconv.Atoi(strings.TrimSpace(p)); err != nil || n[i] < 0 || n[i] > MaxDimension*4 {
+			return image.Rectangle{}, fmt.Errorf("%w: invalid crop value %s", ErrInvalidOptions, p)
+		}
+	}
+	if n[2] == 0 || n[3] == 0 {
+		return image.Rectangle{}, fmt.Errorf("%w: crop width and height must be positive", ErrInvalidOptions)
+	}
+
+	return image.Rect(n[0], n[1], n[0]+n[2], n[1]+n[3]), nil
+}
+
+// parseFocus reads one coordinate of the focal point, relative to the image size
+func parseFocus(v string) (float64, error) {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 || f > 1 || math.IsNaN(f) {
+		return 0, fmt.Errorf("%w: focal point coordinates must be between 0 and 1", ErrInvalidOptions)
+	}
+	// three decimals are more precise than any thumbnail, rounding keeps variants from fragmenting
+	return math.Round(f*1000) / 1000, nil
+}
+
+func formatCrop(r image.Rectangle) string {
+	return fmt.Sprintf("%d,%d,%d,%d", r.Min.X, r.Min.Y, r.Dx(), r.Dy())
+}
+
+// cropRegion returns the region of src which is kept by an explicit crop, the whole image without one
+func cropRegion(b image.Rectangle, o Options) (image.Rectangle, error) {
+	if o.Crop.Empty() {
+		return b, nil
+	}
+	r := o.Crop.Add(b.Min).Intersect(b)
+	if r.Empty() {
+		return image.Rectangle{}, fmt.Errorf("%w: crop %s is outside of the image", ErrInvalidOptions, formatCrop(o.Crop))
+	}
+	return r, nil
+}
+
+// coverCrop returns the region of b with the aspect ratio w:h which is kept according to the gravity of o
+func coverCrop(src image.Image, b image.Rectangle, w, h int, o Options) image.Rectangle {
+	sw, sh := b.Dx(), b.Dy()
+	cw, ch := sw, sh
+	if sw*h > sh*w {
+		cw = scaleDimension(sh, w, h)
+	} else {
+		ch = scaleDimension(sw, h, w)
+	}
+	freeX, freeY := sw-cw, sh-ch
+
+	x, y := freeX/2, freeY/2
+	switch o.Gravity {
+	case GravityNorth:
+		y = 0
+	case GravitySouth:
+		y = freeY
+	case GravityEast:
+		x = freeX
+	case GravityWest:
+		x = 0
+	case GravityNorthEast:
+		x, y = freeX, 0
+	case GravityNorthWest:
+		x, y = 0, 0
+	case GravitySouthEast:
+		x, y = freeX, freeY
+	case GravitySouthWest:
+		x, y = 0, freeY
+	case GravityFocal:
+		x = clamp(int(o.FocusX*float64(sw))-cw/2, 0, freeX)
+		y = clamp(int(o.FocusY*float64(sh))-ch/2, 0, freeY)
+	case GravityEntropy, GravityAttention:
+		x, y = smartCrop(src, b, cw, ch, o.Gravity)
+	}
+
+	return image.Rect(b.Min.X+x, b.Min.Y+y, b.Min.X+x+cw, b.Min.Y+y+ch)
+}
+
+// smartCrop slides a cw x ch window along the free axis of region b and returns the offset of the
+// window with the highest score. The image is scored on a small thumbnail to keep this cheap.
+func smartCrop(src image.Image, b image.Rectangle, cw, ch int, gravity Gravity) (int, int) {
+	sw, sh := b.Dx(), b.Dy()
+	scale := float64(analysisSize) / float64(maxInt(sw, sh))
+	if scale > 1 {
+		scale = 1
+	}
+	tw, th := maxInt(1, int(float64(sw)*scale)), maxInt(1, int(float64(sh)*scale))
+	thumb := image.NewRGBA(image.Rect(0, 0, tw, th))
+	draw.ApproxBiLinear.Scale(thumb, thumb.Bounds(), src, b, draw.Src, nil)
+
+	var score [][]float64
+	if gravity == GravityEntropy {
+		score = entropyMap(thumb)
+	} else {
+		score = attentionMap(thumb)
+	}
+
+	ww, wh := maxInt(1, int(float64(cw)*scale)), maxInt(1, int(float64(ch)*scale))
+	bestX, bestY, best := 0, 0, -1.0
+	for y := 0; y+wh <= th; y++ {
+		for x := 0; x+ww <= tw; x++ {
+			// only one axis has room, so this loops over a single row or column
+			if s := windowScore(score, x, y, ww, wh); s > best {
+				bestX, bestY, best = x, y, s
+			}
+		}
+	}
+
+	return clamp(int(float64(bestX)/scale), 0, sw-cw), clamp(int(float64(bestY)/scale), 0, sh-ch)
+}
+
+func windowScore(score [][]float64, x, y, w, h int) float64 {
+	sum := 0.0
+	for yy := y; yy < y+h; yy++ {
+		for xx := x; xx < x+w; xx++ {
+			sum += score[yy][xx]
+		}
+	}
+	return sum
+}
+
+// entropyMap scores each pixel with the information content of its luminance in the whole image,
+// rare tones in detailed regions score higher than large flat areas
+func entropyMap(img *image.RGBA) [][]float64 {
+	b := img.Bounds()
+	var hist [256]int
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			hist[luminance(img.RGBAAt(x, y))]++
+		}
+	}
+
+	total := float64(b.Dx() * b.Dy())
+	var info [256]float64
+	for i, n := range hist {
+		if n > 0 {
+			info[i] = -math.Log2(float64(n) / total)
+		}
+	}
+
+	score := newScoreMap(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			score[y][x] = info[luminance(img.RGBAAt(x, y))]
+		}
+	}
+	return score
+}
+
+// attentionMap scores each pixel by the strength of its luminance edges and its saturation
+func attentionMap(img *image.RGBA) [][]float64 {
+	b := img.Bounds()
+	score := newScoreMap(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := img.RGBAAt(x, y)
+			l := float64(luminance(c))
+			edge := 0.0
+			if x+1 < b.Max.X {
+				edge += math.Abs(l - float64(luminance(img.RGBAAt(x+1, y))))
+			}
+			if y+1 < b.Max.Y {
+				edge += math.Abs(l - float64(luminance(img.RGBAAt(x, y+1))))
+			}
+			score[y][x] = edge + saturation(c)*255
+		}
+	}
+	return score
+}
+
+func newScoreMap(b image.Rectangle) [][]float64 {
+	score := make([][]float64, b.Max.Y)
+	for y := range score {
+		score[y] = make([]float64, b.Max.X)
+	}
+	return score
+}
+
+func luminance(c color.RGBA) uint8 {
+	return color.GrayModel.Convert(c).(color.Gray).Y
+}
+
+func saturation(c color.RGBA) float64 {
+	hi := maxInt(int(c.R), maxInt(int(c.G), int(c.B)))
+	lo := minInt(int(c.R), minInt(int(c.G), int(c.B)))
+	if hi == 0 {
+		return 0
+	}
+	return float64(hi-lo) / float64(hi)
+}
+
+func clamp(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,66 @@
+package imaging
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestCoverCrop(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 400, 200))
+
+	tests := []struct {
+		name string
+		opts Options
+		want image.Rectangle
+	}{
+		{name: "center", opts: Options{}, want: image.Rect(100, 0, 300, 200)},
+		{name: "west", opts: Options{Gravity: GravityWest}, want: image.Rect(0, 0, 200, 200)},
+		{name: "southeast", opts: Options{Gravity: GravitySouthEast}, want: image.Rect(200, 0, 400, 200)},
+		{name: "focal", opts: Options{Gravity: GravityFocal, FocusX: 0.3, FocusY: 0.5}, want: image.Rect(20, 0, 220, 200)},
+		{name: "focal clamped", opts: Options{Gravity: GravityFocal, FocusX: 1, FocusY: 1}, want: image.Rect(200, 0, 400, 200)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := coverCrop(src, src.Bounds(), 100, 100, tt.opts); got != tt.want {
+				t.Errorf("coverCrop() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCoverCrop_Smart(t *testing.T) {
+	// a flat image with a detailed, colorful patch on the right
+	src := image.NewRGBA(image.Rect(0, 0, 400, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 400; x++ {
+			c := color.RGBA{R: 128, G: 128, B: 128, A: 255}
+			if x >= 300 && (x+y)%2 == 0 {
+				c = color.RGBA{R: uint8(x), G: uint8(y * 2), B: 20, A: 255}
+			}
+			src.SetRGBA(x, y, c)
+		}
+	}
+
+	for _, gravity := range []Gravity{GravityEntropy, GravityAttention} {
+		got := coverCrop(src, src.Bounds(), 100, 100, Options{Gravity: gravity})
+		if got.Min.X < 250 {
+			t.Error("expected:", "crop on the detailed right side", "got:", got, "for", gravity)
+		}
+	}
+}
+
+func TestProcess_Crop(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 40, 40))
+	region, err := cropRegion(src.Bounds(), Options{Crop: image.Rect(30, 30, 60, 60)})
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if region != image.Rect(30, 30, 40, 40) {
+		t.Error("expected:", image.Rect(30, 30, 40, 40), "got:", region)
+	}
+
+	if _, err := cropRegion(src.Bounds(), Options{Crop: image.Rect(50, 50, 60, 60)}); err == nil {
+		t.Error("expected:", ErrInvalidOptions, "got:", nil)
+	}
+}
@@ -0,0 +1,83 @@
+package imaging
+
+import (
+	"context"
+	"fmt"
+	"github.com/phips4/img-proxy/worker/internal"
+	"golang.org/x/image/draw"
+	"image"
+	"math/bits"
+	"strconv"
+)
+
+const (
+	// dHashWidth and dHashHeight are the size of the thumbnail the difference hash is computed from,
+	// every row yields dHashWidth-1 bits
+	dHashWidth  = 9
+	dHashHeight = 8
+	// MaxHashDistance is the largest Hamming distance between two hashes, they differ in every bit
+	MaxHashDistance = 64
+	// DefaultHashDistance is the distance up to which images are considered near-duplicates if no
+	// other distance is given. Resized and recompressed copies stay well below it.
+	DefaultHashDistance = 10
+)
+
+// DHash computes the difference hash of an original image in the processing pool. Visually similar
+// images, like resized or recompressed copies, have hashes with a small Hamming distance.
+func (p *Processor) DHash(ctx context.Context, data []byte, format internal.ImageFormat) (uint64, error) {
+	var hash uint64
+	var err error
+	if poolErr := p.run(ctx, func() { hash, err = p.dHash(data, format) }); poolErr != nil {
+		return 0, poolErr
+	}
+	return hash, err
+}
+
+func (p *Processor) dHash(data []byte, format internal.ImageFormat) (uint64, error) {
+	src, err := p.placeholderSource(data, format)
+	if err != nil {
+		return 0, err
+	}
+	return dHash(src), nil
+}
+
+// dHash shrinks img to a gray thumbnail and sets a bit for every pixel which is darker than its right
+// neighbour. Transparent pixels count as black.
+func dHash(img image.Image) uint64 {
+	// catmull-rom averages over all pixels it shrinks, which keeps the hash stable across sizes
+	gray := image.NewGray(image.Rect(0, 0, dHashWidth, dHashHeight))
+	draw.CatmullRom.Scale(gray, gray.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+	var hash uint64
+	for y := 0; y < dHashHeight; y++ {
+		for x := 0; x < dHashWidth-1; x++ {
+			hash <<= 1
+			if gray.GrayAt(x, y).Y < gray.GrayAt(x+1, y).Y {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// HashDistance returns the number of bits in which the hashes a and b differ
+func HashDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// FormatHash returns the hash as 16 hex digits
+func FormatHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+// ParseHash parses a hash formatted by FormatHash
+func ParseHash(s string) (uint64, error) {
+	if len(s) != 16 {
+		return 0, fmt.Errorf("%w: hash must be 16 hex digits", ErrInvalidOptions)
+	}
+	hash, err := strconv.ParseUint(s, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: hash must be 16 hex digits", ErrInvalidOptions)
+	}
+	return hash, nil
+}
@@ -0,0 +1,106 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/phips4/img-proxy/worker/internal"
+	"golang.org/x/image/draw"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"testing"
+)
+
+// testPattern returns an image with smooth light and dark areas, like a photo at the size of a hash
+func testPattern(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			fx, fy := float64(x)/float64(w), float64(y)/float64(h)
+			v := uint8(127 + 120*math.Sin(fx*7+fy*3)*math.Cos(fy*5-fx*2))
+			img.SetRGBA(x, y, color.RGBA{R: v, G: v / 2, B: 255 - v, A: 255})
+		}
+	}
+	return img
+}
+
+func TestProcessor_DHash(t *testing.T) {
+	original := testPattern(400, 300)
+	var pngBuf bytes.Buffer
+	if err := png.Encode(&pngBuf, original); err != nil {
+		t.Fatal(err)
+	}
+
+	// a smaller and recompressed copy
+	small := image.NewRGBA(image.Rect(0, 0, 150, 112))
+	draw.BiLinear.Scale(small, small.Bounds(), original, original.Bounds(), draw.Src, nil)
+	var jpegBuf bytes.Buffer
+	if err := jpeg.Encode(&jpegBuf, small, &jpeg.Options{Quality: 40}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same pattern upside down
+	flipped := image.NewRGBA(original.Bounds())
+	for y := 0; y < 300; y++ {
+		copy(flipped.Pix[y*flipped.Stride:(y+1)*flipped.Stride], original.Pix[(299-y)*original.Stride:])
+	}
+	var flippedBuf bytes.Buffer
+	if err := png.Encode(&flippedBuf, flipped); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewProcessor(ProcessorConfig{})
+	hash, err := p.DHash(context.Background(), pngBuf.Bytes(), internal.FormatPng)
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	copyHash, err := p.DHash(context.Background(), jpegBuf.Bytes(), internal.FormatJpeg)
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	flippedHash, err := p.DHash(context.Background(), flippedBuf.Bytes(), internal.FormatPng)
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+
+	if d := HashDistance(hash, copyHash); d > DefaultHashDistance {
+		t.Error("expected:", "copy within", DefaultHashDistance, "got:", d)
+	}
+	if d := HashDistance(hash, flippedHash); d <= DefaultHashDistance {
+		t.Error("expected:", "flipped image beyond", DefaultHashDistance, "got:", d)
+	}
+}
+
+func TestParseHash(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    uint64
+		wantErr bool
+	}{
+		{s: "00000000000000ff", want: 0xff},
+		{s: "FFFFFFFFFFFFFFFF", want: math.MaxUint64},
+		{s: "ff", wantErr: true},
+		{s: "000000000000000g", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := ParseHash(tt.s)
+			if tt.wantErr != errors.Is(err, ErrInvalidOptions) {
+				t.Fatalf("ParseHash() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseHash() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if got := FormatHash(0xff); got != "00000000000000ff" {
+		t.Error("expected:", "00000000000000ff", "got:", got)
+	}
+	if got := HashDistance(0xf0, 0x0f); got != 8 {
+		t.Error("expected:", 8, "got:", got)
+	}
+}
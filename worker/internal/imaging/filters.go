@@ -0,0 +1,201 @@
+package imaging
+
+import (
+	"golang.org/x/image/draw"
+	"image"
+	"math"
+)
+
+// Flip mirrors an image
+type Flip string
+
+const (
+	// FlipHorizontal mirrors the image at its vertical axis
+	FlipHorizontal Flip = "h"
+	// FlipVertical mirrors the image at its horizontal axis
+	FlipVertical Flip = "v"
+	// FlipBoth mirrors the image at both axes
+	FlipBoth Flip = "hv"
+)
+
+const (
+	// MaxBlur is the largest blur radius in pixels
+	MaxBlur = 100
+	// MaxSharpen is the strongest sharpening
+	MaxSharpen = 10
+	// sharpenSigma is the radius of the details enhanced by sharpening
+	sharpenSigma = 1
+)
+
+// turn rotates img clockwise and flips it as o asks for. It runs right after the EXIF orientation
+// was applied, so crop, width and height refer to the turned image.
+func turn(img image.Image, o Options) image.Image {
+	// rotations and flips are the same transformations as the EXIF orientations
+	switch o.Rotate {
+	case 90:
+		img = applyOrientation(img, 6)
+	case 180:
+		img = applyOrientation(img, 3)
+	case 270:
+		img = applyOrientation(img, 8)
+	}
+	switch o.Flip {
+	case FlipHorizontal:
+		img = applyOrientation(img, 2)
+	case FlipVertical:
+		img = applyOrientation(img, 4)
+	case FlipBoth:
+		img = applyOrientation(img, 3)
+	}
+	return img
+}
+
+// turnedBounds returns the bounds b has after turn
+func turnedBounds(b image.Rectangle, o Options) image.Rectangle {
+	if o.Rotate == 90 || o.Rotate == 270 {
+		return image.Rect(0, 0, b.Dy(), b.Dx())
+	}
+	return image.Rect(0, 0, b.Dx(), b.Dy())
+}
+
+// adjust applies the pixel filters of o to a resized image, in the order blur, sharpen, grayscale,
+// brightness and contrast. img is not modified.
+func adjust(img image.Image, o Options) image.Image {
+	if o.Blur == 0 && o.Sharpen == 0 && !o.Grayscale && o.Brightness == 0 && o.Contrast == 0 {
+		return img
+	}
+
+	rgba := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+
+	if o.Blur > 0 {
+		rgba = gaussianBlur(rgba, o.Blur)
+	}
+	if o.Sharpen > 0 {
+		sharpen(rgba, o.Sharpen)
+	}
+	if o.Grayscale {
+		grayscale(rgba)
+	}
+	if o.Brightness != 0 || o.Contrast != 0 {
+		brightnessContrast(rgba, o.Brightness, o.Contrast)
+	}
+	return rgba
+}
+
+// gaussianBlur approximates a gaussian blur with three box blurs, which take the same time for
+// every radius
+func gaussianBlur(img *image.RGBA, sigma float64) *image.RGBA {
+	out := image.NewRGBA(img.Rect)
+	tmp := image.NewRGBA(img.Rect)
+	copy(out.Pix, img.Pix)
+	for _, size := range boxSizes(sigma, 3) {
+		r := (size - 1) / 2
+		boxBlur(out, tmp, r, true)
+		boxBlur(tmp, out, r, false)
+	}
+	return out
+}
+
+// boxSizes returns the widths of n box blurs whose combination is close to a gaussian blur with
+// the standard deviation sigma
+func boxSizes(sigma float64, n int) []int {
+	ideal := math.Sqrt(12*sigma*sigma/float64(n) + 1)
+	lower := int(ideal)
+	if lower%2 == 0 {
+		lower--
+	}
+	upper := lower + 2
+	m := int(math.Round((12*sigma*sigma - float64(n*lower*lower+4*n*lower+3*n)) / float64(-4*lower-4)))
+
+	sizes := make([]int, n)
+	for i := range sizes {
+		if i < m {
+			sizes[i] = lower
+		} else {
+			sizes[i] = upper
+		}
+	}
+	return sizes
+}
+
+// boxBlur writes the average of every pixel of src and the r pixels on both sides of it to dst,
+// horizontally or vertically. Pixels beyond the edges repeat the edge pixel. Both images use
+// premultiplied alpha, so transparent pixels do not darken their neighbours.
+func boxBlur(src, dst *image.RGBA, r int, horizontal bool) {
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	lines, length, step, lineStep := h, w, 4, src.Stride
+	if !horizontal {
+		lines, length, step, lineStep = w, h, src.Stride, 4
+	}
+	div := 2*r + 1
+
+	for l := 0; l < lines; l++ {
+		base := l * lineStep
+		at := func(i int) int {
+			return base + clamp(i, 0, length-1)*step
+		}
+
+		var sum [4]int
+		for i := -r; i <= r; i++ {
+			p := at(i)
+			for c := 0; c < 4; c++ {
+				sum[c] += int(src.Pix[p+c])
+			}
+		}
+		for i := 0; i < length; i++ {
+			p := base + i*step
+			for c := 0; c < 4; c++ {
+				dst.Pix[p+c] = uint8((sum[c] + div/2) / div)
+			}
+			in, out := at(i+r+1), at(i-r)
+			for c := 0; c < 4; c++ {
+				sum[c] += int(src.Pix[in+c]) - int(src.Pix[out+c])
+			}
+		}
+	}
+}
+
+// sharpen is an unsharp mask, it adds the difference to a blurred copy amount times to img
+func sharpen(img *image.RGBA, amount float64) {
+	blurred := gaussianBlur(img, sharpenSigma)
+	for i := 0; i < len(img.Pix); i += 4 {
+		a := float64(img.Pix[i+3])
+		for c := 0; c < 3; c++ {
+			v := float64(img.Pix[i+c])
+			v += amount * (v - float64(blurred.Pix[i+c]))
+			img.Pix[i+c] = uint8(math.Round(math.Max(0, math.Min(a, v))))
+		}
+	}
+}
+
+// grayscale replaces every color with its luma according to Rec. 709
+func grayscale(img *image.RGBA) {
+	for i := 0; i < len(img.Pix); i += 4 {
+		y := (2126*int(img.Pix[i]) + 7152*int(img.Pix[i+1]) + 722*int(img.Pix[i+2]) + 5000) / 10000
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2] = uint8(y), uint8(y), uint8(y)
+	}
+}
+
+// brightnessContrast shifts the colors by brightness percent of the full range and then scales
+// their distance to the middle gray by 1 + contrast/100, both are between -100 and 100
+func brightnessContrast(img *image.RGBA, brightness, contrast int) {
+	var lut [256]float64
+	factor := 1 + float64(contrast)/100
+	for v := range lut {
+		f := float64(v) + float64(brightness)*255/100
+		lut[v] = math.Max(0, math.Min(255, (f-128)*factor+128))
+	}
+
+	for i := 0; i < len(img.Pix); i += 4 {
+		a := int(img.Pix[i+3])
+		if a == 0 {
+			continue
+		}
+		// the table works on straight colors, the pixels are premultiplied
+		for c := 0; c < 3; c++ {
+			straight := minInt(255, int(img.Pix[i+c])*255/a)
+			img.Pix[i+c] = uint8(math.Round(lut[straight] * float64(a) / 255))
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package imaging
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestTurn(t *testing.T) {
+	// a 2x1 image with a red pixel on the left
+	src := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	src.Set(0, 0, color.RGBA{R: 255, A: 255})
+
+	tests := []struct {
+		name    string
+		opts    Options
+		wantW   int
+		wantH   int
+		wantRed image.Point
+	}{
+		{name: "none", opts: Options{}, wantW: 2, wantH: 1, wantRed: image.Pt(0, 0)},
+		{name: "rotate 90", opts: Options{Rotate: 90}, wantW: 1, wantH: 2, wantRed: image.Pt(0, 0)},
+		{name: "rotate 180", opts: Options{Rotate: 180}, wantW: 2, wantH: 1, wantRed: image.Pt(1, 0)},
+		{name: "rotate 270", opts: Options{Rotate: 270}, wantW: 1, wantH: 2, wantRed: image.Pt(0, 1)},
+		{name: "flip horizontal", opts: Options{Flip: FlipHorizontal}, wantW: 2, wantH: 1, wantRed: image.Pt(1, 0)},
+		{name: "rotate 90 and flip vertical", opts: Options{Rotate: 90, Flip: FlipVertical}, wantW: 1, wantH: 2, wantRed: image.Pt(0, 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := turn(src, tt.opts)
+			b := img.Bounds()
+			if b.Dx() != tt.wantW || b.Dy() != tt.wantH {
+				t.Errorf("turn() got = %dx%d, want %dx%d", b.Dx(), b.Dy(), tt.wantW, tt.wantH)
+			}
+			if turnedBounds(src.Bounds(), tt.opts) != image.Rect(0, 0, tt.wantW, tt.wantH) {
+				t.Errorf("turnedBounds() got = %v, want %dx%d", turnedBounds(src.Bounds(), tt.opts), tt.wantW, tt.wantH)
+			}
+			if r, _, _, _ := img.At(b.Min.X+tt.wantRed.X, b.Min.Y+tt.wantRed.Y).RGBA(); r == 0 {
+				t.Errorf("turn() red pixel not at %v", tt.wantRed)
+			}
+		})
+	}
+}
+
+func TestAdjust(t *testing.T) {
+	// left half dark blue, right half light orange
+	src := image.NewRGBA(image.Rect(0, 0, 20, 10))
+	for x := 0; x < 20; x++ {
+		for y := 0; y < 10; y++ {
+			c := color.RGBA{R: 20, G: 40, B: 120, A: 255}
+			if x >= 10 {
+				c = color.RGBA{R: 240, G: 180, B: 100, A: 255}
+			}
+			src.SetRGBA(x, y, c)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		opts  Options
+		check func(img *image.RGBA) bool
+	}{
+		{name: "untouched", opts: Options{}, check: func(img *image.RGBA) bool {
+			return img == src
+		}},
+		{name: "blur smooths the edge", opts: Options{Blur: 3}, check: func(img *image.RGBA) bool {
+			return img.RGBAAt(9, 5).R > 20 && img.RGBAAt(10, 5).R < 240 && img.RGBAAt(0, 0).R < 30
+		}},
+		{name: "sharpen increases the edge contrast", opts: Options{Sharpen: 2}, check: func(img *image.RGBA) bool {
+			return img.RGBAAt(9, 5).R < 20 && img.RGBAAt(10, 5).R > 240 && img.RGBAAt(0, 0) == src.RGBAAt(0, 0)
+		}},
+		{name: "grayscale", opts: Options{Grayscale: true}, check: func(img *image.RGBA) bool {
+			c := img.RGBAAt(15, 5)
+			return c.R == c.G && c.G == c.B && c.R > 150
+		}},
+		{name: "full brightness", opts: Options{Brightness: 100}, check: func(img *image.RGBA) bool {
+			return img.RGBAAt(0, 0) == color.RGBA{R: 255, G: 255, B: 255, A: 255}
+		}},
+		{name: "no contrast", opts: Options{Contrast: -100}, check: func(img *image.RGBA) bool {
+			return img.RGBAAt(0, 0) == color.RGBA{R: 128, G: 128, B: 128, A: 255} && img.RGBAAt(0, 0) == img.RGBAAt(19, 9)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, ok := adjust(src, tt.opts).(*image.RGBA)
+			if !ok || !tt.check(img) {
+				t.Errorf("adjust() got = %v, %v", img.RGBAAt(9, 5), img.RGBAAt(10, 5))
+			}
+		})
+	}
+	if src.RGBAAt(0, 0).R != 20 {
+		t.Error("expected:", "untouched source", "got:", src.RGBAAt(0, 0))
+	}
+}
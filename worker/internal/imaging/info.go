@@ -0,0 +1,98 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/phips4/img-proxy/worker/internal"
+	"image"
+	"image/color"
+	"math"
+)
+
+// ImageInfo describes the pixels of an encoded image
+type ImageInfo struct {
+	Width    int
+	Height   int
+	Frames   int
+	HasAlpha bool
+	// ColorSpace is rgb, cmyk or gray
+	ColorSpace string
+	// Profile is the description of the embedded color profile
+	Profile string
+	// ConvertedToSRGB is set if variants of the image are converted to sRGB
+	ConvertedToSRGB bool
+}
+
+// Inspect reads the dimensions, frame count, transparency and colors of an image from its header. The
+// dimensions are those of the image displayed upright, svg images report their intrinsic size.
+func Inspect(data []byte, format internal.ImageFormat) (ImageInfo, error) {
+	if format == internal.FormatSvg {
+		_, width, height, err := decodeSvg(data)
+		if err != nil {
+			return ImageInfo{}, err
+		}
+		// svg images have no background
+		return ImageInfo{Width: int(math.Round(width)), Height: int(math.Round(height)), Frames: 1, HasAlpha: true,
+			ColorSpace: ColorSpaceRGB}, nil
+	}
+
+	conf, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return ImageInfo{}, fmt.Errorf("decoding %s header: %w", format, err)
+	}
+
+	md := ReadMetadata(data, format)
+	info := ImageInfo{
+		Width:           conf.Width,
+		Height:          conf.Height,
+		Frames:          1,
+		HasAlpha:        hasAlpha(conf.ColorModel),
+		ColorSpace:      colorSpace(conf.ColorModel),
+		Profile:         iccDescription(md.ICC),
+		ConvertedToSRGB: convertsToSRGB(conf.ColorModel, md.ICC),
+	}
+	if md.Orientation >= 5 {
+		// orientations 5 to 8 turn the image by 90 degrees
+		info.Width, info.Height = info.Height, info.Width
+	}
+	if format == internal.FormatPng {
+		_ = walkPng(data, func(typ string, chunk []byte) bool {
+			switch {
+			case typ == "acTL" && len(chunk) >= 4:
+				// animated png, the control chunk starts with the number of frames
+				info.Frames = int(binary.BigEndian.Uint32(chunk))
+			case typ == "tRNS":
+				// transparency for images without alpha channel
+				info.HasAlpha = true
+			}
+			return true
+		})
+	}
+	if format == internal.FormatGif {
+		// the color model of the header is just the global palette, transparency is set per frame
+		frames, transparent, _, err := scanGif(data, 0)
+		if err != nil {
+			return ImageInfo{}, fmt.Errorf("reading gif: %w", err)
+		}
+		info.Frames, info.HasAlpha = frames, transparent
+	}
+
+	return info, nil
+}
+
+func hasAlpha(m color.Model) bool {
+	switch m {
+	case color.RGBAModel, color.RGBA64Model, color.NRGBAModel, color.NRGBA64Model, color.AlphaModel, color.Alpha16Model,
+		color.NYCbCrAModel:
+		return true
+	}
+	if palette, ok := m.(color.Palette); ok {
+		for _, c := range palette {
+			if _, _, _, a := c.RGBA(); a != 0xffff {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package imaging
+
+import (
+	"bytes"
+	"github.com/phips4/img-proxy/worker/internal"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	encode := func(img image.Image, format internal.ImageFormat) []byte {
+		var buf bytes.Buffer
+		var err error
+		if format == internal.FormatJpeg {
+			err = jpeg.Encode(&buf, img, nil)
+		} else {
+			err = png.Encode(&buf, img)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	transparent := image.NewNRGBA(image.Rect(0, 0, 30, 20))
+	opaque := image.NewGray(image.Rect(0, 0, 30, 20))
+	palette := image.NewPaletted(image.Rect(0, 0, 30, 20), color.Palette{color.Transparent, color.Black})
+
+	tests := []struct {
+		name   string
+		data   []byte
+		format internal.ImageFormat
+		want   ImageInfo
+	}{
+		{name: "jpeg", data: encode(opaque, internal.FormatJpeg), format: internal.FormatJpeg,
+			want: ImageInfo{Width: 30, Height: 20, Frames: 1, HasAlpha: false, ColorSpace: ColorSpaceGray}},
+		{name: "png with alpha", data: encode(transparent, internal.FormatPng), format: internal.FormatPng,
+			want: ImageInfo{Width: 30, Height: 20, Frames: 1, HasAlpha: true, ColorSpace: ColorSpaceRGB}},
+		{name: "gray png", data: encode(opaque, internal.FormatPng), format: internal.FormatPng,
+			want: ImageInfo{Width: 30, Height: 20, Frames: 1, HasAlpha: false, ColorSpace: ColorSpaceGray}},
+		{name: "paletted png with transparency", data: encode(palette, internal.FormatPng), format: internal.FormatPng,
+			want: ImageInfo{Width: 30, Height: 20, Frames: 1, HasAlpha: true, ColorSpace: ColorSpaceRGB}},
+		{name: "jpeg rotated by exif", data: testJpegWithMetadata(t, 30, 20, 6), format: internal.FormatJpeg,
+			want: ImageInfo{Width: 20, Height: 30, Frames: 1, HasAlpha: false, ColorSpace: ColorSpaceRGB}},
+		{name: "svg", data: []byte(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 48 24"/>`), format: internal.FormatSvg,
+			want: ImageInfo{Width: 48, Height: 24, Frames: 1, HasAlpha: true, ColorSpace: ColorSpaceRGB}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Inspect(tt.data, tt.format)
+			if err != nil {
+				t.Fatal("expected:", nil, "got:", err)
+			}
+			if got != tt.want {
+				t.Errorf("Inspect() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
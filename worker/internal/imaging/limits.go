@@ -0,0 +1,45 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+)
+
+// ErrImageTooLarge is returned for images whose header declares more pixels than the worker decodes
+var ErrImageTooLarge = errors.New("image too large")
+
+// Limits bound the size of images the worker is willing to decode. A few bytes of compressed data
+// can declare a canvas of gigabytes, so the limits are checked against the header before any
+// pixel buffer is allocated. Zero disables a limit.
+type Limits struct {
+	MaxWidth  int
+	MaxHeight int
+	MaxPixels int
+}
+
+// Check decodes just the header of data and rejects images exceeding the limits
+func (l Limits) Check(data []byte) error {
+	conf, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("decoding header: %w", err)
+	}
+	return l.checkSize(conf.Width, conf.Height)
+}
+
+// checkSize rejects images of the given size if they exceed the limits
+func (l Limits) checkSize(width, height int) error {
+	if l.MaxWidth > 0 && width > l.MaxWidth {
+		return fmt.Errorf("%w: width %d exceeds %d", ErrImageTooLarge, width, l.MaxWidth)
+	}
+	if l.MaxHeight > 0 && height > l.MaxHeight {
+		return fmt.Errorf("%w: height %d exceeds %d", ErrImageTooLarge, height, l.MaxHeight)
+	}
+	// int64 because width times height overflows 32 bit ints for crafted headers
+	if l.MaxPixels > 0 && int64(width)*int64(height) > int64(l.MaxPixels) {
+		return fmt.Errorf("%w: %dx%d exceeds %d pixels", ErrImageTooLarge, width, height, l.MaxPixels)
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/phips4/img-proxy/worker/internal"
+	"image"
+	"image/png"
+	"testing"
+)
+
+// pngHeader returns a png which declares w x h pixels but carries no image data at all
+func pngHeader(w, h int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(w))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(h))
+	ihdr[8] = 8 // bit depth
+	ihdr[9] = 6 // RGBA
+	writePngChunk(&buf, "IHDR", ihdr)
+	return buf.Bytes()
+}
+
+// jpegHeader returns a JFIF jpeg which ends after the start of frame declaring w x h pixels
+func jpegHeader(w, h int) []byte {
+	jfif := []byte("JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00")
+	sof := []byte{8, byte(h >> 8), byte(h), byte(w >> 8), byte(w), 3, 1, 0x22, 0, 2, 0x11, 1, 3, 0x11, 1}
+	data := append([]byte{0xff, 0xd8}, jpegSegment(0xe0, jfif)...)
+	return append(data, jpegSegment(0xc0, sof)...)
+}
+
+func TestLimits_Check(t *testing.T) {
+	limits := Limits{MaxWidth: 10000, MaxHeight: 10000, MaxPixels: 50_000_000}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{name: "png within limits", data: pngHeader(4000, 3000), wantErr: false},
+		{name: "png bomb", data: pngHeader(50000, 50000), wantErr: true},
+		{name: "png too wide", data: pngHeader(10001, 10), wantErr: true},
+		{name: "png too tall", data: pngHeader(10, 10001), wantErr: true},
+		{name: "png too many pixels", data: pngHeader(10000, 5001), wantErr: true},
+		{name: "jpeg within limits", data: jpegHeader(4000, 3000), wantErr: false},
+		{name: "jpeg bomb", data: jpegHeader(65000, 65000), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := limits.Check(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrImageTooLarge) {
+				t.Errorf("Check() error = %v, want %v", err, ErrImageTooLarge)
+			}
+		})
+	}
+}
+
+func TestProcess_Limits(t *testing.T) {
+	p := NewProcessor(ProcessorConfig{Limits: Limits{MaxPixels: 1000}})
+
+	_, _, err := p.Process(context.Background(), pngHeader(50000, 50000), "png", Options{Width: 10})
+	if !errors.Is(err, ErrImageTooLarge) {
+		t.Error("expected:", ErrImageTooLarge, "got:", err)
+	}
+}
+
+func TestProcess_TargetLimits(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	p := NewProcessor(ProcessorConfig{Limits: Limits{MaxPixels: 10000}})
+
+	// a tiny original must not be scaled to a canvas beyond the limits
+	_, _, err := p.Process(context.Background(), buf.Bytes(), internal.FormatPng, Options{Width: 8192, Height: 8192, Fit: FitFill})
+	if !errors.Is(err, ErrImageTooLarge) {
+		t.Error("expected:", ErrImageTooLarge, "got:", err)
+	}
+
+	if _, _, err := p.Process(context.Background(), buf.Bytes(), internal.FormatPng, Options{Width: 100, Height: 100, Fit: FitFill}); err != nil {
+		t.Error("expected:", nil, "got:", err)
+	}
+}
@@ -0,0 +1,486 @@
+package imaging
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"github.com/phips4/img-proxy/worker/internal"
+	"golang.org/x/image/draw"
+	"hash/crc32"
+	"image"
+	"io"
+	"sort"
+)
+
+var errMalformed = errors.New("malformed image structure")
+
+const (
+	exifHeader    = "Exif\x00\x00"
+	xmpHeader     = "http://ns.adobe.com/xap/1.0/\x00"
+	xmpExtHeader  = "http://ns.adobe.com/xmp/extension/\x00"
+	iccHeader     = "ICC_PROFILE\x00"
+	iptcHeader    = "Photoshop 3.0\x00"
+	pngXmpKeyword = "XML:com.adobe.xmp"
+	// the data of a jpeg segment is limited by its 16 bit length field which includes itself
+	maxSegmentData = 0xffff - 2
+	// maxICCSize bounds the decompressed profile of a png, a few bytes of zlib data can inflate to
+	// gigabytes. Real profiles are far smaller.
+	maxICCSize = 4 << 20
+)
+
+// Metadata is what the worker reads from the metadata of an image before stripping it
+type Metadata struct {
+	// Orientation is the EXIF orientation from 1 to 8, 1 if the image has none
+	Orientation int
+	// ICC is the embedded color profile
+	ICC []byte
+}
+
+// ReadMetadata extracts the orientation and color profile of a jpeg, png or webp image
+func ReadMetadata(data []byte, format internal.ImageFormat) Metadata {
+	md := Metadata{Orientation: 1}
+
+	switch format {
+	case internal.FormatJpeg:
+		var iccChunks [][]byte
+		_ = walkJpeg(data, func(marker byte, payload []byte) bool {
+			switch {
+			case marker == 0xe1 && bytes.HasPrefix(payload, []byte(exifHeader)):
+				md.Orientation = exifOrientation(payload[len(exifHeader):])
+			case marker == 0xe2 && bytes.HasPrefix(payload, []byte(iccHeader)) && len(payload) > len(iccHeader)+2:
+				// chunks are prefixed with their sequence number, starting at 1
+				iccChunks = append(iccChunks, payload[len(iccHeader):])
+			}
+			return true
+		})
+		sort.SliceStable(iccChunks, func(i, j int) bool { return iccChunks[i][0] < iccChunks[j][0] })
+		for _, c := range iccChunks {
+			md.ICC = append(md.ICC, c[2:]...)
+		}
+	case internal.FormatPng:
+		_ = walkPng(data, func(typ string, chunk []byte) bool {
+			switch typ {
+			case "eXIf":
+				md.Orientation = exifOrientation(chunk)
+			case "iCCP":
+				md.ICC = pngICC(chunk)
+			}
+			return true
+		})
+	case internal.FormatWebp:
+		_ = walkWebp(data, func(fourCC string, chunk []byte) bool {
+			switch fourCC {
+			case "EXIF":
+				// some encoders keep the jpeg header in front of the TIFF data
+				md.Orientation = exifOrientation(bytes.TrimPrefix(chunk, []byte(exifHeader)))
+			case "ICCP":
+				md.ICC = append([]byte{}, chunk...)
+			}
+			return true
+		})
+	}
+
+	return md
+}
+
+// StripMetadata removes EXIF, XMP and IPTC data and unless keepICC the color profile from a jpeg,
+// png or webp image without re-encoding it. It returns the names of the removed blocks.
+func StripMetadata(data []byte, format internal.ImageFormat, keepICC bool) ([]byte, []string, error) {
+	var removed []string
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+
+	switch format {
+	case internal.FormatJpeg:
+		out.Write(data[:2])
+		err := walkJpeg(data, func(marker byte, payload []byte) bool {
+			name := jpegMetadataName(marker, payload)
+			if name == "" || name == "icc" && keepICC {
+				return true
+			}
+			removed = append(removed, name)
+			return false
+		}, out)
+		if err != nil {
+			return nil, nil, err
+		}
+	case internal.FormatPng:
+		out.Write(data[:8])
+		err := walkPng(data, func(typ string, chunk []byte) bool {
+			name := pngMetadataName(typ, chunk)
+			if name == "" || name == "icc" && keepICC {
+				return true
+			}
+			removed = append(removed, name)
+			return false
+		}, out)
+		if err != nil {
+			return nil, nil, err
+		}
+	case internal.FormatWebp:
+		out.Write(data[:12])
+		err := walkWebp(data, func(fourCC string, chunk []byte) bool {
+			name := webpMetadataName(fourCC)
+			if name == "" || name == "icc" && keepICC {
+				return true
+			}
+			removed = append(removed, name)
+			return false
+		}, out)
+		if err != nil {
+			return nil, nil, err
+		}
+	default:
+		return data, nil, nil
+	}
+
+	if len(removed) == 0 {
+		return data, nil, nil
+	}
+	if format == internal.FormatWebp {
+		return fixWebpHeader(out.Bytes(), keepICC), removed, nil
+	}
+	return out.Bytes(), removed, nil
+}
+
+// EmbedICC adds a color profile to a jpeg or png image which was encoded without one
+func EmbedICC(data []byte, format internal.ImageFormat, icc []byte) ([]byte, error) {
+	if len(icc) == 0 {
+		return data, nil
+	}
+
+	var out bytes.Buffer
+	switch format {
+	case internal.FormatJpeg:
+		if len(data) < 2 {
+			return nil, errMalformed
+		}
+		// profiles larger than a segment are split, every chunk carries its sequence number and the total
+		chunkSize := maxSegmentData - len(iccHeader) - 2
+		count := (len(icc) + chunkSize - 1) / chunkSize
+		if count > 255 {
+			return nil, errors.New("icc profile too large")
+		}
+		out.Write(data[:2])
+		for i := 0; i < count; i++ {
+			chunk := icc[i*chunkSize:]
+			if len(chunk) > chunkSize {
+				chunk = chunk[:chunkSize]
+			}
+			segmentLen := 2 + len(iccHeader) + 2 + len(chunk)
+			out.Write([]byte{0xff, 0xe2, byte(segmentLen >> 8), byte(segmentLen)})
+			out.WriteString(iccHeader)
+			out.Write([]byte{byte(i + 1), byte(count)})
+			out.Write(chunk)
+		}
+		out.Write(data[2:])
+	case internal.FormatPng:
+		// iCCP has to come before the image data, right after IHDR is always fine
+		const ihdrEnd = 8 + 4 + 4 + 13 + 4
+		if len(data) < ihdrEnd {
+			return nil, errMalformed
+		}
+		var compressed bytes.Buffer
+		zw := zlib.NewWriter(&compressed)
+		if _, err := zw.Write(icc); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		chunk := append([]byte("icc\x00\x00"), compressed.Bytes()...)
+
+		out.Write(data[:ihdrEnd])
+		writePngChunk(&out, "iCCP", chunk)
+		out.Write(data[ihdrEnd:])
+	default:
+		return data, nil
+	}
+
+	return out.Bytes(), nil
+}
+
+// applyOrientation rotates and mirrors img so it is displayed upright without its EXIF orientation
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	// the pixels are moved as a whole, going through At and Set for each of them is far too slow
+	src, ok := img.(*image.RGBA)
+	if !ok {
+		src = image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+		draw.Draw(src, src.Rect, img, img.Bounds().Min, draw.Src)
+	}
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	// orientations 5 to 8 swap width and height
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		row := src.Pix[y*src.Stride : y*src.Stride+w*4]
+		switch orientation {
+		case 4: // mirrored vertically
+			copy(dst.Pix[(h-1-y)*dst.Stride:], row)
+			continue
+		case 2, 3: // mirrored horizontally, rotated 180° is mirrored both ways
+			dy := y
+			if orientation == 3 {
+				dy = h - 1 - y
+			}
+			out := dst.Pix[dy*dst.Stride:]
+			for x := 0; x < w; x++ {
+				copy(out[(w-1-x)*4:(w-x)*4], row[x*4:x*4+4])
+			}
+			continue
+		}
+
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 5: // mirrored along the top left to bottom right diagonal
+				dx, dy = y, x
+			case 6: // rotated 90° clockwise
+				dx, dy = h-1-y, x
+			case 7: // mirrored along the top right to bottom left diagonal
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90° counter clockwise
+				dx, dy = y, w-1-x
+			}
+			i := dy*dst.Stride + dx*4
+			copy(dst.Pix[i:i+4], row[x*4:x*4+4])
+		}
+	}
+
+	return dst
+}
+
+// walkJpeg calls fn for every marker segment in front of the image data. Segments for which fn
+// returns false are not copied to out, if given.
+func walkJpeg(data []byte, fn func(marker byte, payload []byte) bool, out ...io.Writer) error {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return errMalformed
+	}
+
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xff {
+			return errMalformed
+		}
+		if data[i+1] == 0xff {
+			// markers may be padded with fill bytes
+			i++
+			continue
+		}
+		marker := data[i+1]
+		if marker == 0xda || marker == 0xd9 {
+			// start of scan or end of image, the rest is image data
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return errMalformed
+		}
+
+		segment := data[i : i+2+length]
+		if fn(marker, segment[4:]) && len(out) > 0 {
+			if _, err := out[0].Write(segment); err != nil {
+				return err
+			}
+		}
+		i += 2 + length
+	}
+
+	if len(out) > 0 {
+		if _, err := out[0].Write(data[i:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkPng calls fn for every chunk. Chunks for which fn returns false are not copied to out, if given.
+func walkPng(data []byte, fn func(typ string, chunk []byte) bool, out ...io.Writer) error {
+	if len(data) < 8 || string(data[:8]) != "\x89PNG\r\n\x1a\n" {
+		return errMalformed
+	}
+
+	i := 8
+	for i+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		if length < 0 || i+12+length > len(data) {
+			return errMalformed
+		}
+		typ := string(data[i+4 : i+8])
+
+		if fn(typ, data[i+8:i+8+length]) && len(out) > 0 {
+			if _, err := out[0].Write(data[i : i+12+length]); err != nil {
+				return err
+			}
+		}
+		i += 12 + length
+
+		if typ == "IEND" {
+			break
+		}
+	}
+	return nil
+}
+
+// walkWebp calls fn for every chunk of the RIFF container of a webp image, chunks for which fn returns
+// true are written to out
+func walkWebp(data []byte, fn func(fourCC string, chunk []byte) bool, out ...io.Writer) error {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return errMalformed
+	}
+
+	i := 12
+	for i+8 <= len(data) {
+		length := int(binary.LittleEndian.Uint32(data[i+4:]))
+		// chunks are padded to an even length
+		end := i + 8 + length + length&1
+		if length < 0 || i+8+length > len(data) {
+			return errMalformed
+		}
+		if end > len(data) {
+			end = len(data)
+		}
+
+		if fn(string(data[i:i+4]), data[i+8:i+8+length]) && len(out) > 0 {
+			if _, err := out[0].Write(data[i:end]); err != nil {
+				return err
+			}
+		}
+		i = end
+	}
+	return nil
+}
+
+// fixWebpHeader updates the RIFF size and the feature flags of the extended header after metadata
+// chunks were removed
+func fixWebpHeader(data []byte, keepICC bool) []byte {
+	binary.LittleEndian.PutUint32(data[4:], uint32(len(data)-8))
+	if len(data) >= 21 && string(data[12:16]) == "VP8X" {
+		const iccFlag, exifFlag, xmpFlag = 0x20, 0x08, 0x04
+		flags := data[20] &^ (exifFlag | xmpFlag)
+		if !keepICC {
+			flags &^= iccFlag
+		}
+		data[20] = flags
+	}
+	return data
+}
+
+func writePngChunk(w io.Writer, typ string, chunk []byte) {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(chunk)))
+	copy(header[4:], typ)
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(chunk)
+
+	_, _ = w.Write(header[:])
+	_, _ = w.Write(chunk)
+	_ = binary.Write(w, binary.BigEndian, crc.Sum32())
+}
+
+func jpegMetadataName(marker byte, payload []byte) string {
+	switch {
+	case marker == 0xe1 && bytes.HasPrefix(payload, []byte(exifHeader)):
+		return "exif"
+	case marker == 0xe1 && (bytes.HasPrefix(payload, []byte(xmpHeader)) || bytes.HasPrefix(payload, []byte(xmpExtHeader))):
+		return "xmp"
+	case marker == 0xe2 && bytes.HasPrefix(payload, []byte(iccHeader)):
+		return "icc"
+	case marker == 0xed && bytes.HasPrefix(payload, []byte(iptcHeader)):
+		return "iptc"
+	}
+	return ""
+}
+
+func pngMetadataName(typ string, chunk []byte) string {
+	switch typ {
+	case "eXIf":
+		return "exif"
+	case "iCCP":
+		return "icc"
+	case "iTXt", "tEXt", "zTXt":
+		if bytes.HasPrefix(chunk, []byte(pngXmpKeyword+"\x00")) {
+			return "xmp"
+		}
+	}
+	return ""
+}
+
+func webpMetadataName(fourCC string) string {
+	switch fourCC {
+	case "EXIF":
+		return "exif"
+	case "XMP ":
+		return "xmp"
+	case "ICCP":
+		return "icc"
+	}
+	return ""
+}
+
+// pngICC decompresses the profile of an iCCP chunk: name, null separator, compression method, zlib data
+func pngICC(chunk []byte) []byte {
+	sep := bytes.IndexByte(chunk, 0)
+	if sep < 0 || sep+2 > len(chunk) {
+		return nil
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(chunk[sep+2:]))
+	if err != nil {
+		return nil
+	}
+	defer zr.Close()
+
+	// one byte more than allowed tells a profile at the limit from a larger one
+	icc, err := io.ReadAll(io.LimitReader(zr, maxICCSize+1))
+	if err != nil || len(icc) > maxICCSize {
+		return nil
+	}
+	return icc
+}
+
+// exifOrientation reads the orientation tag from the first IFD of TIFF structured EXIF data
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			return 1
+		}
+	}
+
+	return 1
+}
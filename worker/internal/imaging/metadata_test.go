@@ -0,0 +1,281 @@
+package imaging
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"github.com/phips4/img-proxy/worker/internal"
+	"golang.org/x/image/webp"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"reflect"
+	"testing"
+)
+
+// exifWithOrientation returns little endian TIFF data with a single orientation entry
+func exifWithOrientation(o int) []byte {
+	tiff := []byte("II*\x00\x08\x00\x00\x00")
+	entry := make([]byte, 2+12+4)
+	binary.LittleEndian.PutUint16(entry[0:], 1)
+	binary.LittleEndian.PutUint16(entry[2:], 0x0112)
+	binary.LittleEndian.PutUint16(entry[4:], 3)
+	binary.LittleEndian.PutUint32(entry[6:], 1)
+	binary.LittleEndian.PutUint16(entry[10:], uint16(o))
+	return append(tiff, entry...)
+}
+
+func jpegSegment(marker byte, payload []byte) []byte {
+	length := len(payload) + 2
+	return append([]byte{0xff, marker, byte(length >> 8), byte(length)}, payload...)
+}
+
+// testJpegWithMetadata encodes a w x h jpeg and inserts EXIF, XMP and ICC segments after SOI
+func testJpegWithMetadata(t *testing.T, w, h, orientation int) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, w, h)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	out := append([]byte{}, buf.Bytes()[:2]...)
+	out = append(out, jpegSegment(0xe1, append([]byte(exifHeader), exifWithOrientation(orientation)...))...)
+	out = append(out, jpegSegment(0xe1, []byte(xmpHeader+"<x:xmpmeta/>"))...)
+	out = append(out, jpegSegment(0xe2, []byte(iccHeader+"\x01\x01profile"))...)
+	return append(out, buf.Bytes()[2:]...)
+}
+
+func TestReadMetadata_Jpeg(t *testing.T) {
+	md := ReadMetadata(testJpegWithMetadata(t, 4, 2, 6), internal.FormatJpeg)
+	if md.Orientation != 6 {
+		t.Error("expected:", 6, "got:", md.Orientation)
+	}
+	if string(md.ICC) != "profile" {
+		t.Error("expected:", "profile", "got:", string(md.ICC))
+	}
+}
+
+func TestStripMetadata(t *testing.T) {
+	data := testJpegWithMetadata(t, 4, 2, 1)
+
+	tests := []struct {
+		name        string
+		keepICC     bool
+		wantRemoved []string
+		wantICC     string
+	}{
+		{name: "strip all", keepICC: false, wantRemoved: []string{"exif", "xmp", "icc"}, wantICC: ""},
+		{name: "keep icc", keepICC: true, wantRemoved: []string{"exif", "xmp"}, wantICC: "profile"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, removed, err := StripMetadata(data, internal.FormatJpeg, tt.keepICC)
+			if err != nil {
+				t.Fatal("expected:", nil, "got:", err)
+			}
+			if !reflect.DeepEqual(removed, tt.wantRemoved) {
+				t.Errorf("StripMetadata() got = %v, want %v", removed, tt.wantRemoved)
+			}
+			if md := ReadMetadata(out, internal.FormatJpeg); md.Orientation != 1 || string(md.ICC) != tt.wantICC {
+				t.Errorf("StripMetadata() left metadata %+v", md)
+			}
+			if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+				t.Error("expected:", nil, "got:", err)
+			}
+		})
+	}
+}
+
+func TestStripMetadata_Png(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+	data, err := EmbedICC(buf.Bytes(), internal.FormatPng, []byte("profile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md := ReadMetadata(data, internal.FormatPng); string(md.ICC) != "profile" {
+		t.Error("expected:", "profile", "got:", string(md.ICC))
+	}
+
+	out, removed, err := StripMetadata(data, internal.FormatPng, false)
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if !reflect.DeepEqual(removed, []string{"icc"}) {
+		t.Error("expected:", []string{"icc"}, "got:", removed)
+	}
+	if !bytes.Equal(out, buf.Bytes()) {
+		t.Error("expected:", "bytes without iCCP chunk", "got:", len(out), "bytes")
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// a 2x1 image with a red pixel on the left
+	src := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	src.Set(0, 0, color.RGBA{R: 255, A: 255})
+
+	tests := []struct {
+		orientation int
+		wantW       int
+		wantH       int
+		wantRed     image.Point
+	}{
+		{orientation: 1, wantW: 2, wantH: 1, wantRed: image.Pt(0, 0)},
+		{orientation: 2, wantW: 2, wantH: 1, wantRed: image.Pt(1, 0)},
+		{orientation: 3, wantW: 2, wantH: 1, wantRed: image.Pt(1, 0)},
+		{orientation: 6, wantW: 1, wantH: 2, wantRed: image.Pt(0, 0)},
+		{orientation: 8, wantW: 1, wantH: 2, wantRed: image.Pt(0, 1)},
+	}
+	for _, tt := range tests {
+		img := applyOrientation(src, tt.orientation)
+		b := img.Bounds()
+		if b.Dx() != tt.wantW || b.Dy() != tt.wantH {
+			t.Errorf("applyOrientation(%d) got = %dx%d, want %dx%d", tt.orientation, b.Dx(), b.Dy(), tt.wantW, tt.wantH)
+		}
+		if r, _, _, _ := img.At(tt.wantRed.X, tt.wantRed.Y).RGBA(); r == 0 {
+			t.Errorf("applyOrientation(%d) red pixel not at %v", tt.orientation, tt.wantRed)
+		}
+	}
+}
+
+func TestApplyOrientation_Pixels(t *testing.T) {
+	// every pixel of a 3x2 sub-image is distinct, its bounds do not start at the origin
+	full := image.NewRGBA(image.Rect(0, 0, 5, 4))
+	for i := range full.Pix {
+		full.Pix[i] = uint8(i*7 + 1)
+	}
+	for i := 3; i < len(full.Pix); i += 4 {
+		full.Pix[i] = 255
+	}
+	nrgba := image.NewNRGBA(full.Rect)
+	copy(nrgba.Pix, full.Pix)
+	w, h := 3, 2
+
+	for orientation := 2; orientation <= 8; orientation++ {
+		for _, src := range []image.Image{full.SubImage(image.Rect(1, 1, 4, 3)), nrgba.SubImage(image.Rect(1, 1, 4, 3))} {
+			checkOrientation(t, src, orientation, w, h)
+		}
+	}
+}
+
+// checkOrientation compares every pixel of applyOrientation with where the orientation moves it
+func checkOrientation(t *testing.T, src image.Image, orientation, w, h int) {
+	img := applyOrientation(src, orientation)
+	b := src.Bounds()
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			want := color.RGBAModel.Convert(src.At(b.Min.X+x, b.Min.Y+y))
+			if got := color.RGBAModel.Convert(img.At(dx, dy)); got != want {
+				t.Errorf("applyOrientation(%d) pixel %d,%d got = %v, want %v", orientation, x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestProcess_Orientation(t *testing.T) {
+	data := testJpegWithMetadata(t, 40, 20, 6)
+
+	out, _, err := NewProcessor(ProcessorConfig{}).Process(context.Background(), data, internal.FormatJpeg, Options{})
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+
+	conf, err := jpeg.DecodeConfig(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if conf.Width != 20 || conf.Height != 40 {
+		t.Error("expected:", "20x40", "got:", conf.Width, conf.Height)
+	}
+	if md := ReadMetadata(out, internal.FormatJpeg); md.Orientation != 1 || md.ICC != nil {
+		t.Error("expected:", "no metadata", "got:", md)
+	}
+}
+
+func webpChunk(fourCC string, payload []byte) []byte {
+	chunk := []byte(fourCC)
+	chunk = binary.LittleEndian.AppendUint32(chunk, uint32(len(payload)))
+	chunk = append(chunk, payload...)
+	if len(payload)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+func TestStripMetadata_Webp(t *testing.T) {
+	// extended 1x1 webp with EXIF and an odd sized XMP chunk around the image data of testWebp
+	const iccFlag, exifFlag, xmpFlag = 0x20, 0x08, 0x04
+	vp8x := webpChunk("VP8X", []byte{iccFlag | exifFlag | xmpFlag, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	body := append([]byte("WEBP"), vp8x...)
+	body = append(body, webpChunk("ICCP", []byte("profile"))...)
+	body = append(body, testWebp(t)[12:]...)
+	body = append(body, webpChunk("EXIF", exifWithOrientation(1))...)
+	body = append(body, webpChunk("XMP ", []byte("<x:xmpmeta/>"))...)
+	data := append(binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(len(body))), body...)
+
+	if md := ReadMetadata(data, internal.FormatWebp); string(md.ICC) != "profile" {
+		t.Error("expected:", "profile", "got:", string(md.ICC))
+	}
+
+	out, removed, err := StripMetadata(data, internal.FormatWebp, true)
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if !reflect.DeepEqual(removed, []string{"exif", "xmp"}) {
+		t.Error("expected:", []string{"exif", "xmp"}, "got:", removed)
+	}
+	if size := binary.LittleEndian.Uint32(out[4:]); int(size) != len(out)-8 {
+		t.Error("expected:", len(out)-8, "got:", size)
+	}
+	if out[20] != iccFlag {
+		t.Error("expected:", iccFlag, "got:", out[20])
+	}
+	if md := ReadMetadata(out, internal.FormatWebp); string(md.ICC) != "profile" {
+		t.Error("expected:", "profile", "got:", string(md.ICC))
+	}
+	if _, err := webp.Decode(bytes.NewReader(out)); err != nil {
+		t.Error("expected:", nil, "got:", err)
+	}
+}
+
+func TestPngICC_Limit(t *testing.T) {
+	chunk := func(size int) []byte {
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		if _, err := zw.Write(make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return append([]byte("profile\x00\x00"), buf.Bytes()...)
+	}
+
+	if icc := pngICC(chunk(1024)); len(icc) != 1024 {
+		t.Error("expected:", 1024, "got:", len(icc))
+	}
+	// zeros compress about a thousand to one, the chunk itself is small
+	if icc := pngICC(chunk(maxICCSize + 1)); icc != nil {
+		t.Error("expected:", nil, "got:", len(icc), "bytes")
+	}
+}
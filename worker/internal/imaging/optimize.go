@@ -0,0 +1,68 @@
+package imaging
+
+import (
+	"bytes"
+	"github.com/phips4/img-proxy/worker/internal"
+	"github.com/phips4/img-proxy/worker/internal/prom"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"log"
+)
+
+// optimize recompresses an image which would be passed through otherwise. Jpegs are re-encoded at the
+// configured quality, pngs losslessly at the highest compression level. The re-encoded bytes are only
+// used if they are smaller, icc is embedded again if the profile is kept. Other formats are returned
+// as they are.
+func (p *Processor) optimize(data []byte, format internal.ImageFormat, icc []byte) []byte {
+	if format != internal.FormatJpeg && format != internal.FormatPng {
+		return data
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		log.Println("Processor (worker) error decoding image to optimize:", err)
+		return data
+	}
+
+	var buf bytes.Buffer
+	if format == internal.FormatJpeg {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: p.jpegQuality()})
+	} else {
+		err = p.pngEncoder().Encode(&buf, img)
+	}
+	if err != nil {
+		log.Println("Processor (worker) error optimizing image:", err)
+		return data
+	}
+
+	out := buf.Bytes()
+	if p.conf.KeepICC {
+		if out, err = EmbedICC(out, format, icc); err != nil {
+			log.Println("Processor (worker) error embedding color profile:", err)
+			return data
+		}
+	}
+
+	if len(out) >= len(data) {
+		prom.OptimizationSavings.WithLabelValues(string(format)).Observe(0)
+		return data
+	}
+	prom.OptimizationSavings.WithLabelValues(string(format)).Observe(1 - float64(len(out))/float64(len(data)))
+	return out
+}
+
+// jpegQuality is the quality of jpegs whose options do not set one
+func (p *Processor) jpegQuality() int {
+	if p.conf.Optimize && p.conf.OptimizeQuality > 0 {
+		return p.conf.OptimizeQuality
+	}
+	return defaultJpegQuality
+}
+
+func (p *Processor) pngEncoder() *png.Encoder {
+	if p.conf.Optimize {
+		return &png.Encoder{CompressionLevel: png.BestCompression}
+	}
+	return &png.Encoder{}
+}
@@ -0,0 +1,65 @@
+package imaging
+
+import (
+	"bytes"
+	"github.com/phips4/img-proxy/worker/internal"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func TestProcessor_Optimize(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 64; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 4), G: uint8(y * 4), B: uint8(x * y), A: 255})
+		}
+	}
+	encodeJpeg := func(quality int) []byte {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	var uncompressed bytes.Buffer
+	if err := (&png.Encoder{CompressionLevel: png.NoCompression}).Encode(&uncompressed, img); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewProcessor(ProcessorConfig{Optimize: true, OptimizeQuality: 60})
+	tests := []struct {
+		name        string
+		data        []byte
+		format      internal.ImageFormat
+		wantSmaller bool
+	}{
+		{name: "jpeg above target quality", data: encodeJpeg(100), format: internal.FormatJpeg, wantSmaller: true},
+		{name: "jpeg below target quality", data: encodeJpeg(10), format: internal.FormatJpeg, wantSmaller: false},
+		{name: "uncompressed png", data: uncompressed.Bytes(), format: internal.FormatPng, wantSmaller: true},
+		{name: "gif", data: []byte("GIF89a"), format: internal.FormatGif, wantSmaller: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := p.optimize(tt.data, tt.format, nil)
+			if smaller := len(out) < len(tt.data); smaller != tt.wantSmaller {
+				t.Errorf("optimize() got = %d bytes from %d, want smaller %v", len(out), len(tt.data), tt.wantSmaller)
+			}
+			if !tt.wantSmaller && !bytes.Equal(out, tt.data) {
+				t.Error("expected:", "original bytes", "got:", len(out), "bytes")
+			}
+		})
+	}
+
+	// png is recompressed losslessly
+	out := p.optimize(uncompressed.Bytes(), internal.FormatPng, nil)
+	decoded, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if decoded.At(40, 20) != img.At(40, 20) {
+		t.Error("expected:", img.At(40, 20), "got:", decoded.At(40, 20))
+	}
+}
@@ -0,0 +1,364 @@
+package imaging
+
+import (
+	"errors"
+	"fmt"
+	"github.com/phips4/img-proxy/worker/internal"
+	"image"
+	"math"
+	"net/url"
+	"strconv"
+)
+
+// MaxDimension is the largest width or height a variant can be requested with
+const MaxDimension = 8192
+
+var ErrInvalidOptions = errors.New("invalid image options")
+
+// Fit decides how an image is fitted into the requested width and height
+type Fit string
+
+const (
+	// FitContain scales the image to the largest size which fits into the box, keeping the aspect ratio
+	FitContain Fit = "contain"
+	// FitCover scales the image to fill the whole box and crops what is left over
+	FitCover Fit = "cover"
+	// FitFill stretches the image to exactly the requested size
+	FitFill Fit = "fill"
+	// FitInside works like FitContain but never enlarges the image
+	FitInside Fit = "inside"
+)
+
+// Options describe the transformations applied to an original image to produce a variant. The zero
+// value leaves the image untouched.
+type Options struct {
+	Width  int
+	Height int
+	Fit    Fit
+	// Format is the format of the variant, empty keeps the format of the original
+	Format internal.ImageFormat
+	// Quality applies to lossy formats only, 0 uses the default of the encoder
+	Quality int
+	// Crop is cut out of the turned original before it is resized, relative to its top left corner
+	Crop image.Rectangle
+	// Gravity decides which part of the image is kept by FitCover
+	Gravity Gravity
+	// FocusX and FocusY are the focal point for GravityFocal, relative to the image size
+	FocusX float64
+	FocusY float64
+	// Anim decides what happens to the frames of animated images, empty keeps all of them
+	Anim Anim
+	// Frame is the index of the poster frame of AnimPoster, Time picks it by its timestamp in seconds instead
+	Frame int
+	Time  float64
+	// Budget is the largest size of an animated gif variant in bytes, 0 for no limit
+	Budget int
+	// Watermark composites the configured overlay onto the variant
+	Watermark bool
+	// Rotate turns the image clockwise by 90, 180 or 270 degrees before it is cropped and resized
+	Rotate int
+	// Flip mirrors the image after it was rotated
+	Flip Flip
+	// Blur is the radius of a gaussian blur in pixels of the variant
+	Blur float64
+	// Sharpen is the strength of an unsharp mask
+	Sharpen float64
+	// Grayscale removes all colors
+	Grayscale bool
+	// Brightness and Contrast are between -100 and 100, 0 leaves the image as it is
+	Brightness int
+	Contrast   int
+}
+
+// ParseOptions reads the options from query parameters, unknown parameters are ignored
+func ParseOptions(q url.Values) (Options, error) {
+	var o Options
+	var err error
+
+	if o.Width, err = parseDimension(q.Get("w")); err != nil {
+		return Options{}, err
+	}
+	if o.Height, err = parseDimension(q.Get("h")); err != nil {
+		return Options{}, err
+	}
+
+	switch fit := Fit(q.Get("fit")); fit {
+	case "":
+	case FitContain, FitCover, FitFill, FitInside:
+		o.Fit = fit
+	default:
+		return Options{}, fmt.Errorf("%w: unknown fit %s", ErrInvalidOptions, fit)
+	}
+
+	switch format := internal.ImageFormat(q.Get("format")); format {
+	case "":
+	case "jpg":
+		o.Format = internal.FormatJpeg
+	case internal.FormatJpeg, internal.FormatPng, internal.FormatGif:
+		o.Format = format
+	default:
+		// there is no pure Go webp encoder, so webp is only supported as input
+		return Options{}, fmt.Errorf("%w: unsupported output format %s", ErrInvalidOptions, format)
+	}
+
+	if v := q.Get("quality"); v != "" {
+		if o.Quality, err = strconv.Atoi(v); err != nil || o.Quality < 1 || o.Quality > 100 {
+			return Options{}, fmt.Errorf("%w: quality must be between 1 and 100", ErrInvalidOptions)
+		}
+	}
+
+	if v := q.Get("crop"); v != "" {
+		if o.Crop, err = parseCrop(v); err != nil {
+			return Options{}, err
+		}
+	}
+
+	switch gravity := Gravity(q.Get("gravity")); {
+	case gravity == "":
+	case gravities[gravity]:
+		o.Gravity = gravity
+	default:
+		return Options{}, fmt.Errorf("%w: unknown gravity %s", ErrInvalidOptions, gravity)
+	}
+
+	fx, fy := q.Get("fx"), q.Get("fy")
+	if fx != "" || fy != "" {
+		if o.Gravity != "" && o.Gravity != GravityFocal {
+			return Options{}, fmt.Errorf("%w: a focal point cannot be combined with gravity %s", ErrInvalidOptions, o.Gravity)
+		}
+		if o.FocusX, err = parseFocus(fx); err != nil {
+			return Options{}, err
+		}
+		if o.FocusY, err = parseFocus(fy); err != nil {
+			return Options{}, err
+		}
+		o.Gravity = GravityFocal
+	} else if o.Gravity == GravityFocal {
+		return Options{}, fmt.Errorf("%w: gravity focal requires fx and fy", ErrInvalidOptions)
+	}
+
+	switch anim := Anim(q.Get("anim")); anim {
+	case "", AnimAll:
+	case AnimFirst, AnimPoster:
+		o.Anim = anim
+	default:
+		return Options{}, fmt.Errorf("%w: anim must be all, first or poster", ErrInvalidOptions)
+	}
+
+	frame, at := q.Get("frame"), q.Get("time")
+	if frame != "" || at != "" {
+		if frame != "" && at != "" {
+			return Options{}, fmt.Errorf("%w: frame and time cannot be combined", ErrInvalidOptions)
+		}
+		if o.Anim != "" && o.Anim != AnimPoster {
+			return Options{}, fmt.Errorf("%w: frame and time require anim poster", ErrInvalidOptions)
+		}
+		o.Anim = AnimPoster
+		if frame != "" {
+			if o.Frame, err = strconv.Atoi(frame); err != nil || o.Frame < 0 {
+				return Options{}, fmt.Errorf("%w: frame must be a frame index", ErrInvalidOptions)
+			}
+		}
+		if at != "" {
+			if o.Time, err = strconv.ParseFloat(at, 64); err != nil || o.Time < 0 || o.Time > MaxPosterTime {
+				return Options{}, fmt.Errorf("%w: time must be between 0 and %d seconds", ErrInvalidOptions, MaxPosterTime)
+			}
+			// gifs time their frames in hundredths of a second
+			o.Time = math.Round(o.Time*100) / 100
+		}
+	}
+
+	if v := q.Get("budget"); v != "" {
+		if o.Budget, err = strconv.Atoi(v); err != nil || o.Budget < MinBudget || o.Budget > MaxBudget {
+			return Options{}, fmt.Errorf("%w: budget must be between %d and %d bytes", ErrInvalidOptions, MinBudget, MaxBudget)
+		}
+	}
+
+	if v := q.Get("watermark"); v != "" {
+		if o.Watermark, err = strconv.ParseBool(v); err != nil {
+			return Options{}, fmt.Errorf("%w: watermark must be true or false", ErrInvalidOptions)
+		}
+	}
+
+	switch rotate := q.Get("rotate"); rotate {
+	case "", "0":
+	case "90", "180", "270":
+		o.Rotate, _ = strconv.Atoi(rotate)
+	default:
+		return Options{}, fmt.Errorf("%w: rotate must be 0, 90, 180 or 270", ErrInvalidOptions)
+	}
+
+	switch flip := Flip(q.Get("flip")); flip {
+	case "":
+	case FlipHorizontal, FlipVertical, FlipBoth:
+		o.Flip = flip
+	case "vh":
+		o.Flip = FlipBoth
+	default:
+		return Options{}, fmt.Errorf("%w: flip must be h, v or hv", ErrInvalidOptions)
+	}
+
+	if o.Blur, err = parseStrength(q.Get("blur"), "blur", MaxBlur); err != nil {
+		return Options{}, err
+	}
+	if o.Sharpen, err = parseStrength(q.Get("sharpen"), "sharpen", MaxSharpen); err != nil {
+		return Options{}, err
+	}
+
+	if v := q.Get("grayscale"); v != "" {
+		if o.Grayscale, err = strconv.ParseBool(v); err != nil {
+			return Options{}, fmt.Errorf("%w: grayscale must be true or false", ErrInvalidOptions)
+		}
+	}
+
+	if o.Brightness, err = parsePercent(q.Get("brightness"), "brightness"); err != nil {
+		return Options{}, err
+	}
+	if o.Contrast, err = parsePercent(q.Get("contrast"), "contrast"); err != nil {
+		return Options{}, err
+	}
+
+	return o.normalize(), nil
+}
+
+// parseStrength parses a number between 0 and max, rounded to one decimal so nearly equal values share
+// a variant
+func parseStrength(v, name string, max float64) (float64, error) {
+	if v == "" {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 || f > max {
+		return 0, fmt.Errorf("%w: %s must be between 0 and %g", ErrInvalidOptions, name, max)
+	}
+	return math.Round(f*10) / 10, nil
+}
+
+func parsePercent(v, name string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil || i < -100 || i > 100 {
+		return 0, fmt.Errorf("%w: %s must be between -100 and 100", ErrInvalidOptions, name)
+	}
+	return i, nil
+}
+
+func parseDimension(v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil || i <= 0 || i > MaxDimension {
+		return 0, fmt.Errorf("%w: dimension must be between 1 and %d", ErrInvalidOptions, MaxDimension)
+	}
+	return i, nil
+}
+
+// normalize drops settings without effect, so equal transformations share one variant
+func (o Options) normalize() Options {
+	if o.Width == 0 && o.Height == 0 {
+		o.Fit = ""
+	} else if o.Fit == "" {
+		o.Fit = FitContain
+	}
+	if o.Format == internal.FormatPng || o.Format == internal.FormatGif {
+		o.Quality = 0
+	}
+	// gravity only matters if a cover fit has to cut something off
+	if o.Fit != FitCover || o.Width == 0 || o.Height == 0 || o.Gravity == GravityCenter {
+		o.Gravity = ""
+	}
+	if o.Gravity != GravityFocal {
+		o.FocusX, o.FocusY = 0, 0
+	}
+	// stills have no frames to drop
+	if o.Anim == AnimFirst || o.Anim == AnimPoster {
+		o.Budget = 0
+	}
+	return o
+}
+
+// filtered reports whether o turns the image or changes its pixels
+func (o Options) filtered() bool {
+	return o.Rotate != 0 || o.Flip != "" || o.Blur > 0 || o.Sharpen > 0 || o.Grayscale || o.Brightness != 0 ||
+		o.Contrast != 0
+}
+
+// IsZero reports whether the options leave the image untouched
+func (o Options) IsZero() bool {
+	return o == Options{}
+}
+
+// Values encodes the options as query parameters, the inverse of ParseOptions
+func (o Options) Values() url.Values {
+	q := url.Values{}
+	if o.Width > 0 {
+		q.Set("w", strconv.Itoa(o.Width))
+	}
+	if o.Height > 0 {
+		q.Set("h", strconv.Itoa(o.Height))
+	}
+	if o.Fit != "" {
+		q.Set("fit", string(o.Fit))
+	}
+	if o.Format != "" {
+		q.Set("format", string(o.Format))
+	}
+	if o.Quality > 0 {
+		q.Set("quality", strconv.Itoa(o.Quality))
+	}
+	if !o.Crop.Empty() {
+		q.Set("crop", formatCrop(o.Crop))
+	}
+	if o.Gravity != "" {
+		q.Set("gravity", string(o.Gravity))
+	}
+	if o.Gravity == GravityFocal {
+		q.Set("fx", strconv.FormatFloat(o.FocusX, 'f', -1, 64))
+		q.Set("fy", strconv.FormatFloat(o.FocusY, 'f', -1, 64))
+	}
+	if o.Anim != "" {
+		q.Set("anim", string(o.Anim))
+	}
+	if o.Frame > 0 {
+		q.Set("frame", strconv.Itoa(o.Frame))
+	}
+	if o.Time > 0 {
+		q.Set("time", strconv.FormatFloat(o.Time, 'f', -1, 64))
+	}
+	if o.Budget > 0 {
+		q.Set("budget", strconv.Itoa(o.Budget))
+	}
+	if o.Watermark {
+		q.Set("watermark", "1")
+	}
+	if o.Rotate != 0 {
+		q.Set("rotate", strconv.Itoa(o.Rotate))
+	}
+	if o.Flip != "" {
+		q.Set("flip", string(o.Flip))
+	}
+	if o.Blur > 0 {
+		q.Set("blur", strconv.FormatFloat(o.Blur, 'f', -1, 64))
+	}
+	if o.Sharpen > 0 {
+		q.Set("sharpen", strconv.FormatFloat(o.Sharpen, 'f', -1, 64))
+	}
+	if o.Grayscale {
+		q.Set("grayscale", "1")
+	}
+	if o.Brightness != 0 {
+		q.Set("brightness", strconv.Itoa(o.Brightness))
+	}
+	if o.Contrast != 0 {
+		q.Set("contrast", strconv.Itoa(o.Contrast))
+	}
+	return q
+}
+
+// Key is the normalized representation of the options used to tell variants apart
+func (o Options) Key() string {
+	return o.Values().Encode()
+}
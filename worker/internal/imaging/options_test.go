@@ -0,0 +1,76 @@
+package imaging
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestParseOptions(t *testing.T) {
+	tests := []struct {
+		query   string
+		wantKey string
+		wantErr bool
+	}{
+		{query: "", wantKey: ""},
+		{query: "fit=cover", wantKey: ""},
+		{query: "w=100", wantKey: "fit=contain&w=100"},
+		{query: "h=50&w=100&fit=cover", wantKey: "fit=cover&h=50&w=100"},
+		{query: "w=0", wantErr: true},
+		{query: "w=99999", wantErr: true},
+		{query: "w=abc", wantErr: true},
+		{query: "w=10&fit=stretch", wantErr: true},
+		{query: "format=jpg&quality=70", wantKey: "format=jpeg&quality=70"},
+		{query: "format=png&quality=70", wantKey: "format=png"},
+		{query: "format=webp", wantErr: true},
+		{query: "quality=0", wantErr: true},
+		{query: "crop=10,20,30,40&w=10", wantKey: "crop=10%2C20%2C30%2C40&fit=contain&w=10"},
+		{query: "crop=10,20,0,40", wantErr: true},
+		{query: "w=10&h=10&fit=cover&gravity=center", wantKey: "fit=cover&h=10&w=10"},
+		{query: "w=10&gravity=north", wantKey: "fit=contain&w=10"},
+		{query: "w=10&h=10&fit=cover&fx=0.25&fy=0.7504", wantKey: "fit=cover&fx=0.25&fy=0.75&gravity=focal&h=10&w=10"},
+		{query: "w=10&h=10&fit=cover&fx=0.25", wantErr: true},
+		{query: "w=10&h=10&fit=cover&fx=0.2&fy=0.2&gravity=north", wantErr: true},
+		{query: "gravity=up", wantErr: true},
+		{query: "anim=all", wantKey: ""},
+		{query: "anim=first&w=10", wantKey: "anim=first&fit=contain&w=10"},
+		{query: "anim=last", wantErr: true},
+		{query: "frame=3", wantKey: "anim=poster&frame=3"},
+		{query: "anim=poster&time=1.234", wantKey: "anim=poster&time=1.23"},
+		{query: "anim=poster", wantKey: "anim=poster"},
+		{query: "anim=first&frame=3", wantErr: true},
+		{query: "frame=3&time=1", wantErr: true},
+		{query: "frame=-1", wantErr: true},
+		{query: "time=4000", wantErr: true},
+		{query: "budget=200000", wantKey: "budget=200000"},
+		{query: "anim=first&budget=200000", wantKey: "anim=first"},
+		{query: "budget=10", wantErr: true},
+		{query: "watermark=true", wantKey: "watermark=1"},
+		{query: "watermark=0", wantKey: ""},
+		{query: "watermark=maybe", wantErr: true},
+		{query: "rotate=90&w=10", wantKey: "fit=contain&rotate=90&w=10"},
+		{query: "rotate=0", wantKey: ""},
+		{query: "rotate=360", wantErr: true},
+		{query: "rotate=45", wantErr: true},
+		{query: "flip=vh", wantKey: "flip=hv"},
+		{query: "flip=x", wantErr: true},
+		{query: "blur=2.04&sharpen=0.5", wantKey: "blur=2&sharpen=0.5"},
+		{query: "blur=101", wantErr: true},
+		{query: "sharpen=-1", wantErr: true},
+		{query: "grayscale=true&brightness=-20&contrast=0", wantKey: "brightness=-20&grayscale=1"},
+		{query: "contrast=200", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, _ := url.ParseQuery(tt.query)
+			opts, err := ParseOptions(q)
+			if tt.wantErr != errors.Is(err, ErrInvalidOptions) {
+				t.Errorf("ParseOptions() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if opts.Key() != tt.wantKey {
+				t.Errorf("ParseOptions() key = %v, want %v", opts.Key(), tt.wantKey)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/phips4/img-proxy/worker/internal"
+	"golang.org/x/image/draw"
+	"image"
+	"math"
+	"strings"
+)
+
+const (
+	// placeholderSize is the longer side of the thumbnail placeholders are computed from, the result
+	// is a blur anyway
+	placeholderSize = 32
+	blurHashX       = 4
+	blurHashY       = 3
+	base83Chars     = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+)
+
+// Placeholder computes the BlurHash and the dominant color of an original image in the processing pool
+func (p *Processor) Placeholder(ctx context.Context, data []byte, format internal.ImageFormat) (internal.Placeholder, error) {
+	var ph internal.Placeholder
+	var err error
+	if poolErr := p.run(ctx, func() { ph, err = p.placeholder(data, format) }); poolErr != nil {
+		return internal.Placeholder{}, poolErr
+	}
+	return ph, err
+}
+
+func (p *Processor) placeholder(data []byte, format internal.ImageFormat) (internal.Placeholder, error) {
+	src, err := p.placeholderSource(data, format)
+	if err != nil {
+		return internal.Placeholder{}, err
+	}
+
+	b := src.Bounds()
+	scale := math.Min(1, float64(placeholderSize)/float64(maxInt(b.Dx(), b.Dy())))
+	thumb := image.NewRGBA(image.Rect(0, 0, maxInt(1, int(float64(b.Dx())*scale)), maxInt(1, int(float64(b.Dy())*scale))))
+	draw.ApproxBiLinear.Scale(thumb, thumb.Bounds(), src, b, draw.Src, nil)
+
+	return internal.Placeholder{
+		BlurHash:      blurHash(thumb, blurHashX, blurHashY),
+		DominantColor: dominantColor(thumb),
+	}, nil
+}
+
+// placeholderSource decodes the upright image a placeholder is computed from. Svg images are drawn
+// right at the size of the placeholder.
+func (p *Processor) placeholderSource(data []byte, format internal.ImageFormat) (image.Image, error) {
+	if format == internal.FormatSvg {
+		if !p.conf.Svg {
+			return nil, &internal.UnsupportedMediaError{Reason: "svg rasterization is disabled"}
+		}
+		icon, width, height, err := decodeSvg(data)
+		if err != nil {
+			return nil, err
+		}
+		scale := math.Min(1, placeholderSize/math.Max(width, height))
+		return drawSvg(icon, maxInt(1, int(width*scale)), maxInt(1, int(height*scale))), nil
+	}
+
+	if err := p.conf.Limits.Check(data); err != nil {
+		return nil, err
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", format, err)
+	}
+	md := ReadMetadata(data, format)
+	src, _ = toSRGB(src, md.ICC)
+	return applyOrientation(src, md.Orientation), nil
+}
+
+// blurHash encodes img with xComp x yComp cosine components, see https://blurha.sh
+func blurHash(img *image.RGBA, xComp, yComp int) string {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	factors := make([][3]float64, 0, xComp*yComp)
+	for j := 0; j < yComp; j++ {
+		for i := 0; i < xComp; i++ {
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(w)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(h))
+					c := img.RGBAAt(b.Min.X+x, b.Min.Y+y)
+					f[0] += basis * srgbToLinear(c.R)
+					f[1] += basis * srgbToLinear(c.G)
+					f[2] += basis * srgbToLinear(c.B)
+				}
+			}
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+			scale := norm / float64(w*h)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(encode83((xComp-1)+(yComp-1)*9, 1))
+
+	dc, ac := factors[0], factors[1:]
+	maxValue := 1.0
+	if len(ac) > 0 {
+		actualMax := 0.0
+		for _, f := range ac {
+			actualMax = math.Max(actualMax, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+		quantisedMax := clamp(int(math.Floor(actualMax*166-0.5)), 0, 82)
+		maxValue = float64(quantisedMax+1) / 166
+		sb.WriteString(encode83(quantisedMax, 1))
+	} else {
+		sb.WriteString(encode83(0, 1))
+	}
+
+	sb.WriteString(encode83(linearToSrgb(dc[0])<<16+linearToSrgb(dc[1])<<8+linearToSrgb(dc[2]), 4))
+	for _, f := range ac {
+		quant := func(v float64) int {
+			return clamp(int(math.Floor(signPow(v/maxValue, 0.5)*9+9.5)), 0, 18)
+		}
+		sb.WriteString(encode83(quant(f[0])*19*19+quant(f[1])*19+quant(f[2]), 2))
+	}
+
+	return sb.String()
+}
+
+// dominantColor returns the average color of the most common of 4096 color buckets as #rrggbb,
+// mostly transparent pixels are ignored
+func dominantColor(img *image.RGBA) string {
+	type bucket struct {
+		count   int
+		r, g, b int
+	}
+	buckets := make(map[int]*bucket)
+	var best *bucket
+
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := img.RGBAAt(x, y)
+			if c.A < 128 {
+				continue
+			}
+			key := int(c.R>>4)<<8 | int(c.G>>4)<<4 | int(c.B>>4)
+			bk, ok := buckets[key]
+			if !ok {
+				bk = &bucket{}
+				buckets[key] = bk
+			}
+			bk.count++
+			bk.r, bk.g, bk.b = bk.r+int(c.R), bk.g+int(c.G), bk.b+int(c.B)
+			if best == nil || bk.count > best.count {
+				best = bk
+			}
+		}
+	}
+
+	if best == nil {
+		return "#ffffff"
+	}
+	return fmt.Sprintf("#%02x%02x%02x", best.r/best.count, best.g/best.count, best.b/best.count)
+}
+
+func encode83(value, length int) string {
+	var sb strings.Builder
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		sb.WriteByte(base83Chars[digit])
+	}
+	return sb.String()
+}
+
+func srgbToLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSrgb(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
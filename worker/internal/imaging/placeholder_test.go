@@ -0,0 +1,60 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"github.com/phips4/img-proxy/worker/internal"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestBlurHash_Solid(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{R: 255, A: 255}), image.Point{}, draw.Src)
+
+	got := blurHash(img, 4, 3)
+	// one char size flag for 4x3, one char AC maximum, four chars DC and two chars per AC component
+	if len(got) != 1+1+4+2*11 {
+		t.Error("expected:", 28, "got:", len(got), got)
+	}
+	if !strings.HasPrefix(got, "L") {
+		t.Error("expected:", "size flag L", "got:", got)
+	}
+	// the DC component is the average color, pure red
+	if got[2:6] != "TI:j" {
+		t.Error("expected:", "TI:j", "got:", got[2:6])
+	}
+}
+
+func TestDominantColor(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{B: 255, A: 255}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(0, 0, 2, 2), image.NewUniform(color.RGBA{R: 255, A: 255}), image.Point{}, draw.Src)
+
+	if got := dominantColor(img); got != "#0000ff" {
+		t.Error("expected:", "#0000ff", "got:", got)
+	}
+}
+
+func TestProcessor_Placeholder(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 300, 200))); err != nil {
+		t.Fatal(err)
+	}
+
+	ph, err := NewProcessor(ProcessorConfig{}).Placeholder(context.Background(), buf.Bytes(), internal.FormatPng)
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if len(ph.BlurHash) != 28 {
+		t.Error("expected:", 28, "got:", len(ph.BlurHash), ph.BlurHash)
+	}
+	// fully transparent images have no dominant color
+	if ph.DominantColor != "#ffffff" {
+		t.Error("expected:", "#ffffff", "got:", ph.DominantColor)
+	}
+}
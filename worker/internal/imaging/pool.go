@@ -0,0 +1,57 @@
+package imaging
+
+import (
+	"context"
+	"errors"
+	"github.com/phips4/img-proxy/worker/internal/prom"
+	"time"
+)
+
+// ErrPoolFull is returned if an image cannot even be queued for processing
+var ErrPoolFull = errors.New("processing queue is full")
+
+// Pool bounds the number of images processed at the same time. Callers beyond the concurrency wait
+// in a queue of limited depth, callers beyond that are turned away right away.
+type Pool struct {
+	slots   chan struct{}
+	tickets chan struct{}
+}
+
+func NewPool(concurrency, queueDepth int) *Pool {
+	return &Pool{
+		slots:   make(chan struct{}, concurrency),
+		tickets: make(chan struct{}, concurrency+queueDepth),
+	}
+}
+
+// Do runs fn as soon as a slot is free. It returns ErrPoolFull if the queue is full and the error
+// of ctx if it is done before fn got to run.
+func (p *Pool) Do(ctx context.Context, fn func()) error {
+	select {
+	case p.tickets <- struct{}{}:
+	default:
+		prom.ProcessingRejections.Inc()
+		return ErrPoolFull
+	}
+	defer func() { <-p.tickets }()
+
+	queued := time.Now()
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		prom.ProcessingQueueWait.Observe(time.Since(queued).Seconds())
+		return ctx.Err()
+	}
+	defer func() { <-p.slots }()
+	prom.ProcessingQueueWait.Observe(time.Since(queued).Seconds())
+
+	// the client may have given up while waiting, both cases of the select above could be ready
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	started := time.Now()
+	fn()
+	prom.ProcessingDuration.Observe(time.Since(started).Seconds())
+	return nil
+}
@@ -0,0 +1,53 @@
+package imaging
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPool_Do(t *testing.T) {
+	pool := NewPool(1, 1)
+
+	// occupy the only slot until release is closed
+	running, release := make(chan struct{}), make(chan struct{})
+	go func() {
+		_ = pool.Do(context.Background(), func() {
+			close(running)
+			<-release
+		})
+	}()
+	<-running
+
+	// the second caller waits in the queue until its context is canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	queued := make(chan error)
+	go func() {
+		queued <- pool.Do(ctx, func() { t.Error("expected:", "no call", "got:", "call") })
+	}()
+	// wait until the second caller holds its ticket
+	deadline := time.Now().Add(time.Second * 5)
+	for len(pool.tickets) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected:", 2, "tickets", "got:", len(pool.tickets))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// slot and queue are taken
+	if err := pool.Do(context.Background(), func() {}); !errors.Is(err, ErrPoolFull) {
+		t.Error("expected:", ErrPoolFull, "got:", err)
+	}
+
+	cancel()
+	if err := <-queued; !errors.Is(err, context.Canceled) {
+		t.Error("expected:", context.Canceled, "got:", err)
+	}
+
+	close(release)
+	called := false
+	if err := pool.Do(context.Background(), func() { called = true }); err != nil || !called {
+		t.Error("expected:", "call without error", "got:", called, err)
+	}
+}
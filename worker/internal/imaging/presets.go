@@ -0,0 +1,96 @@
+package imaging
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+)
+
+// formatAuto is the format of presets which lets the gateway negotiate the format with the client
+const formatAuto = "auto"
+
+// Presets are named sets of options. The file is shared with the gateway, which also enforces
+// Only. Workers expand whatever preset the gateway passes on.
+type Presets struct {
+	// Only forbids ad-hoc options, clients can only request presets
+	Only    bool                         `json:"presets_only"`
+	Presets map[string]map[string]string `json:"presets"`
+}
+
+// LoadPresets reads presets from a json file, without a path there are no presets
+func LoadPresets(path string) (*Presets, error) {
+	p := &Presets{}
+	if path == "" {
+		return p, nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading presets: %w", err)
+	}
+	if err := json.Unmarshal(raw, p); err != nil {
+		return nil, fmt.Errorf("parsing presets: %w", err)
+	}
+
+	for name, values := range p.Presets {
+		if _, ok := values["preset"]; ok {
+			return nil, fmt.Errorf("preset %s: presets cannot reference other presets", name)
+		}
+		if _, err := ParseOptions(presetValues(values)); err != nil {
+			return nil, fmt.Errorf("preset %s: %w", name, err)
+		}
+	}
+
+	return p, nil
+}
+
+// Expand replaces the preset parameter of q with the options of the preset. Options set in q
+// explicitly take precedence over the ones of the preset.
+func (p *Presets) Expand(q url.Values) (url.Values, error) {
+	name := q.Get("preset")
+	if name == "" {
+		return q, nil
+	}
+
+	values, ok := p.Presets[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown preset %s", ErrInvalidOptions, name)
+	}
+
+	expanded := presetValues(values)
+	for k, v := range q {
+		// the gateway forwards options it expanded itself, those are equal to the preset anyway
+		if k != "preset" {
+			expanded[k] = v
+		}
+	}
+	return expanded, nil
+}
+
+// ParseOptions expands the preset of q and parses the result
+func (p *Presets) ParseOptions(q url.Values) (Options, error) {
+	expanded, err := p.Expand(q)
+	if err != nil {
+		return Options{}, err
+	}
+	return ParseOptions(expanded)
+}
+
+// presetValues returns the options of a preset as query parameters. The gateway resolves format auto
+// from the Accept header of the client and forwards the result, so it is dropped here.
+func presetValues(values map[string]string) url.Values {
+	q := toValues(values)
+	if q.Get("format") == formatAuto {
+		q.Del("format")
+	}
+	return q
+}
+
+func toValues(m map[string]string) url.Values {
+	q := url.Values{}
+	for k, v := range m {
+		q.Set(k, v)
+	}
+	return q
+}
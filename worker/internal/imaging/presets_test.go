@@ -0,0 +1,41 @@
+package imaging
+
+import (
+	"github.com/phips4/img-proxy/worker/internal"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadPresets_Auto(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "presets.json")
+	if err := os.WriteFile(path, []byte(`{"presets":{"hero":{"w":"800","format":"auto"}}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	presets, err := LoadPresets(path)
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+
+	tests := []struct {
+		name string
+		q    url.Values
+		want internal.ImageFormat
+	}{
+		{name: "direct request", q: url.Values{"preset": {"hero"}}, want: ""},
+		{name: "resolved by the gateway", q: url.Values{"preset": {"hero"}, "format": {"png"}}, want: internal.FormatPng},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := presets.ParseOptions(tt.q)
+			if err != nil {
+				t.Fatal("expected:", nil, "got:", err)
+			}
+			if opts.Width != 800 || opts.Format != tt.want {
+				t.Errorf("ParseOptions() got = %d %q, want %d %q", opts.Width, opts.Format, 800, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,354 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/phips4/img-proxy/worker/internal"
+	"golang.org/x/image/draw"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"log"
+	"strings"
+)
+
+const defaultJpegQuality = 85
+
+// ProcessorConfig holds the worker wide settings of image processing
+type ProcessorConfig struct {
+	// KeepICC keeps the color profile of the original when metadata is stripped
+	KeepICC bool
+	// Debug logs the metadata removed from every image
+	Debug bool
+	// Limits are checked before an image is decoded
+	Limits Limits
+	// MaxFrames is the number of frames of an animation which are processed, the rest is dropped
+	MaxFrames int
+	// Watermark is composited onto variants with the watermark option, nil disables watermarks
+	Watermark *Watermark
+	// Concurrency is the number of images processed at the same time, 0 does not limit it
+	Concurrency int
+	// QueueDepth is the number of images waiting for a slot before new ones are rejected
+	QueueDepth int
+	// Svg rasterizes svg images to png, they are rejected otherwise
+	Svg bool
+	// Optimize recompresses images which are otherwise passed through and encodes variants at the
+	// highest png compression level
+	Optimize bool
+	// OptimizeQuality is the jpeg quality optimized images and variants without explicit quality get
+	OptimizeQuality int
+}
+
+// Processor turns original images into the variants described by Options
+type Processor struct {
+	conf ProcessorConfig
+	pool *Pool
+}
+
+func NewProcessor(conf ProcessorConfig) *Processor {
+	p := &Processor{conf: conf}
+	if conf.Concurrency > 0 {
+		p.pool = NewPool(conf.Concurrency, conf.QueueDepth)
+	}
+	return p
+}
+
+// run runs fn in the processing pool, if there is one
+func (p *Processor) run(ctx context.Context, fn func()) error {
+	if p.pool == nil {
+		fn()
+		return nil
+	}
+	return p.pool.Do(ctx, fn)
+}
+
+// Process applies o to the original image data of the given format and returns the encoded variant.
+// EXIF, XMP and IPTC metadata is always removed, the color profile unless configured otherwise. The
+// EXIF orientation is applied to the pixels, without any other transformation the original bytes are
+// passed through with just the metadata stripped. Images exceeding the limits are rejected with
+// ErrImageTooLarge, even if they would just be passed through. Processing waits for a slot of the
+// pool, ErrPoolFull and the error of ctx are returned if it does not get one.
+func (p *Processor) Process(ctx context.Context, data []byte, format internal.ImageFormat, o Options) ([]byte, internal.ImageFormat, error) {
+	var out []byte
+	var outFormat internal.ImageFormat
+	var err error
+	if poolErr := p.run(ctx, func() { out, outFormat, err = p.process(data, format, o) }); poolErr != nil {
+		return nil, "", poolErr
+	}
+	return out, outFormat, err
+}
+
+func (p *Processor) process(data []byte, format internal.ImageFormat, o Options) ([]byte, internal.ImageFormat, error) {
+	if format == internal.FormatSvg {
+		return p.processSvg(data, o)
+	}
+	if err := p.conf.Limits.Check(data); err != nil {
+		return nil, "", err
+	}
+	md := ReadMetadata(data, format)
+
+	outFormat := format
+	if o.Format != "" {
+		outFormat = o.Format
+	}
+	if format == internal.FormatGif && o.Anim == AnimPoster && o.Format == "" {
+		outFormat = posterFormat(data)
+	}
+	if o.Budget > 0 && (format != internal.FormatGif || outFormat != internal.FormatGif) {
+		return nil, "", fmt.Errorf("%w: budget requires a gif variant of a gif", ErrInvalidOptions)
+	}
+	requantize := o.Quality > 0 && outFormat == internal.FormatJpeg
+	srgb := convertsToSRGB(colorModel(data), md.ICC)
+	still := format == internal.FormatGif && (o.Anim == AnimFirst || o.Anim == AnimPoster)
+	watermark := o.Watermark && p.conf.Watermark != nil
+	// tiff keeps its metadata in the same directory as the pixel layout, it is always converted
+	if o.Width == 0 && o.Height == 0 && o.Crop.Empty() && outFormat == format && !requantize && md.Orientation == 1 &&
+		!still && o.Budget == 0 && !watermark && !o.filtered() && !srgb && format != internal.FormatTiff {
+		out, removed, err := StripMetadata(data, format, p.conf.KeepICC)
+		if err != nil {
+			return nil, "", fmt.Errorf("stripping metadata: %w", err)
+		}
+		p.logRemoved(removed)
+		if p.conf.Optimize {
+			out = p.optimize(out, format, md.ICC)
+		}
+		return out, format, nil
+	}
+
+	if !encodable(outFormat) {
+		outFormat = internal.FormatPng
+	}
+
+	if format == internal.FormatGif {
+		out, err := p.processGif(data, outFormat, o)
+		if err != nil {
+			return nil, "", err
+		}
+		return out, outFormat, nil
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("decoding %s: %w", format, err)
+	}
+	src, converted := toSRGB(src, md.ICC)
+	src = turn(applyOrientation(src, md.Orientation), o)
+
+	region, err := cropRegion(src.Bounds(), o)
+	if err != nil {
+		return nil, "", err
+	}
+
+	resized, err := resize(src, region, o, p.conf.Limits)
+	if err != nil {
+		return nil, "", err
+	}
+	out, err := p.encode(p.watermark(adjust(resized, o), o), outFormat, o.Quality)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// the encoders write no metadata at all, only the profile is carried over if wanted. Converted
+	// pixels are sRGB, which needs no profile.
+	if p.conf.KeepICC && !converted {
+		if out, err = EmbedICC(out, outFormat, md.ICC); err != nil {
+			return nil, "", fmt.Errorf("embedding color profile: %w", err)
+		}
+	}
+	if p.conf.Debug {
+		_, removed, _ := StripMetadata(data, format, p.conf.KeepICC)
+		p.logRemoved(removed)
+	}
+
+	return out, outFormat, nil
+}
+
+// processSvg rasterizes a svg image, it is never passed through because it could contain scripts
+func (p *Processor) processSvg(data []byte, o Options) ([]byte, internal.ImageFormat, error) {
+	if !p.conf.Svg {
+		return nil, "", &internal.UnsupportedMediaError{Reason: "svg rasterization is disabled"}
+	}
+
+	src, err := rasterizeSvg(data, o, p.conf.Limits)
+	if err != nil {
+		return nil, "", err
+	}
+	src = turn(src, o)
+
+	outFormat := internal.FormatPng
+	if o.Format != "" {
+		outFormat = o.Format
+	}
+
+	region, err := cropRegion(src.Bounds(), o)
+	if err != nil {
+		return nil, "", err
+	}
+
+	resized, err := resize(src, region, o, p.conf.Limits)
+	if err != nil {
+		return nil, "", err
+	}
+	out, err := p.encode(p.watermark(adjust(resized, o), o), outFormat, o.Quality)
+	if err != nil {
+		return nil, "", err
+	}
+	return out, outFormat, nil
+}
+
+// Accepts reports whether originals in format can be processed, svg images only if rasterizing is enabled
+func (p *Processor) Accepts(format internal.ImageFormat) bool {
+	return format != internal.FormatSvg || p.conf.Svg
+}
+
+// Policy returns the options the image at imgUrl is actually processed with. Origins which always
+// get a watermark have it enabled, so it ends up in the variant key. finalUrl is where the image was
+// served from after redirects, it is checked as well so a redirect cannot avoid the watermark.
+func (p *Processor) Policy(imgUrl, finalUrl string, o Options) Options {
+	if p.conf.Watermark == nil {
+		return o
+	}
+	if internal.HostMatches(imgUrl, p.conf.Watermark.Domains) || internal.HostMatches(finalUrl, p.conf.Watermark.Domains) {
+		o.Watermark = true
+	}
+	return o
+}
+
+// watermark composites the configured overlay onto img if o asks for it
+func (p *Processor) watermark(img image.Image, o Options) image.Image {
+	if !o.Watermark || p.conf.Watermark == nil {
+		return img
+	}
+	return p.conf.Watermark.apply(img)
+}
+
+func (p *Processor) logRemoved(removed []string) {
+	if p.conf.Debug && len(removed) > 0 {
+		log.Println("Processor (worker) removed metadata:", strings.Join(removed, ", "))
+	}
+}
+
+// resize scales the region of src according to the width, height and fit of o with a Catmull-Rom filter.
+// A tiny original can be scaled to a huge canvas, so the size of the result is checked against limits
+// before it is allocated.
+func resize(src image.Image, region image.Rectangle, o Options, limits Limits) (image.Image, error) {
+	sw, sh := region.Dx(), region.Dy()
+	if sw == 0 || sh == 0 {
+		return src, nil
+	}
+
+	w, h := targetSize(region, o)
+	crop := region
+	if o.Fit == FitCover && o.Width > 0 && o.Height > 0 {
+		crop = coverCrop(src, region, w, h, o)
+	}
+	if w == crop.Dx() && h == crop.Dy() && crop == src.Bounds() {
+		return src, nil
+	}
+	if err := limits.checkSize(w, h); err != nil {
+		return nil, fmt.Errorf("resizing: %w", err)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, crop, draw.Src, nil)
+	return dst, nil
+}
+
+// targetSize returns the size resize scales region to according to the width, height and fit of o
+func targetSize(region image.Rectangle, o Options) (int, int) {
+	sw, sh := region.Dx(), region.Dy()
+	w, h := o.Width, o.Height
+
+	switch {
+	case w == 0 && h == 0:
+		return sw, sh
+	case w == 0:
+		w = scaleDimension(sw, h, sh)
+	case h == 0:
+		h = scaleDimension(sh, w, sw)
+	case o.Fit == FitCover:
+		return w, h
+	case o.Fit == FitContain || o.Fit == FitInside:
+		if sw*h > sh*w {
+			h = scaleDimension(sh, w, sw)
+		} else {
+			w = scaleDimension(sw, h, sh)
+		}
+	}
+
+	if o.Fit == FitInside && (w > sw || h > sh) {
+		w, h = sw, sh
+	}
+	return w, h
+}
+
+// scaleDimension returns the size of a side with length side after scaling by num/den, at least 1
+func scaleDimension(side, num, den int) int {
+	v := (side*num + den/2) / den
+	if v < 1 {
+		return 1
+	}
+	return v
+}
+
+// colorModel returns the color model announced by the header of data, nil if it cannot be read
+func colorModel(data []byte) color.Model {
+	conf, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	return conf.ColorModel
+}
+
+// posterFormat is the format of posters of the gif in data without a requested format, png if the
+// gif uses transparency and jpeg otherwise
+func posterFormat(data []byte) internal.ImageFormat {
+	if _, transparent, _, err := scanGif(data, 0); err == nil && !transparent {
+		return internal.FormatJpeg
+	}
+	return internal.FormatPng
+}
+
+// encodable reports whether variants can be encoded in format, the other input formats are converted to png
+func encodable(format internal.ImageFormat) bool {
+	return format == internal.FormatJpeg || format == internal.FormatPng || format == internal.FormatGif
+}
+
+// encode writes img in the given format, quality is ignored by lossless formats
+func (p *Processor) encode(img image.Image, format internal.ImageFormat, quality int) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+
+	switch format {
+	case internal.FormatJpeg:
+		if quality == 0 {
+			quality = p.jpegQuality()
+		}
+		err = jpeg.Encode(&buf, flatten(img), &jpeg.Options{Quality: quality})
+	case internal.FormatPng:
+		err = p.pngEncoder().Encode(&buf, img)
+	case internal.FormatGif:
+		err = gif.Encode(&buf, img, &gif.Options{NumColors: 256, Drawer: draw.FloydSteinberg})
+	default:
+		return nil, fmt.Errorf("encoding %s is not supported", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// flatten draws img onto a white background, formats without alpha channel would turn
+// transparent pixels black otherwise
+func flatten(img image.Image) image.Image {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+		return img
+	}
+	dst := image.NewRGBA(img.Bounds())
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Over)
+	return dst
+}
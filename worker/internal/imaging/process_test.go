@@ -0,0 +1,164 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"github.com/phips4/img-proxy/worker/internal"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResize(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 400, 200))
+
+	tests := []struct {
+		name  string
+		opts  Options
+		wantW int
+		wantH int
+	}{
+		{name: "width only", opts: Options{Width: 100, Fit: FitContain}, wantW: 100, wantH: 50},
+		{name: "height only", opts: Options{Height: 100, Fit: FitContain}, wantW: 200, wantH: 100},
+		{name: "contain", opts: Options{Width: 100, Height: 100, Fit: FitContain}, wantW: 100, wantH: 50},
+		{name: "contain enlarges", opts: Options{Width: 800, Height: 800, Fit: FitContain}, wantW: 800, wantH: 400},
+		{name: "inside does not enlarge", opts: Options{Width: 800, Height: 800, Fit: FitInside}, wantW: 400, wantH: 200},
+		{name: "cover", opts: Options{Width: 100, Height: 100, Fit: FitCover}, wantW: 100, wantH: 100},
+		{name: "fill", opts: Options{Width: 50, Height: 300, Fit: FitFill}, wantW: 50, wantH: 300},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resized, err := resize(src, src.Bounds(), tt.opts, Limits{})
+			if err != nil {
+				t.Fatal("expected:", nil, "got:", err)
+			}
+			b := resized.Bounds()
+			if b.Dx() != tt.wantW || b.Dy() != tt.wantH {
+				t.Errorf("resize() got = %dx%d, want %dx%d", b.Dx(), b.Dy(), tt.wantW, tt.wantH)
+			}
+		})
+	}
+}
+
+func TestProcess(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 40, 20))); err != nil {
+		t.Fatal(err)
+	}
+	p := NewProcessor(ProcessorConfig{})
+
+	out, format, err := p.Process(context.Background(), buf.Bytes(), internal.FormatPng, Options{Width: 10, Fit: FitContain})
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if format != internal.FormatPng {
+		t.Error("expected:", internal.FormatPng, "got:", format)
+	}
+
+	conf, err := png.DecodeConfig(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if conf.Width != 10 || conf.Height != 5 {
+		t.Error("expected:", "10x5", "got:", conf.Width, conf.Height)
+	}
+}
+
+func TestProcess_Format(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatal(err)
+	}
+	p := NewProcessor(ProcessorConfig{})
+
+	out, format, err := p.Process(context.Background(), buf.Bytes(), internal.FormatPng, Options{Format: internal.FormatJpeg, Quality: 50})
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if got, _ := internal.DetectFormat(out); format != internal.FormatJpeg || got != internal.FormatJpeg {
+		t.Error("expected:", internal.FormatJpeg, "got:", format, got)
+	}
+
+	out, _, err = p.Process(context.Background(), buf.Bytes(), internal.FormatPng, Options{Format: internal.FormatPng})
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if !bytes.Equal(out, buf.Bytes()) {
+		t.Error("expected:", "original bytes", "got:", len(out), "bytes")
+	}
+}
+
+// testWebp reads the lossless 1x1 webp shared with the tests of the internal package, there is no
+// pure Go encoder to create one
+func testWebp(t *testing.T) []byte {
+	data, err := os.ReadFile(filepath.Join("..", "testdata", "pixel.webp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestProcess_InputFormats(t *testing.T) {
+	var bmpBuf, tiffBuf bytes.Buffer
+	if err := bmp.Encode(&bmpBuf, image.NewRGBA(image.Rect(0, 0, 4, 2))); err != nil {
+		t.Fatal(err)
+	}
+	if err := tiff.Encode(&tiffBuf, image.NewRGBA(image.Rect(0, 0, 4, 2)), nil); err != nil {
+		t.Fatal(err)
+	}
+	p := NewProcessor(ProcessorConfig{})
+
+	tests := []struct {
+		name            string
+		data            []byte
+		format          internal.ImageFormat
+		opts            Options
+		wantFormat      internal.ImageFormat
+		wantPassThrough bool
+	}{
+		{name: "webp passed through", data: testWebp(t), format: internal.FormatWebp, wantFormat: internal.FormatWebp, wantPassThrough: true},
+		{name: "webp resized to png", data: testWebp(t), format: internal.FormatWebp, opts: Options{Width: 2}, wantFormat: internal.FormatPng},
+		{name: "webp to jpeg", data: testWebp(t), format: internal.FormatWebp, opts: Options{Format: internal.FormatJpeg}, wantFormat: internal.FormatJpeg},
+		{name: "bmp passed through", data: bmpBuf.Bytes(), format: internal.FormatBmp, wantFormat: internal.FormatBmp, wantPassThrough: true},
+		{name: "tiff converted", data: tiffBuf.Bytes(), format: internal.FormatTiff, wantFormat: internal.FormatPng},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, format, err := p.Process(context.Background(), tt.data, tt.format, tt.opts)
+			if err != nil {
+				t.Fatal("expected:", nil, "got:", err)
+			}
+			if got, _ := internal.DetectFormat(out); format != tt.wantFormat || got != tt.wantFormat {
+				t.Errorf("Process() got = %v (sniffed %v), want %v", format, got, tt.wantFormat)
+			}
+			if bytes.Equal(out, tt.data) != tt.wantPassThrough {
+				t.Errorf("Process() passed through = %v, want %v", !tt.wantPassThrough, tt.wantPassThrough)
+			}
+		})
+	}
+}
+
+func TestProcess_Filters(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 40, 20))); err != nil {
+		t.Fatal(err)
+	}
+
+	// the width refers to the rotated image
+	out, _, err := NewProcessor(ProcessorConfig{}).Process(context.Background(), buf.Bytes(), internal.FormatPng,
+		Options{Width: 10, Fit: FitContain, Rotate: 90, Grayscale: true})
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	conf, err := png.DecodeConfig(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if conf.Width != 10 || conf.Height != 20 {
+		t.Error("expected:", "10x20", "got:", conf.Width, conf.Height)
+	}
+}
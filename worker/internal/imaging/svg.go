@@ -0,0 +1,280 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+	"golang.org/x/net/html/charset"
+	"image"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	// size browsers give svg images without width, height and viewBox
+	defaultSvgWidth  = 300
+	defaultSvgHeight = 150
+
+	// the rasterizer copies the referenced element for every <use> and recurses into it, a few bytes
+	// of nested or cyclic references expand without bound. Documents beyond these limits are rejected.
+	maxSvgDepth    = 256
+	maxSvgUseDepth = 8
+	maxSvgElements = 10000
+)
+
+// unsafeSvgElements are removed together with their children before an svg is rasterized
+var unsafeSvgElements = map[string]bool{
+	"script":        true,
+	"foreignobject": true,
+	"iframe":        true,
+}
+
+// svgElement is a kept element of a svg together with the elements its <use> children reference
+type svgElement struct {
+	children []*svgElement
+	// use is the id the element references if it is a <use> element
+	use string
+}
+
+// sanitizeSvg rewrites data without scripts, event handlers, references to other documents,
+// comments, processing instructions and DOCTYPE declarations. It also returns the width and height
+// of the root element, 0 if they are missing or relative. Documents whose <use> references are
+// cyclic or expand beyond the svg limits are rejected with ErrImageTooLarge.
+func sanitizeSvg(data []byte) ([]byte, float64, float64, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.CharsetReader = charset.NewReaderLabel
+
+	var out bytes.Buffer
+	var width, height float64
+	root, skip := true, 0
+	document := &svgElement{}
+	open := []*svgElement{document}
+	ids := make(map[string]*svgElement)
+	for {
+		tok, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, 0, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if skip > 0 || unsafeSvgElements[strings.ToLower(t.Name.Local)] {
+				skip++
+				continue
+			}
+			if root {
+				root = false
+				for _, attr := range t.Attr {
+					switch attr.Name.Local {
+					case "width":
+						width = svgLength(attr.Value)
+					case "height":
+						height = svgLength(attr.Value)
+					}
+				}
+			}
+			if len(open) > maxSvgDepth {
+				return nil, 0, 0, fmt.Errorf("%w: svg nested deeper than %d elements", ErrImageTooLarge, maxSvgDepth)
+			}
+			el := &svgElement{}
+			parent := open[len(open)-1]
+			parent.children = append(parent.children, el)
+			open = append(open, el)
+
+			out.WriteString("<" + qualifiedName(t.Name))
+			for _, attr := range t.Attr {
+				if !safeSvgAttr(attr) {
+					continue
+				}
+				switch {
+				case attr.Name.Local == "id":
+					ids[attr.Value] = el
+				case attr.Name.Local == "href" && strings.EqualFold(t.Name.Local, "use"):
+					el.use = strings.TrimPrefix(strings.TrimSpace(attr.Value), "#")
+				}
+				out.WriteString(" " + qualifiedName(attr.Name) + `="`)
+				_ = xml.EscapeText(&out, []byte(attr.Value))
+				out.WriteString(`"`)
+			}
+			out.WriteString(">")
+		case xml.EndElement:
+			if skip > 0 {
+				skip--
+				continue
+			}
+			if len(open) > 1 {
+				open = open[:len(open)-1]
+			}
+			out.WriteString("</" + qualifiedName(t.Name) + ">")
+		case xml.CharData:
+			if skip == 0 {
+				_ = xml.EscapeText(&out, t)
+			}
+		}
+	}
+
+	if _, _, err := svgExpansion(document, ids, make(map[*svgElement][2]int), make(map[*svgElement]bool)); err != nil {
+		return nil, 0, 0, err
+	}
+	return out.Bytes(), width, height, nil
+}
+
+// svgExpansion returns the number of elements el expands to once every <use> is replaced by the element
+// it references, and the longest chain of references below el. It fails for cyclic references and
+// expansions beyond the svg limits. done remembers the results of elements already walked, active
+// the elements on the current path.
+func svgExpansion(el *svgElement, ids map[string]*svgElement, done map[*svgElement][2]int,
+	active map[*svgElement]bool) (int, int, error) {
+	if r, ok := done[el]; ok {
+		return r[0], r[1], nil
+	}
+	if active[el] {
+		return 0, 0, fmt.Errorf("%w: svg references itself", ErrImageTooLarge)
+	}
+	active[el] = true
+	defer delete(active, el)
+
+	elements, depth := 1, 0
+	walk := func(next *svgElement, extraDepth int) error {
+		n, d, err := svgExpansion(next, ids, done, active)
+		if err != nil {
+			return err
+		}
+		elements += n
+		depth = maxInt(depth, d+extraDepth)
+		if elements > maxSvgElements {
+			return fmt.Errorf("%w: svg expands to more than %d elements", ErrImageTooLarge, maxSvgElements)
+		}
+		if depth > maxSvgUseDepth {
+			return fmt.Errorf("%w: svg references nested deeper than %d", ErrImageTooLarge, maxSvgUseDepth)
+		}
+		return nil
+	}
+	for _, child := range el.children {
+		if err := walk(child, 0); err != nil {
+			return 0, 0, err
+		}
+	}
+	if target, ok := ids[el.use]; ok && el.use != "" {
+		if err := walk(target, 1); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	done[el] = [2]int{elements, depth}
+	return elements, depth, nil
+}
+
+// safeSvgAttr drops event handlers and links which do not point into the document itself
+func safeSvgAttr(attr xml.Attr) bool {
+	name := strings.ToLower(attr.Name.Local)
+	if strings.HasPrefix(name, "on") {
+		return false
+	}
+	if name == "href" && !strings.HasPrefix(strings.TrimSpace(attr.Value), "#") {
+		return false
+	}
+	return true
+}
+
+func qualifiedName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+// svgLength parses absolute lengths like "24" or "24px", relative ones like "100%" give 0
+func svgLength(v string) float64 {
+	f, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(v), "px"), 64)
+	if err != nil || f <= 0 {
+		return 0
+	}
+	return f
+}
+
+// decodeSvg parses a sanitized copy of the svg in data. It also returns the intrinsic size of the image,
+// taken from width and height, the viewBox or the default of browsers in that order.
+func decodeSvg(data []byte) (*oksvg.SvgIcon, float64, float64, error) {
+	clean, width, height, err := sanitizeSvg(data)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("sanitizing svg: %w", err)
+	}
+	icon, err := oksvg.ReadIconStream(bytes.NewReader(clean), oksvg.IgnoreErrorMode)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("decoding svg: %w", err)
+	}
+
+	vb := icon.ViewBox
+	switch {
+	case width > 0 && height > 0:
+	case width > 0 && vb.W > 0 && vb.H > 0:
+		height = width * vb.H / vb.W
+	case height > 0 && vb.W > 0 && vb.H > 0:
+		width = height * vb.W / vb.H
+	case vb.W > 0 && vb.H > 0:
+		width, height = vb.W, vb.H
+	default:
+		width, height = defaultSvgWidth, defaultSvgHeight
+	}
+	if vb.W <= 0 || vb.H <= 0 {
+		icon.ViewBox.X, icon.ViewBox.Y, icon.ViewBox.W, icon.ViewBox.H = 0, 0, width, height
+	}
+	return icon, width, height, nil
+}
+
+// rasterizeSvg draws a sanitized copy of the svg in data. The raster is as large as the variant
+// described by o needs, so scaling it down afterwards does not blur the edges. Crops refer to the
+// pixels of the declared size, so the svg is drawn at that size if o has one.
+func rasterizeSvg(data []byte, o Options, limits Limits) (image.Image, error) {
+	icon, width, height, err := decodeSvg(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// the requested size refers to the turned image
+	targetW, targetH := o.Width, o.Height
+	if o.Rotate == 90 || o.Rotate == 270 {
+		targetW, targetH = targetH, targetW
+	}
+	scale := 0.0
+	if o.Crop.Empty() {
+		if targetW > 0 {
+			scale = float64(targetW) / width
+		}
+		if targetH > 0 {
+			scale = math.Max(scale, float64(targetH)/height)
+		}
+		if o.Fit == FitInside {
+			scale = math.Min(scale, 1)
+		}
+	}
+	if scale <= 0 {
+		scale = 1
+	}
+	// declared sizes are arbitrary floats, they have to fit into an int before the limits can be checked
+	if width*scale > math.MaxInt32 || height*scale > math.MaxInt32 {
+		return nil, fmt.Errorf("%w: svg of %gx%g", ErrImageTooLarge, width*scale, height*scale)
+	}
+	w := maxInt(1, int(math.Round(width*scale)))
+	h := maxInt(1, int(math.Round(height*scale)))
+	if err := limits.checkSize(w, h); err != nil {
+		return nil, err
+	}
+	return drawSvg(icon, w, h), nil
+}
+
+// drawSvg rasterizes icon into an image of w x h pixels
+func drawSvg(icon *oksvg.SvgIcon, w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	icon.SetTarget(0, 0, float64(w), float64(h))
+	icon.Draw(rasterx.NewDasher(w, h, rasterx.NewScannerGV(w, h, img, img.Bounds())), 1)
+	return img
+}
@@ -0,0 +1,122 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/phips4/img-proxy/worker/internal"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+const testSvg = `<?xml version="1.0"?>
+<!DOCTYPE svg [<!ENTITY e "entity">]>
+<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" width="40" height="20" onload="alert(1)">
+  <script>alert(2)</script>
+  <foreignObject><div>html</div></foreignObject>
+  <image xlink:href="https://example.com/tracker.png" width="1" height="1"/>
+  <rect width="40" height="20" fill="#ff0000"/>
+</svg>`
+
+func TestSanitizeSvg(t *testing.T) {
+	clean, w, h, err := sanitizeSvg([]byte(testSvg))
+	if err != nil {
+		t.Fatal("expected:", nil, "got:", err)
+	}
+	if w != 40 || h != 20 {
+		t.Error("expected:", "40x20", "got:", w, h)
+	}
+
+	for _, unsafe := range []string{"onload", "script", "alert", "foreignObject", "html", "example.com", "ENTITY"} {
+		if strings.Contains(string(clean), unsafe) {
+			t.Errorf("sanitizeSvg() left %q in %s", unsafe, clean)
+		}
+	}
+	if !strings.Contains(string(clean), `<rect width="40" height="20" fill="#ff0000">`) {
+		t.Error("expected:", "rect element", "got:", string(clean))
+	}
+}
+
+func TestProcess_Svg(t *testing.T) {
+	_, _, err := NewProcessor(ProcessorConfig{}).Process(context.Background(), []byte(testSvg), internal.FormatSvg, Options{})
+	var mediaErr *internal.UnsupportedMediaError
+	if !errors.As(err, &mediaErr) {
+		t.Error("expected:", "unsupported media error", "got:", err)
+	}
+
+	p := NewProcessor(ProcessorConfig{Svg: true, Limits: Limits{MaxPixels: 1_000_000}})
+	tests := []struct {
+		name  string
+		opts  Options
+		wantW int
+		wantH int
+	}{
+		{name: "declared size", opts: Options{}, wantW: 40, wantH: 20},
+		{name: "scaled up", opts: Options{Width: 400}, wantW: 400, wantH: 200},
+		{name: "cover", opts: Options{Width: 100, Height: 100, Fit: FitCover}, wantW: 100, wantH: 100},
+		{name: "inside does not enlarge", opts: Options{Width: 400, Height: 400, Fit: FitInside}, wantW: 40, wantH: 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, format, err := p.Process(context.Background(), []byte(testSvg), internal.FormatSvg, tt.opts)
+			if err != nil {
+				t.Fatal("expected:", nil, "got:", err)
+			}
+			if format != internal.FormatPng {
+				t.Error("expected:", internal.FormatPng, "got:", format)
+			}
+			img, err := png.Decode(bytes.NewReader(out))
+			if err != nil {
+				t.Fatal("expected:", nil, "got:", err)
+			}
+			if b := img.Bounds(); b.Dx() != tt.wantW || b.Dy() != tt.wantH {
+				t.Errorf("Process() got = %dx%d, want %dx%d", b.Dx(), b.Dy(), tt.wantW, tt.wantH)
+			}
+			if r, g, _, _ := img.At(tt.wantW/2, tt.wantH/2).RGBA(); r>>8 != 0xff || g != 0 {
+				t.Error("expected:", "red center", "got:", img.At(tt.wantW/2, tt.wantH/2))
+			}
+		})
+	}
+
+	if _, _, err := p.Process(context.Background(), []byte(testSvg), internal.FormatSvg, Options{Width: 4000}); !errors.Is(err, ErrImageTooLarge) {
+		t.Error("expected:", ErrImageTooLarge, "got:", err)
+	}
+}
+
+func TestSanitizeSvg_Use(t *testing.T) {
+	// every level references the previous one twice, 2^20 elements from a few lines
+	var nested strings.Builder
+	nested.WriteString(`<svg xmlns="http://www.w3.org/2000/svg"><defs><rect id="l0" width="1" height="1"/>`)
+	for i := 1; i <= 20; i++ {
+		fmt.Fprintf(&nested, `<g id="l%d"><use href="#l%d"/><use href="#l%d"/></g>`, i, i-1, i-1)
+	}
+	nested.WriteString(`</defs><use href="#l20"/></svg>`)
+
+	tests := []struct {
+		name    string
+		svg     string
+		wantErr bool
+	}{
+		{name: "symbol", svg: `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink"><defs><rect id="a" width="1" height="1"/></defs><use xlink:href="#a"/><use href="#a"/></svg>`},
+		{name: "unknown id", svg: `<svg xmlns="http://www.w3.org/2000/svg"><use href="#missing"/></svg>`},
+		{name: "self reference", svg: `<svg xmlns="http://www.w3.org/2000/svg"><defs><g id="a"><rect width="1" height="1"/><use href="#a"/></g></defs><use href="#a"/></svg>`, wantErr: true},
+		{name: "cycle", svg: `<svg xmlns="http://www.w3.org/2000/svg"><g id="a"><use href="#b"/></g><g id="b"><use href="#a"/></g></svg>`, wantErr: true},
+		{name: "exponential", svg: nested.String(), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, _, err := sanitizeSvg([]byte(tt.svg))
+			if tt.wantErr != errors.Is(err, ErrImageTooLarge) {
+				t.Errorf("sanitizeSvg() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// the worker has to survive the document instead of overflowing its stack
+	p := NewProcessor(ProcessorConfig{Svg: true})
+	if _, _, err := p.Process(context.Background(), []byte(tests[2].svg), internal.FormatSvg, Options{}); !errors.Is(err, ErrImageTooLarge) {
+		t.Error("expected:", ErrImageTooLarge, "got:", err)
+	}
+}
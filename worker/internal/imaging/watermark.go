@@ -0,0 +1,116 @@
+package imaging
+
+import (
+	"fmt"
+	"github.com/phips4/img-proxy/worker/internal"
+	"golang.org/x/image/draw"
+	"image"
+	"image/color"
+	"os"
+)
+
+// Watermark is an overlay composited onto variants. It is requested per preset with the watermark
+// option or enforced for the images of some origin hosts.
+type Watermark struct {
+	Image    image.Image
+	Position Gravity
+	Margin   int
+	Opacity  float64
+	Scale    float64
+	MinSize  int
+	Domains  []string
+}
+
+// LoadWatermark reads the overlay image once at startup, without a file there is no watermark
+func LoadWatermark(conf internal.WatermarkConfig) (*Watermark, error) {
+	if conf.File == "" {
+		return nil, nil
+	}
+
+	position := Gravity(conf.Position)
+	if !gravities[position] || position == GravityFocal || position == GravityEntropy || position == GravityAttention {
+		return nil, fmt.Errorf("unknown watermark position %s", conf.Position)
+	}
+
+	f, err := os.Open(conf.File)
+	if err != nil {
+		return nil, fmt.Errorf("reading watermark: %w", err)
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("decoding watermark: %w", err)
+	}
+
+	return &Watermark{
+		Image:    img,
+		Position: position,
+		Margin:   conf.Margin,
+		Opacity:  conf.Opacity,
+		Scale:    conf.Scale,
+		MinSize:  conf.MinSize,
+		Domains:  conf.Domains,
+	}, nil
+}
+
+// apply composites the overlay onto img. Variants smaller than MinSize are returned untouched.
+func (wm *Watermark) apply(img image.Image) image.Image {
+	b := img.Bounds()
+	if maxInt(b.Dx(), b.Dy()) < wm.MinSize {
+		return img
+	}
+
+	ob := wm.Image.Bounds()
+	ow, oh := ob.Dx(), ob.Dy()
+	if wm.Scale > 0 {
+		ow = maxInt(1, int(float64(b.Dx())*wm.Scale))
+		oh = scaleDimension(ob.Dy(), ow, ob.Dx())
+	}
+	// the overlay never covers more than the variant minus its margins
+	if free := b.Dx() - 2*wm.Margin; ow > free {
+		ow, oh = maxInt(1, free), scaleDimension(oh, maxInt(1, free), ow)
+	}
+	if free := b.Dy() - 2*wm.Margin; oh > free {
+		ow, oh = scaleDimension(ow, maxInt(1, free), oh), maxInt(1, free)
+	}
+
+	overlay := image.NewRGBA(image.Rect(0, 0, ow, oh))
+	draw.CatmullRom.Scale(overlay, overlay.Bounds(), wm.Image, ob, draw.Src, nil)
+
+	dst := image.NewRGBA(b)
+	draw.Draw(dst, b, img, b.Min, draw.Src)
+
+	at := wm.position(b, ow, oh)
+	mask := image.NewUniform(color.Alpha{A: uint8(wm.Opacity*255 + 0.5)})
+	draw.DrawMask(dst, image.Rect(at.X, at.Y, at.X+ow, at.Y+oh), overlay, image.Point{}, mask, image.Point{}, draw.Over)
+
+	return dst
+}
+
+// position returns the top left corner of a w x h overlay in b
+func (wm *Watermark) position(b image.Rectangle, w, h int) image.Point {
+	left, top := b.Min.X+wm.Margin, b.Min.Y+wm.Margin
+	right, bottom := b.Max.X-wm.Margin-w, b.Max.Y-wm.Margin-h
+	centerX, centerY := b.Min.X+(b.Dx()-w)/2, b.Min.Y+(b.Dy()-h)/2
+
+	switch wm.Position {
+	case GravityNorth:
+		return image.Pt(centerX, top)
+	case GravitySouth:
+		return image.Pt(centerX, bottom)
+	case GravityEast:
+		return image.Pt(right, centerY)
+	case GravityWest:
+		return image.Pt(left, centerY)
+	case GravityNorthEast:
+		return image.Pt(right, top)
+	case GravityNorthWest:
+		return image.Pt(left, top)
+	case GravitySouthWest:
+		return image.Pt(left, bottom)
+	case GravitySouthEast:
+		return image.Pt(right, bottom)
+	}
+	return image.Pt(centerX, centerY)
+}
@@ -0,0 +1,71 @@
+package imaging
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func testWatermark(position Gravity) *Watermark {
+	overlay := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	draw.Draw(overlay, overlay.Bounds(), image.NewUniform(color.RGBA{R: 255, A: 255}), image.Point{}, draw.Src)
+	return &Watermark{Image: overlay, Position: position, Margin: 5, Opacity: 1, Domains: []string{"partner.com"}}
+}
+
+func TestWatermark_Position(t *testing.T) {
+	b := image.Rect(0, 0, 100, 50)
+
+	tests := []struct {
+		position Gravity
+		want     image.Point
+	}{
+		{position: GravityNorthWest, want: image.Pt(5, 5)},
+		{position: GravitySouthEast, want: image.Pt(85, 35)},
+		{position: GravityCenter, want: image.Pt(45, 20)},
+		{position: GravityEast, want: image.Pt(85, 20)},
+	}
+	for _, tt := range tests {
+		if got := testWatermark(tt.position).position(b, 10, 10); got != tt.want {
+			t.Errorf("position(%s) got = %v, want %v", tt.position, got, tt.want)
+		}
+	}
+}
+
+func TestWatermark_Apply(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	draw.Draw(src, src.Bounds(), image.White, image.Point{}, draw.Src)
+
+	wm := testWatermark(GravitySouthEast)
+	img := wm.apply(src)
+	if r, g, _, _ := img.At(90, 40).RGBA(); r != 0xffff || g != 0 {
+		t.Error("expected:", "red overlay", "got:", img.At(90, 40))
+	}
+	if r, g, _, _ := img.At(10, 10).RGBA(); r != 0xffff || g != 0xffff {
+		t.Error("expected:", "white background", "got:", img.At(10, 10))
+	}
+
+	wm.MinSize = 200
+	if img := wm.apply(src); img != image.Image(src) {
+		t.Error("expected:", "small variants untouched", "got:", "watermarked image")
+	}
+}
+
+func TestProcessor_Policy(t *testing.T) {
+	p := NewProcessor(ProcessorConfig{Watermark: testWatermark(GravitySouthEast)})
+
+	if o := p.Policy("https://cdn.partner.com/a.png", "", Options{}); !o.Watermark {
+		t.Error("expected:", true, "got:", o.Watermark)
+	}
+	if o := p.Policy("https://example.com/a.png", "https://example.com/a.png", Options{}); o.Watermark {
+		t.Error("expected:", false, "got:", o.Watermark)
+	}
+	// a redirect to a watermarked origin gets the watermark as well
+	if o := p.Policy("https://example.com/a.png", "https://cdn.partner.com/a.png", Options{}); !o.Watermark {
+		t.Error("expected:", true, "got:", o.Watermark)
+	}
+	// without an overlay there is nothing to enforce
+	if o := NewProcessor(ProcessorConfig{}).Policy("https://partner.com/a.png", "", Options{}); o.Watermark {
+		t.Error("expected:", false, "got:", o.Watermark)
+	}
+}
@@ -0,0 +1,249 @@
+package internal
+
+import (
+	"errors"
+	"github.com/phips4/img-proxy/worker/internal/prom"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrCircuitOpen = errors.New("circuit breaker open for origin")
+	ErrOriginBusy  = errors.New("too many concurrent requests to origin")
+)
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerHalfOpen
+	BreakerOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerHalfOpen:
+		return "half-open"
+	case BreakerOpen:
+		return "open"
+	default:
+		return "unknown"
+	}
+}
+
+// OriginStatus is a point in time view of a single origin host
+type OriginStatus struct {
+	Host     string
+	State    BreakerState
+	InFlight int
+	Failures int
+}
+
+// maxOrigins is the number of hosts the limiter keeps track of. Hosts come from user supplied urls,
+// so idle ones are forgotten beyond it.
+const maxOrigins = 1024
+
+type origin struct {
+	sem      chan struct{}
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+	// users is the number of downloads holding or waiting for a slot, lastUsed when the last one started
+	users    int
+	lastUsed time.Time
+}
+
+// OriginLimiter bounds the number of concurrent downloads per origin host and stops talking to
+// hosts which keep failing. After failureThreshold consecutive failures the breaker of a host opens
+// and every request fails fast with ErrCircuitOpen. Once openTimeout has passed a single probe
+// request is let through (half-open), its outcome decides whether the breaker closes or opens again.
+// At most maxOrigins hosts are tracked, the least recently used idle host is forgotten for a new one.
+type OriginLimiter struct {
+	mu               sync.Mutex
+	origins          map[string]*origin
+	maxConcurrent    int
+	acquireTimeout   time.Duration
+	failureThreshold int
+	openTimeout      time.Duration
+	now              func() time.Time
+}
+
+func NewOriginLimiter(maxConcurrent int, acquireTimeout time.Duration, failureThreshold int, openTimeout time.Duration) *OriginLimiter {
+	return &OriginLimiter{
+		origins:          make(map[string]*origin),
+		maxConcurrent:    maxConcurrent,
+		acquireTimeout:   acquireTimeout,
+		failureThreshold: failureThreshold,
+		openTimeout:      openTimeout,
+		now:              time.Now,
+	}
+}
+
+// Wrap guards every download of dl with the per-host concurrency limit and circuit breaker
+func (l *OriginLimiter) Wrap(dl Downloader) Downloader {
+	return DownloaderFunc(func(rawUrl string, validators Validators) (*Download, error) {
+		u, err := url.Parse(rawUrl)
+		if err != nil {
+			return nil, err
+		}
+		host := u.Hostname()
+
+		release, err := l.acquire(host)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := dl.Download(rawUrl, validators)
+		release(!isOriginFailure(err))
+
+		return res, err
+	})
+}
+
+// isOriginFailure reports whether err says something about the health of the origin. Missing files
+// and requests rejected by our own policies do not.
+func isOriginFailure(err error) bool {
+	return err != nil && !errors.Is(err, ErrFileNotFound) && !errors.Is(err, ErrForbiddenHost) &&
+		!errors.Is(err, ErrRedirect)
+}
+
+// acquire reserves a download slot for host. The returned function must be called exactly once
+// with the outcome of the download.
+func (l *OriginLimiter) acquire(host string) (func(success bool), error) {
+	l.mu.Lock()
+	o := l.originFor(host)
+	o.users++
+	o.lastUsed = l.now()
+
+	probe := false
+	switch o.state {
+	case BreakerOpen:
+		if l.now().Sub(o.openedAt) < l.openTimeout {
+			o.users--
+			l.mu.Unlock()
+			prom.OriginRejections.WithLabelValues("circuit_open").Inc()
+			return nil, ErrCircuitOpen
+		}
+		l.setState(o, BreakerHalfOpen)
+		fallthrough
+	case BreakerHalfOpen:
+		if o.probing {
+			o.users--
+			l.mu.Unlock()
+			prom.OriginRejections.WithLabelValues("circuit_open").Inc()
+			return nil, ErrCircuitOpen
+		}
+		o.probing = true
+		probe = true
+	}
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.acquireTimeout)
+	defer timer.Stop()
+
+	select {
+	case o.sem <- struct{}{}:
+	case <-timer.C:
+		l.mu.Lock()
+		o.users--
+		if probe {
+			o.probing = false
+		}
+		l.mu.Unlock()
+		prom.OriginRejections.WithLabelValues("busy").Inc()
+		return nil, ErrOriginBusy
+	}
+	prom.OriginInFlight.Inc()
+
+	return func(success bool) {
+		<-o.sem
+		prom.OriginInFlight.Dec()
+		l.record(o, probe, success)
+	}, nil
+}
+
+func (l *OriginLimiter) record(o *origin, probe, success bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	o.users--
+	if probe {
+		o.probing = false
+	}
+
+	if success {
+		o.failures = 0
+		if o.state != BreakerClosed {
+			l.setState(o, BreakerClosed)
+		}
+		return
+	}
+
+	o.failures++
+	if o.state == BreakerHalfOpen || o.failures >= l.failureThreshold {
+		o.openedAt = l.now()
+		l.setState(o, BreakerOpen)
+	}
+}
+
+// originFor returns the state of host and creates it if necessary. l.mu must be held.
+func (l *OriginLimiter) originFor(host string) *origin {
+	o, ok := l.origins[host]
+	if !ok {
+		if len(l.origins) >= maxOrigins {
+			l.evictIdle()
+		}
+		o = &origin{sem: make(chan struct{}, l.maxConcurrent)}
+		l.origins[host] = o
+		prom.OriginBreakers.WithLabelValues(BreakerClosed.String()).Inc()
+	}
+	return o
+}
+
+// evictIdle forgets the least recently used host without running or waiting downloads. If every host
+// is busy none is forgotten, the number of busy hosts is bounded by the number of requests anyway.
+// l.mu must be held.
+func (l *OriginLimiter) evictIdle() {
+	var oldest string
+	for host, o := range l.origins {
+		if o.users == 0 && (oldest == "" || o.lastUsed.Before(l.origins[oldest].lastUsed)) {
+			oldest = host
+		}
+	}
+	if oldest != "" {
+		prom.OriginBreakers.WithLabelValues(l.origins[oldest].state.String()).Dec()
+		delete(l.origins, oldest)
+	}
+}
+
+func (l *OriginLimiter) setState(o *origin, state BreakerState) {
+	prom.OriginBreakers.WithLabelValues(o.state.String()).Dec()
+	o.state = state
+	prom.OriginBreakers.WithLabelValues(state.String()).Inc()
+}
+
+// Status returns the state of all known origins sorted by host
+func (l *OriginLimiter) Status() []OriginStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	status := make([]OriginStatus, 0, len(l.origins))
+	for host, o := range l.origins {
+		status = append(status, OriginStatus{
+			Host:     host,
+			State:    o.state,
+			InFlight: len(o.sem),
+			Failures: o.failures,
+		})
+	}
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Host < status[j].Host
+	})
+
+	return status
+}
@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestOriginLimiter_Breaker(t *testing.T) {
+	now := time.Now()
+	limiter := NewOriginLimiter(2, time.Millisecond*10, 2, time.Minute)
+	limiter.now = func() time.Time { return now }
+
+	fail := true
+	dl := limiter.Wrap(DownloaderFunc(func(string, Validators) (*Download, error) {
+		if fail {
+			return nil, errors.New("boom")
+		}
+		return &Download{Data: []byte("img")}, nil
+	}))
+
+	for i := 0; i < 2; i++ {
+		if _, err := dl.Download("https://slow.example.com/a.png", Validators{}); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Error("expected:", "download error", "got:", err)
+		}
+	}
+
+	if _, err := dl.Download("https://slow.example.com/a.png", Validators{}); !errors.Is(err, ErrCircuitOpen) {
+		t.Error("expected:", ErrCircuitOpen, "got:", err)
+	}
+
+	// other hosts are not affected
+	fail = false
+	if _, err := dl.Download("https://fast.example.com/a.png", Validators{}); err != nil {
+		t.Error("expected:", nil, "got:", err)
+	}
+
+	// after the open timeout a probe is let through and closes the breaker
+	now = now.Add(time.Minute)
+	if _, err := dl.Download("https://slow.example.com/a.png", Validators{}); err != nil {
+		t.Error("expected:", nil, "got:", err)
+	}
+
+	for _, s := range limiter.Status() {
+		if s.State != BreakerClosed {
+			t.Error("expected:", BreakerClosed, "got:", s.State, "for", s.Host)
+		}
+	}
+}
+
+func TestOriginLimiter_HalfOpenFailureReopens(t *testing.T) {
+	now := time.Now()
+	limiter := NewOriginLimiter(1, time.Millisecond*10, 1, time.Minute)
+	limiter.now = func() time.Time { return now }
+
+	dl := limiter.Wrap(DownloaderFunc(func(string, Validators) (*Download, error) {
+		return nil, errors.New("boom")
+	}))
+
+	_, _ = dl.Download("https://slow.example.com/a.png", Validators{})
+	now = now.Add(time.Minute)
+	_, _ = dl.Download("https://slow.example.com/a.png", Validators{})
+
+	if _, err := dl.Download("https://slow.example.com/a.png", Validators{}); !errors.Is(err, ErrCircuitOpen) {
+		t.Error("expected:", ErrCircuitOpen, "got:", err)
+	}
+}
+
+func TestOriginLimiter_NotFoundIsNoFailure(t *testing.T) {
+	limiter := NewOriginLimiter(1, time.Millisecond*10, 1, time.Minute)
+	dl := limiter.Wrap(DownloaderFunc(func(string, Validators) (*Download, error) {
+		return nil, ErrFileNotFound
+	}))
+
+	_, _ = dl.Download("https://example.com/missing.png", Validators{})
+	if _, err := dl.Download("https://example.com/missing.png", Validators{}); !errors.Is(err, ErrFileNotFound) {
+		t.Error("expected:", ErrFileNotFound, "got:", err)
+	}
+}
+
+func TestOriginLimiter_Busy(t *testing.T) {
+	limiter := NewOriginLimiter(1, time.Millisecond*10, 5, time.Minute)
+	block := make(chan struct{})
+	started := make(chan struct{})
+	dl := limiter.Wrap(DownloaderFunc(func(string, Validators) (*Download, error) {
+		close(started)
+		<-block
+		return nil, nil
+	}))
+
+	go func() { _, _ = dl.Download("https://example.com/a.png", Validators{}) }()
+	<-started
+
+	if _, err := dl.Download("https://example.com/b.png", Validators{}); !errors.Is(err, ErrOriginBusy) {
+		t.Error("expected:", ErrOriginBusy, "got:", err)
+	}
+	close(block)
+}
+
+func TestOriginLimiter_EvictsIdleHosts(t *testing.T) {
+	now := time.Now()
+	limiter := NewOriginLimiter(1, time.Millisecond*10, 1, time.Minute)
+	limiter.now = func() time.Time { return now }
+	dl := limiter.Wrap(DownloaderFunc(func(string, Validators) (*Download, error) {
+		return &Download{Data: []byte("img")}, nil
+	}))
+
+	for i := 0; i <= maxOrigins; i++ {
+		now = now.Add(time.Second)
+		if _, err := dl.Download(fmt.Sprintf("https://host%d.example.com/a.png", i), Validators{}); err != nil {
+			t.Fatal("expected:", nil, "got:", err)
+		}
+	}
+
+	status := limiter.Status()
+	if len(status) != maxOrigins {
+		t.Fatal("expected:", maxOrigins, "got:", len(status))
+	}
+	// the least recently used host was forgotten
+	for _, s := range status {
+		if s.Host == "host0.example.com" {
+			t.Error("expected:", "host0.example.com evicted", "got:", s)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+var (
+	ErrForbiddenHost = errors.New("host is not allowed")
+	ErrRedirect      = errors.New("redirect not allowed")
+)
+
+// HostPolicy decides which origins the worker may download from. Entries of the allow and deny
+// lists match the host itself and all of its subdomains. An empty allow list allows every host
+// which is not denied.
+type HostPolicy struct {
+	Allowed     []string
+	Denied      []string
+	DenyPrivate bool
+}
+
+// Check returns ErrForbiddenHost if u must not be requested
+func (p *HostPolicy) Check(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: scheme %s", ErrForbiddenHost, u.Scheme)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return fmt.Errorf("%w: empty host", ErrForbiddenHost)
+	}
+
+	for _, d := range p.Denied {
+		if matchesHost(host, d) {
+			return fmt.Errorf("%w: %s", ErrForbiddenHost, host)
+		}
+	}
+
+	if len(p.Allowed) > 0 {
+		allowed := false
+		for _, a := range p.Allowed {
+			if matchesHost(host, a) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("%w: %s", ErrForbiddenHost, host)
+		}
+	}
+
+	if ip := net.ParseIP(host); ip != nil && p.DenyPrivate && isPrivateIP(ip) {
+		return fmt.Errorf("%w: %s", ErrForbiddenHost, host)
+	}
+
+	return nil
+}
+
+// dialControl rejects connections to private addresses after DNS resolution, so host names which
+// resolve into private networks are caught as well
+func (p *HostPolicy) dialControl(_, address string, _ syscall.RawConn) error {
+	if !p.DenyPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip != nil && isPrivateIP(ip) {
+		return fmt.Errorf("%w: %s resolves to a private address", ErrForbiddenHost, address)
+	}
+	return nil
+}
+
+// HostMatches reports whether the host of rawUrl is one of the patterns or a subdomain of one
+func HostMatches(rawUrl string, patterns []string) bool {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, p := range patterns {
+		if matchesHost(host, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesHost(host, pattern string) bool {
+	pattern = strings.ToLower(strings.TrimPrefix(pattern, "."))
+	return host == pattern || strings.HasSuffix(host, "."+pattern)
+}
+
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified()
+}
@@ -0,0 +1,38 @@
+package internal
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestHostPolicy_Check(t *testing.T) {
+	policy := &HostPolicy{
+		Allowed:     []string{"example.com", "10.0.0.1"},
+		Denied:      []string{"evil.example.com"},
+		DenyPrivate: true,
+	}
+
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{url: "https://example.com/a.png"},
+		{url: "https://cdn.Example.com/a.png"},
+		{url: "http://example.com/a.png"},
+		{url: "https://notexample.com/a.png", wantErr: true},
+		{url: "https://evil.example.com/a.png", wantErr: true},
+		{url: "https://img.evil.example.com/a.png", wantErr: true},
+		{url: "ftp://example.com/a.png", wantErr: true},
+		{url: "https://10.0.0.1/a.png", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			u, _ := url.Parse(tt.url)
+			err := policy.Check(u)
+			if tt.wantErr != errors.Is(err, ErrForbiddenHost) {
+				t.Errorf("Check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -6,12 +6,48 @@ import (
 )
 
 var (
-	CachedImages = promauto.NewCounter(prometheus.CounterOpts{
+	CachedImages = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "imgproxy_cached_images_total",
 		Help: "The total number of cached images on this node",
 	})
-	CachedImageBytes = promauto.NewCounter(prometheus.CounterOpts{
+	CachedImageBytes = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "imgproxy_cached_images_bytes",
 		Help: "The total size of all images stored on this node",
 	})
+	// the origin metrics are not labeled by host, hosts come from user supplied urls
+	OriginInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "imgproxy_origin_inflight_downloads",
+		Help: "The number of downloads currently running to all origins",
+	})
+	OriginBreakers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "imgproxy_origin_breakers",
+		Help: "The number of tracked origin hosts per circuit breaker state (closed, half-open, open)",
+	}, []string{"state"})
+	OriginRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "imgproxy_origin_rejected_total",
+		Help: "The total number of downloads rejected per reason (circuit_open, busy)",
+	}, []string{"reason"})
+	Revalidations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "imgproxy_revalidations_total",
+		Help: "The total number of conditional requests to origins by result (modified, not_modified)",
+	}, []string{"result"})
+	ProcessingQueueWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "imgproxy_processing_queue_wait_seconds",
+		Help:    "The time images wait for a free processing slot",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	})
+	ProcessingDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "imgproxy_processing_duration_seconds",
+		Help:    "The time it takes to process an image once it got a slot",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+	})
+	ProcessingRejections = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "imgproxy_processing_rejected_total",
+		Help: "The total number of images rejected because the processing queue was full",
+	})
+	OptimizationSavings = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "imgproxy_optimization_savings_ratio",
+		Help:    "The share of bytes saved by optimizing images per format, 0 if the original was smaller",
+		Buckets: prometheus.LinearBuckets(0, 0.05, 20),
+	}, []string{"format"})
 )